@@ -0,0 +1,80 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// the default templates and files are part of the binary, files in the configured directories shadow them by name
+//
+//go:embed templates/*.html
+var embeddedTemplates embed.FS
+
+//go:embed files/*
+var embeddedFiles embed.FS
+
+//go:embed i18n/*.json
+var embeddedTranslations embed.FS
+
+// overlayFS opens a name from the first layer that has it
+type overlayFS []fs.FS
+
+func (layers overlayFS) Open(name string) (fs.File, error) {
+	var firstErr error
+	for _, layer := range layers {
+		file, err := layer.Open(name)
+		if err == nil {
+			return file, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return nil, firstErr
+}
+
+// ReadDir lists a directory of all layers, an entry of an earlier layer shadows entries with the same name
+func (layers overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	var entries []fs.DirEntry
+	found := false
+	for _, layer := range layers {
+		layerEntries, err := fs.ReadDir(layer, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		found = true
+		for _, entry := range layerEntries {
+			if !slices.ContainsFunc(entries, func(e fs.DirEntry) bool { return e.Name() == entry.Name() }) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	if !found {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	slices.SortFunc(entries, func(a fs.DirEntry, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+// siteFiles are the files served at /files/, the configured file directory with the files of the theme and the embedded files as fallback
+func siteFiles(config BlogConfiguration, theme Theme) fs.FS {
+	embedded, _ := fs.Sub(embeddedFiles, "files")
+	var layers overlayFS
+	if config.FileDir != "" {
+		layers = append(layers, os.DirFS(config.FileDir))
+	}
+	if theme.Dir != "" {
+		layers = append(layers, os.DirFS(filepath.Join(theme.Dir, "files")))
+	}
+	return append(layers, embedded)
+}
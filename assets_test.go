@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEmbeddedTemplateOverrides(t *testing.T) {
+	tmpl, err := loadTemplates(BlogConfiguration{TemplateDir: filepath.Join(t.TempDir(), "missing")}, Theme{})
+	if err != nil || tmpl.Lookup("_base.html") == nil || tmpl.Lookup("index.html") == nil {
+		t.Fatalf("The embedded templates should be used without a template directory, got %v", err)
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "error.html"), []byte("custom {{.}}"), 0700)
+	tmpl, err = loadTemplates(BlogConfiguration{TemplateDir: dir}, Theme{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output strings.Builder
+	tmpl.ExecuteTemplate(&output, "error.html", "error")
+	if output.String() != "custom error" || tmpl.Lookup("post.html") == nil {
+		t.Fatalf("A template should only shadow the embedded template of the same name, got %v", output.String())
+	}
+}
+
+func TestEmbeddedFileOverrides(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "golb.css"), []byte("custom"), 0700)
+	blogConfig.Set(BlogConfiguration{FileDir: dir})
+	defer blogConfig.Set(BlogConfiguration{})
+	handler := http.StripPrefix("/files/", http.HandlerFunc(fileHandler))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/files/golb.css", nil))
+	if recorder.Body.String() != "custom" {
+		t.Fatal("Files in the file directory should shadow the embedded files")
+	}
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/files/sakura.min.css", nil))
+	if recorder.Code != http.StatusOK || recorder.Body.Len() == 0 {
+		t.Fatal("Embedded files should be served when they aren't overridden")
+	}
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/files/missing.css", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatal("Unknown files should not be found")
+	}
+
+	entries, err := fs.ReadDir(siteFiles(BlogConfiguration{FileDir: filepath.Join(dir, "missing")}, Theme{}), ".")
+	if err != nil || len(entries) == 0 {
+		t.Fatalf("The embedded files should be used without a file directory, got %v", err)
+	}
+}
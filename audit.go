@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const AUDIT_LOGIN string = "login"
+const AUDIT_LOGIN_FAILED string = "login_failed"
+const AUDIT_LOGOUT string = "logout"
+const AUDIT_PUBLISH string = "publish"
+const AUDIT_EDIT string = "edit"
+const AUDIT_DELETE string = "delete"
+const AUDIT_USER_SAVE string = "user_save"
+const AUDIT_USER_DELETE string = "user_delete"
+const AUDIT_2FA string = "2fa"
+const AUDIT_SESSION_REVOKE string = "session_revoke"
+const AUDIT_CONFIG_RELOAD string = "config_reload"
+const AUDIT_THEME string = "theme"
+
+var auditActions []string = []string{AUDIT_LOGIN, AUDIT_LOGIN_FAILED, AUDIT_LOGOUT, AUDIT_PUBLISH, AUDIT_EDIT, AUDIT_DELETE,
+	AUDIT_USER_SAVE, AUDIT_USER_DELETE, AUDIT_2FA, AUDIT_SESSION_REVOKE, AUDIT_CONFIG_RELOAD, AUDIT_THEME}
+
+// the page shows at most this many events, the csv export contains all matching events
+const AUDIT_PAGE_SIZE int = 200
+
+var auditLog AuditLog = newMemoryAuditLog(1000)
+
+type AuditEvent struct {
+	Time       time.Time
+	Action     string
+	Actor      string `json:",omitempty"`
+	IP         string `json:",omitempty"`
+	RequestID  string `json:",omitempty"`
+	PostID     string `json:",omitempty"`
+	HashBefore string `json:",omitempty"`
+	HashAfter  string `json:",omitempty"`
+	Detail     string `json:",omitempty"`
+}
+
+// AuditLog is append only, events can't be changed or removed through golb
+type AuditLog interface {
+	Record(event AuditEvent) error
+	List() ([]AuditEvent, error)
+}
+
+// memoryAuditLog keeps the most recent events when no audit file is configured
+type memoryAuditLog struct {
+	events []AuditEvent
+	limit  int
+	mutex  sync.Mutex
+}
+
+func newMemoryAuditLog(limit int) *memoryAuditLog {
+	return &memoryAuditLog{events: []AuditEvent{}, limit: limit}
+}
+
+func (log *memoryAuditLog) Record(event AuditEvent) error {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	log.events = append(log.events, event)
+	if len(log.events) > log.limit {
+		log.events = slices.Clone(log.events[len(log.events)-log.limit:])
+	}
+	return nil
+}
+
+func (log *memoryAuditLog) List() ([]AuditEvent, error) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	return slices.Clone(log.events), nil
+}
+
+// fileAuditLog appends every event as a json line, the file can be shipped and rotated by external tools
+type fileAuditLog struct {
+	filename string
+	mutex    sync.Mutex
+}
+
+func newFileAuditLog(filename string) (*fileAuditLog, error) {
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	return &fileAuditLog{filename: filename}, nil
+}
+
+func (log *fileAuditLog) Record(event AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	file, err := os.OpenFile(log.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (log *fileAuditLog) List() ([]AuditEvent, error) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	file, err := os.Open(log.filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []AuditEvent = []AuditEvent{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var event AuditEvent
+		// a line cut off by a crash shouldn't hide the rest of the log
+		if json.Unmarshal(scanner.Bytes(), &event) == nil {
+			events = append(events, event)
+		}
+	}
+	return events, scanner.Err()
+}
+
+// recordAudit adds the client ip and request id of r to the event and records it in the log of the site,
+// r is nil for events without a request like reloads, which go to the default site
+func recordAudit(r *http.Request, event AuditEvent) {
+	event.Time = time.Now().UTC()
+	if r != nil {
+		event.IP = clientIP(r, blogConfig.Get().TrustedProxies)
+		event.RequestID = requestID(r)
+	}
+
+	site := defaultSite
+	if r != nil {
+		site = requestSite(r)
+	}
+	err := site.Audit().Record(event)
+	if err != nil {
+		slog.Error("couldn't write audit log", "site", site.Name, "action", event.Action, "error", err)
+	}
+}
+
+func contentHash(filebytes []byte) string {
+	sum := sha256.Sum256(filebytes)
+	return hex.EncodeToString(sum[:])
+}
+
+// postFileHash returns the hash of a post file, or an empty string when it doesn't exist
+func postFileHash(filename string, postdir string) string {
+	filebytes, err := os.ReadFile(filepath.Join(postdir, filename))
+	if err != nil {
+		return ""
+	}
+	return contentHash(filebytes)
+}
+
+type AuditFilter struct {
+	Action string
+	Actor  string
+	PostID string
+	Since  string
+	Until  string
+}
+
+func (filter AuditFilter) Match(event AuditEvent) bool {
+	if filter.Action != "" && event.Action != filter.Action {
+		return false
+	}
+	if filter.Actor != "" && !strings.Contains(strings.ToLower(event.Actor), strings.ToLower(filter.Actor)) {
+		return false
+	}
+	if filter.PostID != "" && !strings.Contains(event.PostID, filter.PostID) {
+		return false
+	}
+	since, err := time.Parse(time.DateOnly, filter.Since)
+	if err == nil && event.Time.Before(since) {
+		return false
+	}
+	until, err := time.Parse(time.DateOnly, filter.Until)
+	if err == nil && !event.Time.Before(until.AddDate(0, 0, 1)) {
+		return false
+	}
+	return true
+}
+
+// filterAuditEvents returns the matching events, newest first
+func filterAuditEvents(events []AuditEvent, filter AuditFilter) []AuditEvent {
+	var matching []AuditEvent = []AuditEvent{}
+	for i := len(events) - 1; i >= 0; i-- {
+		if filter.Match(events[i]) {
+			matching = append(matching, events[i])
+		}
+	}
+	return matching
+}
+
+func writeAuditCSV(w http.ResponseWriter, events []AuditEvent) error {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="golb-audit.csv"`)
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"time", "action", "actor", "ip", "request_id", "post_id", "hash_before", "hash_after", "detail"})
+	for _, event := range events {
+		writer.Write([]string{event.Time.Format(time.RFC3339), event.Action, csvSafe(event.Actor), event.IP, event.RequestID, csvSafe(event.PostID), event.HashBefore, event.HashAfter, csvSafe(event.Detail)})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// csvSafe keeps spreadsheet programs from evaluating user controlled values as formulas
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsAny(value[:1], "=+-@\t\r") {
+		return "'" + value
+	}
+	return value
+}
+
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	config := requestSite(r).Config()
+	logger := requestLogger(r)
+	user, _, err := currentUser(r, config)
+	if err != nil {
+		redirect(w, r, "/login", 307)
+		return
+	}
+	if !user.IsAdmin() {
+		renderError(w, r, forbidden("Only admins can view the audit log!"))
+		return
+	}
+	if r.Method != "GET" {
+		renderError(w, r, methodNotAllowed("GET"))
+		return
+	}
+
+	query := r.URL.Query()
+	filter := AuditFilter{Action: query.Get("action"), Actor: query.Get("actor"), PostID: query.Get("post"), Since: query.Get("since"), Until: query.Get("until")}
+	events, err := siteOf(config).Audit().List()
+	if err != nil {
+		renderError(w, r, internalError(fmt.Errorf("couldn't read audit log: %w", err)))
+		return
+	}
+	events = filterAuditEvents(events, filter)
+
+	if query.Get("format") == "csv" {
+		err = writeAuditCSV(w, events)
+		if err != nil {
+			logger.Error("couldn't export audit log", "error", err)
+		}
+		return
+	}
+
+	data := AuditListData{Filter: filter, Actions: auditActions, Events: events, ExportQuery: exportQuery(r)}
+	if len(events) > AUDIT_PAGE_SIZE {
+		data.Events = events[:AUDIT_PAGE_SIZE]
+		data.Truncated = true
+	}
+	renderPage(w, r, "audit.html", data)
+}
+
+// exportQuery is the query of the current filter as csv export, it is encoded already so templates keep its & and =
+func exportQuery(r *http.Request) template.URL {
+	query := r.URL.Query()
+	query.Set("format", "csv")
+	return template.URL(query.Encode())
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileAuditLog(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.jsonl")
+	log, err := newFileAuditLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Record(AuditEvent{Time: time.Now(), Action: AUDIT_LOGIN, Actor: "alice"})
+
+	// a partially written line must not hide the other events
+	file, _ := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0600)
+	file.WriteString(`{"Action":"pub`)
+	file.WriteString("\n")
+	file.Close()
+	log.Record(AuditEvent{Time: time.Now(), Action: AUDIT_DELETE, Actor: "bob", PostID: "hello"})
+
+	log, err = newFileAuditLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := log.List()
+	if err != nil || len(events) != 2 || events[0].Actor != "alice" || events[1].PostID != "hello" {
+		t.Fatal("Audit events should be appended and read back in order")
+	}
+}
+
+func TestMemoryAuditLogLimit(t *testing.T) {
+	log := newMemoryAuditLog(2)
+	for _, action := range []string{AUDIT_LOGIN, AUDIT_PUBLISH, AUDIT_LOGOUT} {
+		log.Record(AuditEvent{Action: action})
+	}
+	events, _ := log.List()
+	if len(events) != 2 || events[0].Action != AUDIT_PUBLISH {
+		t.Fatal("Memory audit log should keep only the most recent events")
+	}
+}
+
+func TestFilterAuditEvents(t *testing.T) {
+	day := time.Date(2025, 2, 5, 12, 0, 0, 0, time.UTC)
+	events := []AuditEvent{
+		{Time: day.AddDate(0, 0, -1), Action: AUDIT_PUBLISH, Actor: "alice", PostID: "hello"},
+		{Time: day, Action: AUDIT_EDIT, Actor: "bob", PostID: "hello"},
+		{Time: day, Action: AUDIT_LOGIN, Actor: "Alice"},
+	}
+
+	matching := filterAuditEvents(events, AuditFilter{Actor: "alice"})
+	if len(matching) != 2 || matching[0].Action != AUDIT_LOGIN {
+		t.Fatal("Filtering by actor should be case insensitive and return the newest events first")
+	}
+	matching = filterAuditEvents(events, AuditFilter{PostID: "hello", Since: "2025-02-05", Until: "2025-02-05"})
+	if len(matching) != 1 || matching[0].Action != AUDIT_EDIT {
+		t.Fatal("Filtering by post and date range should match only events on that day")
+	}
+}
+
+func TestPublishEditDeleteAudited(t *testing.T) {
+	postDir := t.TempDir()
+	auditLog = newMemoryAuditLog(100)
+	sessionStore = newMemorySessionStore()
+	userStore = newMemoryUserStore()
+	config := BlogConfiguration{Hash: "filler", PostDir: postDir, TemplateDir: "templates", SessionTimeout: 60, RememberMeDays: 30}
+	blogConfig.Set(config)
+	reloadTemplates()
+
+	recorder := httptest.NewRecorder()
+	session, _ := createSession(recorder, httptest.NewRequest("POST", "/login", nil), config, LEGACY_ADMIN, false)
+	cookie := recorder.Result().Cookies()[0]
+	post := func(target string, form string) {
+		r := newFormRequest(target, form+"&csrf_token="+session.CSRFToken)
+		r.AddCookie(cookie)
+		if strings.HasPrefix(target, "/delete/") {
+			r.SetPathValue("postId", strings.TrimPrefix(target, "/delete/"))
+			deletePostHandler(httptest.NewRecorder(), r)
+		} else {
+			createPostHandler(httptest.NewRecorder(), r)
+		}
+	}
+
+	post("/create", "title=Hello&data=first&publish=on")
+	post("/create", "title=Hello&data=second&publish=on")
+	post("/delete/hello", "")
+
+	events, _ := auditLog.List()
+	if len(events) != 3 || events[0].Action != AUDIT_PUBLISH || events[1].Action != AUDIT_EDIT || events[2].Action != AUDIT_DELETE {
+		t.Fatalf("Publish, edit and delete should be audited, got %v", events)
+	}
+	if events[0].HashBefore != "" || events[1].HashBefore != events[0].HashAfter || events[2].HashBefore != events[1].HashAfter || events[1].HashAfter == events[0].HashAfter {
+		t.Fatal("Audit events should chain the content hashes of the post")
+	}
+	if events[2].PostID != "hello" || events[2].Actor != LEGACY_ADMIN {
+		t.Fatal("Audit events should contain the post and actor")
+	}
+
+	recorder = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/audit?format=csv&action=edit", nil)
+	r.AddCookie(cookie)
+	auditHandler(recorder, r)
+	rows, err := csv.NewReader(recorder.Body).ReadAll()
+	if err != nil || len(rows) != 2 || rows[1][1] != AUDIT_EDIT {
+		t.Fatal("Audit log should be exportable as filtered csv")
+	}
+}
+
+func TestCSVSafe(t *testing.T) {
+	if csvSafe("=HYPERLINK(\"x\")") != "'=HYPERLINK(\"x\")" || csvSafe("alice") != "alice" {
+		t.Fatal("Values starting with formula characters should be escaped")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var forwardedHostPattern *regexp.Regexp = regexp.MustCompile(`^([a-zA-Z0-9.-]+|\[[0-9a-fA-F:.]+\])(:[0-9]{1,5})?$`)
+
+// parseBasePath accepts the path golb is served under like /blog and removes the trailing slash, / means no base path
+func parseBasePath(value string) (string, error) {
+	if value == "" || value == "/" {
+		return "", nil
+	}
+	cleaned := path.Clean(value)
+	if !strings.HasPrefix(value, "/") || cleaned != strings.TrimSuffix(value, "/") || strings.ContainsAny(value, "?#{}% ") {
+		return "", errors.New(value + " must be a clean path like /blog")
+	}
+	return cleaned, nil
+}
+
+// basePathOf returns the path of a base url, which is the default base path
+func basePathOf(baseURL string) string {
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(parsed.Path, "/")
+}
+
+// redirect sends the browser to a page of the blog below the base path
+func redirect(w http.ResponseWriter, r *http.Request, target string, code int) {
+	http.Redirect(w, r, requestSite(r).Config().BasePath+target, code)
+}
+
+// requestBaseURL is the public url of the blog, -baseurl when set, otherwise built from the request,
+// using X-Forwarded-Proto and X-Forwarded-Host when the request came from a trusted proxy
+func requestBaseURL(r *http.Request, config BlogConfiguration) string {
+	if config.BaseURL != "" {
+		return config.BaseURL
+	}
+	scheme := "http"
+	if isHTTPS(r, config) {
+		scheme = "https"
+	}
+	return scheme + "://" + forwardedHost(r, config) + config.BasePath
+}
+
+func forwardedHost(r *http.Request, config BlogConfiguration) string {
+	addr, ok := remoteAddr(r)
+	if ok && isTrustedProxy(addr, config.TrustedProxies) {
+		host := forwardedValue(r, "X-Forwarded-Host")
+		if forwardedHostPattern.MatchString(host) {
+			return host
+		}
+	}
+	return r.Host
+}
+
+// forwardedValue returns the value the first proxy added to a forwarded header
+func forwardedValue(r *http.Request, header string) string {
+	value, _, _ := strings.Cut(r.Header.Get(header), ",")
+	return strings.TrimSpace(value)
+}
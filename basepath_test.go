@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestParseBasePath(t *testing.T) {
+	valid := map[string]string{"": "", "/": "", "/blog": "/blog", "/blog/": "/blog", "/sites/blog": "/sites/blog"}
+	for value, expected := range valid {
+		basePath, err := parseBasePath(value)
+		if err != nil || basePath != expected {
+			t.Fatalf("Expected %q for %q, got %q %v", expected, value, basePath, err)
+		}
+	}
+	for _, value := range []string{"blog", "/blog//posts", "/blog/../x", "/blog?x=1", "/{blog}"} {
+		_, err := parseBasePath(value)
+		if err == nil {
+			t.Fatalf("%q should be rejected", value)
+		}
+	}
+
+	config, err := parseFlags([]string{"-baseurl", "https://example.com/blog/"})
+	if err != nil || config.BasePath != "/blog" {
+		t.Fatalf("The base path should default to the path of the base url, got %q %v", config.BasePath, err)
+	}
+	_, err = parseFlags([]string{"-baseurl", "https://example.com/blog", "-basepath", "/other"})
+	if err == nil {
+		t.Fatal("A base url outside the base path should be rejected")
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	postDir := t.TempDir()
+	writeTestPost(t, postDir, "Hello")
+	defaultSite.SetConfig(BlogConfiguration{Title: "Sub", BasePath: "/blog", PostDir: postDir, TemplateDir: "templates", PostsPerPage: 10, ViewOnly: true})
+	err := reloadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshPosts()
+	mux := http.NewServeMux()
+	registerPublicRoutes(mux, "/blog")
+
+	serve := func(target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("GET", target, nil))
+		return recorder
+	}
+	body := serve("/blog/").Body.String()
+	for _, expected := range []string{`href="/blog/posts/hello"`, `href="/blog/"`, `href="/blog/files/golb.css?v=`} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("Links should start with the base path, expected %v in %v", expected, body)
+		}
+	}
+	if recorder := serve("/blog/posts/hello"); recorder.Code != http.StatusOK {
+		t.Fatalf("Posts should be served below the base path, got %v", recorder.Code)
+	}
+	if recorder := serve("/blog/files/golb.css"); recorder.Code != http.StatusOK {
+		t.Fatalf("Files should be served below the base path, got %v", recorder.Code)
+	}
+	if recorder := serve("/posts/hello"); recorder.Code != http.StatusNotFound {
+		t.Fatalf("Pages outside the base path shouldn't be served, got %v", recorder.Code)
+	}
+	if recorder := serve("/blog"); recorder.Code != http.StatusMovedPermanently || recorder.Header().Get("Location") != "/blog/" {
+		t.Fatalf("The base path should redirect to the index, got %v %v", recorder.Code, recorder.Header().Get("Location"))
+	}
+	if recorder := serve("/blog/favicon.ico"); recorder.Header().Get("Location") != "/blog/files/favicon.ico" {
+		t.Fatalf("Redirects should stay below the base path, got %v", recorder.Header().Get("Location"))
+	}
+}
+
+func TestRequestBaseURL(t *testing.T) {
+	config := BlogConfiguration{BasePath: "/blog", TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	r := httptest.NewRequest("GET", "/blog/", nil)
+	r.Host = "internal:8080"
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "example.com, internal")
+	if baseURL := requestBaseURL(r, config); baseURL != "https://example.com/blog" {
+		t.Fatalf("Forwarded headers of trusted proxies should be used, got %v", baseURL)
+	}
+
+	r.RemoteAddr = "192.0.2.1:1234"
+	if baseURL := requestBaseURL(r, config); baseURL != "http://internal:8080/blog" {
+		t.Fatalf("Forwarded headers of other clients should be ignored, got %v", baseURL)
+	}
+
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-Host", "evil.com/path")
+	if baseURL := requestBaseURL(r, config); baseURL != "https://internal:8080/blog" {
+		t.Fatalf("Invalid forwarded hosts should be ignored, got %v", baseURL)
+	}
+
+	config.BaseURL = "https://blog.example.com/blog"
+	if baseURL := requestBaseURL(r, config); baseURL != config.BaseURL {
+		t.Fatalf("The configured base url should take precedence, got %v", baseURL)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// linkPattern matches the link attributes rewritten in exported pages
+var linkPattern *regexp.Regexp = regexp.MustCompile(`\b(href|src|action)="([^"]*)"`)
+
+// BUILD_MANIFEST lists the files of the last export, files of it the next export doesn't write again are removed
+const BUILD_MANIFEST string = ".golb-build"
+
+type buildResult struct {
+	Pages     int
+	Files     int
+	Written   int
+	Unchanged int
+	Removed   int
+}
+
+func runBuild(args []string, stdin io.Reader, stdout io.Writer) error {
+	buildFlags := flag.NewFlagSet("golb build", flag.ContinueOnError)
+	out := buildFlags.String("out", "", "specifies the directory the static site is written to")
+	siteName := buildFlags.String("site", DEFAULT_SITE, "specifies the site to export")
+	args, err := splitCommandFlags(args, buildFlags)
+	if err != nil {
+		return err
+	}
+	config, _, err := parseConfiguration(args)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		return errors.New("usage: golb build -out dir [-site name] [flags]")
+	}
+
+	site, host, err := buildSite(config, *siteName)
+	if err != nil {
+		return err
+	}
+	result, err := exportSite(site, host, *out)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "exported %v pages and %v files to %v, %v written, %v unchanged, %v removed\n", result.Pages, result.Files, *out, result.Written, result.Unchanged, result.Removed)
+	return nil
+}
+
+// buildSite loads templates and posts of the site like the server does on startup and returns the host it is served on
+func buildSite(config BlogConfiguration, name string) (*Site, string, error) {
+	site, host := defaultSite, "localhost"
+	if config.BaseURL != "" {
+		baseURL, _ := url.Parse(config.BaseURL)
+		host = baseURL.Host
+	}
+	// exported links are relative or start with -baseurl, which already contains the base path
+	config.BasePath = ""
+	sites.Set(nil)
+	defaultSite.SetConfig(config)
+
+	if name != DEFAULT_SITE {
+		site = nil
+		for _, siteConfig := range config.Sites {
+			if siteConfig.Name == name {
+				site = newSite(siteConfig.Name, siteConfig.Hosts)
+				siteConfig.Config.BasePath = ""
+				site.SetConfig(siteConfig.Config)
+				host = siteConfig.Hosts[0]
+			}
+		}
+		if site == nil {
+			return nil, "", errors.New("unknown site " + name)
+		}
+		sites.Set([]*Site{site})
+	}
+
+	err := site.reloadTemplates()
+	if err != nil {
+		return nil, "", errors.New("couldn't load templates: " + err.Error())
+	}
+	err = site.refreshPosts()
+	if err != nil {
+		return nil, "", errors.New("couldn't read posts: " + err.Error())
+	}
+	return site, host, nil
+}
+
+// staticPages maps every public page of the site to the file it is exported to, pages become directories so their urls stay the same
+func staticPages(site *Site) map[string]string {
+	pages := map[string]string{"/": "index.html", "/posts": "posts/index.html"}
+	posts := site.sortedPostIndex.Get()
+	perPage := site.Config().PostsPerPage
+	if perPage < 1 {
+		perPage = DEFAULT_POSTS_PER_PAGE
+	}
+	for page := 1; page < pageCount(len(posts), perPage); page++ {
+		pages["/page/"+strconv.Itoa(page)] = "page/" + strconv.Itoa(page) + "/index.html"
+	}
+	for _, post := range posts {
+		id, err := url.PathUnescape(post.URL)
+		if err != nil || !filepath.IsLocal(id) || strings.ContainsAny(id, `/\`) {
+			continue
+		}
+		pages["/posts/"+post.URL] = "posts/" + id + "/index.html"
+	}
+	return pages
+}
+
+// exportSite renders the public pages through the same handlers as the server and copies the files
+func exportSite(site *Site, host string, out string) (buildResult, error) {
+	config := site.Config()
+	mux := http.NewServeMux()
+	registerPublicRoutes(mux, config.BasePath)
+
+	result := buildResult{}
+	var names []string
+	write := func(name string, data []byte) error {
+		names = append(names, name)
+		written, err := writeIfChanged(filepath.Join(out, filepath.FromSlash(name)), data)
+		if written {
+			result.Written++
+		} else if err == nil {
+			result.Unchanged++
+		}
+		return err
+	}
+
+	pages := staticPages(site)
+	for page, name := range pages {
+		r := httptest.NewRequest("GET", page, nil)
+		r.Host = host
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, r)
+		if recorder.Code != http.StatusOK {
+			return result, fmt.Errorf("%v returned status %v", page, recorder.Code)
+		}
+		err := write(name, rewriteLinks(recorder.Body.Bytes(), page, name, config.BaseURL, pages))
+		if err != nil {
+			return result, err
+		}
+		result.Pages++
+	}
+
+	r := httptest.NewRequest("GET", "/404.html", nil)
+	r.Host = host
+	recorder := httptest.NewRecorder()
+	renderError(recorder, r, notFound("Page not found!"))
+	err := write("404.html", rewriteLinks(recorder.Body.Bytes(), "/404.html", "404.html", config.BaseURL, pages))
+	if err != nil {
+		return result, err
+	}
+	result.Pages++
+
+	files := siteFiles(config, config.theme)
+	err = fs.WalkDir(files, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(files, name)
+		if err != nil {
+			return err
+		}
+		result.Files++
+		return write(path.Join("files", name), data)
+	})
+	if err != nil {
+		return result, err
+	}
+
+	result.Removed, err = removeStaleFiles(out, names)
+	return result, err
+}
+
+// removeStaleFiles deletes the files of the previous export that weren't written again, like pages of deleted posts,
+// and records the written files for the next export. Files golb didn't write are never touched.
+func removeStaleFiles(out string, names []string) (int, error) {
+	manifest := filepath.Join(out, BUILD_MANIFEST)
+	previous, err := os.ReadFile(manifest)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+
+	current := map[string]bool{}
+	for _, name := range names {
+		current[name] = true
+	}
+	removed := 0
+	for _, name := range strings.Split(string(previous), "\n") {
+		if name == "" || current[name] || !filepath.IsLocal(filepath.FromSlash(name)) {
+			continue
+		}
+		err = os.Remove(filepath.Join(out, filepath.FromSlash(name)))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return removed, err
+		}
+		removed++
+		// directories of removed posts are left empty, non-empty ones fail to be removed and stay
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if os.Remove(filepath.Join(out, filepath.FromSlash(dir))) != nil {
+				break
+			}
+		}
+	}
+
+	slices.Sort(names)
+	return removed, writeFileAtomic(manifest, []byte(strings.Join(names, "\n")+"\n"), 0644)
+}
+
+// rewriteLinks resolves the links of an exported page against its url and points them to the base url,
+// or makes them relative so the export works from any directory
+func rewriteLinks(body []byte, page string, name string, baseURL string, pages map[string]string) []byte {
+	prefix := strings.TrimSuffix(baseURL, "/")
+	if baseURL == "" {
+		prefix = strings.TrimSuffix(strings.Repeat("../", strings.Count(name, "/")), "/")
+		if prefix == "" {
+			prefix = "."
+		}
+	}
+	base, _ := url.Parse(page)
+	return linkPattern.ReplaceAllFunc(body, func(match []byte) []byte {
+		parts := linkPattern.FindSubmatch(match)
+		link := string(parts[2])
+		target, suffix := link, ""
+		if index := strings.IndexAny(link, "?#"); index != -1 {
+			target, suffix = link[:index], link[index:]
+		}
+		reference, err := url.Parse(target)
+		if err != nil || target == "" || reference.Scheme != "" || reference.Host != "" {
+			return match
+		}
+		target = base.ResolveReference(reference).EscapedPath()
+		if _, ok := pages[target]; ok && target != "/" {
+			target += "/"
+		}
+		return []byte(string(parts[1]) + `="` + prefix + target + suffix + `"`)
+	})
+}
+
+// writeIfChanged only replaces a file when its content changed, so syncing the export only uploads what changed
+func writeIfChanged(filename string, data []byte) (bool, error) {
+	existing, err := os.ReadFile(filename)
+	if err == nil && bytes.Equal(existing, data) {
+		return false, nil
+	}
+	err = os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return false, err
+	}
+	err = writeFileAtomic(filename, data, 0644)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
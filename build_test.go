@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuild(t *testing.T) {
+	postDir, fileDir, out := t.TempDir(), t.TempDir(), t.TempDir()
+	writeTestPost(t, postDir, "First post")
+	writeTestPost(t, postDir, "Second post")
+	os.WriteFile(filepath.Join(postDir, "links.md"), []byte("### Links\n---\n[first](first%20post) ![cat](/files/img/cat.png)"), 0700)
+	os.MkdirAll(filepath.Join(fileDir, "img"), 0700)
+	os.WriteFile(filepath.Join(fileDir, "img", "cat.png"), []byte("cat"), 0700)
+	defer defaultSite.SetConfig(blogConfig.Get())
+
+	args := []string{"-out", out, "-postdir", postDir, "-filedir", fileDir, "-postsperpage", "2"}
+	var stdout bytes.Buffer
+	err := runBuild(args, nil, &stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"index.html", "posts/index.html", "page/1/index.html", "posts/first post/index.html", "posts/links/index.html", "404.html", "files/img/cat.png"} {
+		_, err := os.Stat(filepath.Join(out, name))
+		if err != nil {
+			t.Fatalf("Build should export %v: %v", name, err)
+		}
+	}
+
+	page, _ := os.ReadFile(filepath.Join(out, "posts", "links", "index.html"))
+	for _, expected := range []string{`href="../../posts/first%20post/"`, `src="../../files/img/cat.png"`, `href="../../"`} {
+		if !strings.Contains(string(page), expected) {
+			t.Fatalf("Exported links should be relative, expected %v in %v", expected, string(page))
+		}
+	}
+	errorPage, _ := os.ReadFile(filepath.Join(out, "404.html"))
+	if !strings.Contains(string(errorPage), "Page not found!") {
+		t.Fatal("Build should export the error page")
+	}
+
+	stdout.Reset()
+	err = runBuild(args, nil, &stdout)
+	if err != nil || !strings.Contains(stdout.String(), "0 written") {
+		t.Fatalf("Unchanged pages shouldn't be rewritten, got %v %v", stdout.String(), err)
+	}
+
+	err = runBuild(append(args, "-baseurl", "https://example.com/blog"), nil, &stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ = os.ReadFile(filepath.Join(out, "posts", "links", "index.html"))
+	if !strings.Contains(string(page), `href="https://example.com/blog/posts/first%20post/"`) {
+		t.Fatalf("Exported links should use the base url, got %v", string(page))
+	}
+
+	os.WriteFile(filepath.Join(out, "robots.txt"), []byte("own file"), 0600)
+	os.Remove(filepath.Join(postDir, generatePostFilename("Second post")))
+	stdout.Reset()
+	err = runBuild(args, nil, &stdout)
+	if err != nil || !strings.Contains(stdout.String(), "2 removed") {
+		t.Fatalf("The page of the deleted post and the second index page should be removed, got %v %v", stdout.String(), err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "posts", "second post")); !os.IsNotExist(err) {
+		t.Fatalf("The directory of a deleted post should be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "robots.txt")); err != nil {
+		t.Fatalf("Files golb didn't write should be kept, got %v", err)
+	}
+
+	err = runBuild([]string{"-postdir", postDir}, nil, &stdout)
+	if err == nil {
+		t.Fatal("Build should require an output directory")
+	}
+}
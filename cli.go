@@ -0,0 +1,353 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/yuin/goldmark"
+)
+
+// commands are the subcommands besides serve, they get the arguments after the command name
+var commands map[string]func(args []string, stdin io.Reader, stdout io.Writer) error = map[string]func(args []string, stdin io.Reader, stdout io.Writer) error{
+	"new":           runNewPost,
+	"list":          runListPosts,
+	"check":         runCheck,
+	"render":        runRenderPost,
+	"build":         runBuild,
+	"hash-password": runHashPassword,
+	"config":        runConfig,
+	"help": func(args []string, stdin io.Reader, stdout io.Writer) error {
+		printUsage(stdout)
+		return nil
+	},
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, `usage: golb [command] [flags]
+
+commands:
+  serve                  serve the blog, the default when no command is given
+  new "Title"            create an empty post in the post directory
+  list                   list published posts and drafts with their dates
+  check                  validate all posts and templates and report broken headers and links
+  render <file>          print the html of a post
+  build -out dir         export the blog as static html files, -site selects the site to export
+  hash-password          read a password from stdin and print its argon2id hash
+  config check           validate the configuration and print every setting
+  help                   print this help
+
+every command takes the flags of serve, see golb -h`)
+}
+
+// splitCommandFlags parses the flags only a command knows and returns the remaining arguments for parseCommandLine
+func splitCommandFlags(args []string, command *flag.FlagSet) ([]string, error) {
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return append(rest, args[i:]...), nil
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		f := command.Lookup(name)
+		if !strings.HasPrefix(arg, "-") || f == nil {
+			rest = append(rest, arg)
+			continue
+		}
+		if !hasValue {
+			if boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && boolFlag.IsBoolFlag() {
+				value = "true"
+			} else if i+1 < len(args) {
+				i++
+				value = args[i]
+			} else {
+				return nil, errors.New("flag needs an argument: -" + name)
+			}
+		}
+		err := command.Set(name, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q for flag -%v: %w", value, name, err)
+		}
+	}
+	return rest, nil
+}
+
+func runConfig(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 || args[0] != "check" {
+		return errors.New("usage: golb config check [flags]")
+	}
+	return runConfigCheck(args[1:], stdout)
+}
+
+// runNewPost scaffolds a post with the title and the current time, it never overwrites an existing post
+func runNewPost(args []string, stdin io.Reader, stdout io.Writer) error {
+	config, _, arguments, err := parseCommandLine(args)
+	if err != nil {
+		return err
+	}
+	if len(arguments) != 1 || strings.TrimSpace(arguments[0]) == "" {
+		return errors.New(`usage: golb new [flags] "Title"`)
+	}
+	title := strings.TrimSpace(arguments[0])
+	if strings.ContainsAny(title, "\r\n") {
+		return errors.New("the title can't contain line breaks")
+	}
+
+	post, err := buildPost(CreatePostData{Title: title}, config.location())
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(config.PostDir, generatePostFilename(title))
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0700)
+	if errors.Is(err, fs.ErrExist) {
+		return errors.New(filename + " already exists")
+	} else if err != nil {
+		return err
+	}
+	_, err = file.Write(post)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(stdout, filename)
+	return nil
+}
+
+type postEntry struct {
+	PostHeader
+	Status   string
+	Filename string
+}
+
+// listPosts reads the headers of all posts and drafts in the post directory, newest first
+func listPosts(postDir string) ([]postEntry, error) {
+	var entries []postEntry
+	for status, pattern := range map[string]string{"published": "*.md", "draft": "_createpost*.temp"} {
+		filenames, err := filepath.Glob(filepath.Join(postDir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, filename := range filenames {
+			entry := postEntry{Status: status, Filename: filename}
+			header, err := readPostHeader(filepath.Base(filename), postDir)
+			if err != nil {
+				entry.Status = "invalid"
+				entry.Title = err.Error()
+			} else {
+				entry.PostHeader = header
+			}
+			entries = append(entries, entry)
+		}
+	}
+	slices.SortStableFunc(entries, func(a postEntry, b postEntry) int {
+		if order := comparePostHeaders(a.PostHeader, b.PostHeader); order != 0 {
+			return order
+		}
+		return strings.Compare(a.Filename, b.Filename)
+	})
+	return entries, nil
+}
+
+func runListPosts(args []string, stdin io.Reader, stdout io.Writer) error {
+	config, _, err := parseConfiguration(args)
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "SITE\tSTATUS\tDATE\tTITLE\tFILE")
+	for _, site := range configuredSites(config) {
+		entries, err := listPosts(site.Config.PostDir)
+		if err != nil {
+			return fmt.Errorf("site %v: %w", site.Name, err)
+		}
+		for _, entry := range entries {
+			date := "-"
+			timestamp, err := time.Parse(time.RFC1123, entry.Timestamp)
+			if err == nil {
+				date = timestamp.In(site.Config.location()).Format("2006-01-02 15:04")
+			} else if entry.Timestamp != "" {
+				date = entry.Timestamp
+			}
+			fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\n", site.Name, entry.Status, date, entry.Title, entry.Filename)
+		}
+	}
+	return writer.Flush()
+}
+
+// requiredTemplates are the templates rendered by the handlers, the management pages only matter with credentials
+func requiredTemplates(config BlogConfiguration) []string {
+	required := []string{"_base.html", "index.html", "post.html", "error.html"}
+	if !config.isPasswordless() {
+		required = append(required, "login.html", "logintotp.html", "2fa.html", "create.html", "delete.html", "confirmdelete.html", "sessions.html", "users.html", "audit.html", "themes.html")
+	}
+	return required
+}
+
+// checkTemplates parses the templates and renders the public pages with the posts to find errors that only show up when executing
+func checkTemplates(config BlogConfiguration, posts []PostData) []string {
+	tmpl, err := loadTemplates(config, config.theme)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var problems []string
+	for _, name := range requiredTemplates(config) {
+		if tmpl.Lookup(name) == nil {
+			problems = append(problems, filepath.Join(config.TemplateDir, name)+": missing template")
+		}
+	}
+
+	var headers []PostHeader
+	for _, post := range posts {
+		headers = append(headers, post.PostHeader)
+		if tmpl.Lookup("post.html") != nil {
+			err = tmpl.ExecuteTemplate(io.Discard, "post.html", PageParameters[PostData]{PageData: post})
+			if err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+	pages := map[string]any{
+		"index.html": PageParameters[[]PostHeader]{PageData: headers, CurrentPage: 1, NextPage: 2, TotalPages: 3, Pages: pageLinks(1, 3)},
+		"error.html": "Page not found!",
+		"404.html":   "Page not found!",
+		"500.html":   INTERNAL_ERROR_MESSAGE,
+		"_base.html": TemplateData{Title: config.Title},
+	}
+	for name, data := range pages {
+		if tmpl.Lookup(name) != nil {
+			err = tmpl.ExecuteTemplate(io.Discard, name, data)
+			if err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+	return slices.Compact(problems)
+}
+
+// checkPost validates the header of a post and that its links to posts and files exist
+func checkPost(filename string, config BlogConfiguration, md goldmark.Markdown) (PostData, []string) {
+	filebytes, err := os.ReadFile(filepath.Join(config.PostDir, filename))
+	if err != nil {
+		return PostData{}, []string{err.Error()}
+	}
+	post, err := parsePost(filebytes, filename, md)
+	if err != nil {
+		return PostData{}, []string{err.Error()}
+	}
+
+	var problems []string
+	if strings.TrimSpace(post.Title) == "" {
+		problems = append(problems, "missing title")
+	}
+	if _, err := time.Parse(time.RFC1123, post.Timestamp); post.Timestamp != "" && err != nil {
+		problems = append(problems, fmt.Sprintf("invalid timestamp %q, expected a date like %q", post.Timestamp, time.RFC1123))
+	}
+
+	base := &url.URL{Path: config.BasePath + "/posts/"}
+	for _, link := range postLinks(filebytes, md) {
+		target, err := url.Parse(link)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("invalid link %q", link))
+			continue
+		}
+		if target.Scheme != "" || target.Host != "" || target.Path == "" {
+			continue
+		}
+		path := strings.TrimPrefix(base.ResolveReference(target).Path, config.BasePath)
+		if id, ok := strings.CutPrefix(path, "/posts/"); ok && id != "" {
+			_, err = os.Stat(filepath.Join(config.PostDir, url.PathEscape(id)+".md"))
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("broken link %q, there is no post %v", link, id))
+			}
+		} else if name, ok := strings.CutPrefix(path, "/files/"); ok && name != "" {
+			_, err = os.Stat(filepath.Join(config.FileDir, filepath.FromSlash(name)))
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("broken link %q, there is no file %v in %v", link, name, config.FileDir))
+			}
+		}
+	}
+	return post, problems
+}
+
+func runCheck(args []string, stdin io.Reader, stdout io.Writer) error {
+	config, _, err := parseConfiguration(args)
+	if err != nil {
+		return err
+	}
+
+	count, checked := 0, 0
+	for _, site := range configuredSites(config) {
+		prefix := ""
+		if site.Name != DEFAULT_SITE {
+			prefix = "site " + site.Name + ": "
+		}
+		report := func(problem string) {
+			fmt.Fprintln(stdout, prefix+problem)
+			count++
+		}
+
+		filenames, err := generatePostFilenamesList(site.Config.PostDir)
+		if err != nil {
+			return err
+		}
+		md := newMarkdown(site.Config)
+		var posts []PostData
+		for _, filename := range filenames {
+			post, problems := checkPost(filename, site.Config, md)
+			for _, problem := range problems {
+				report(filepath.Join(site.Config.PostDir, filename) + ": " + problem)
+			}
+			if len(problems) == 0 {
+				posts = append(posts, post)
+			}
+		}
+		for _, problem := range checkTemplates(site.Config, posts) {
+			report(problem)
+		}
+		checked += len(filenames)
+	}
+
+	if count > 0 {
+		return fmt.Errorf("found %v problems", count)
+	}
+	fmt.Fprintf(stdout, "checked %v posts, no problems found\n", checked)
+	return nil
+}
+
+// runRenderPost prints the html of a post file as the server renders it
+func runRenderPost(args []string, stdin io.Reader, stdout io.Writer) error {
+	config, _, arguments, err := parseCommandLine(args)
+	if err != nil {
+		return err
+	}
+	if len(arguments) != 1 {
+		return errors.New("usage: golb render [flags] <file>")
+	}
+
+	filebytes, err := os.ReadFile(arguments[0])
+	if err != nil {
+		return err
+	}
+	post, err := parsePost(filebytes, filepath.Base(arguments[0]), newMarkdown(config))
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(stdout, string(post.Text))
+	return err
+}
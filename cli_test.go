@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewAndListPosts(t *testing.T) {
+	dir := t.TempDir()
+	var stdout bytes.Buffer
+	err := runNewPost([]string{"-postdir", dir, "My post", "-timezone", "UTC"}, nil, &stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := strings.TrimSpace(stdout.String())
+	if filename != filepath.Join(dir, "my%20post.md") {
+		t.Fatalf("New post should be written to the post directory, got %v", filename)
+	}
+	header, err := readPostHeader("my%20post.md", dir)
+	if err != nil || header.Title != "My post" || !strings.HasSuffix(header.Timestamp, "UTC") {
+		t.Fatalf("New post should have a valid header, got %v %v", header, err)
+	}
+	err = runNewPost([]string{"-postdir", dir, "My post"}, nil, &stdout)
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatal("New shouldn't overwrite existing posts")
+	}
+
+	os.WriteFile(filepath.Join(dir, draftFilename("alice")), []byte("### Draft\n---\n"), 0700)
+	os.WriteFile(filepath.Join(dir, "broken.md"), []byte("no header"), 0700)
+	stdout.Reset()
+	err = runListPosts([]string{"-postdir", dir}, nil, &stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"published", "My post", "draft", "Draft", "invalid", "broken.md"} {
+		if !strings.Contains(stdout.String(), expected) {
+			t.Fatalf("List should contain %v, got %v", expected, stdout.String())
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	postDir, fileDir := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(fileDir, "cat.png"), []byte{}, 0700)
+	os.WriteFile(filepath.Join(postDir, "hello.md"), []byte("### Hello\n---\n[other](other) ![cat](/files/cat.png) [web](https://example.com)"), 0700)
+	os.WriteFile(filepath.Join(postDir, "other.md"), []byte("### Other\n###### Mon, 02 Jan 2006 15:04:05 MST\n---\n[back](/posts/hello#top)"), 0700)
+	args := []string{"-postdir", postDir, "-filedir", fileDir}
+
+	var stdout bytes.Buffer
+	err := runCheck(args, nil, &stdout)
+	if err != nil {
+		t.Fatalf("Valid posts should pass the check, got %v %v", err, stdout.String())
+	}
+
+	os.WriteFile(filepath.Join(postDir, "broken.md"), []byte("### Broken\n###### yesterday\n---\n[gone](/posts/gone) ![dog](/files/dog.png)"), 0700)
+	stdout.Reset()
+	err = runCheck(args, nil, &stdout)
+	if err == nil || err.Error() != "found 3 problems" {
+		t.Fatalf("Check should report every problem, got %v", err)
+	}
+	for _, expected := range []string{`invalid timestamp "yesterday"`, "no post gone", "no file dog.png"} {
+		if !strings.Contains(stdout.String(), expected) {
+			t.Fatalf("Check should report %v, got %v", expected, stdout.String())
+		}
+	}
+
+	templateDir := t.TempDir()
+	os.WriteFile(filepath.Join(templateDir, "post.html"), []byte("{{.PageData.Missing}}"), 0700)
+	stdout.Reset()
+	err = runCheck(append(args, "-templatedir", templateDir), nil, &stdout)
+	if err == nil || !strings.Contains(stdout.String(), "can't evaluate field Missing") {
+		t.Fatalf("Check should report template errors, got %v", stdout.String())
+	}
+}
+
+func TestRenderPost(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "post.md")
+	os.WriteFile(filename, []byte("### Title\n---\n~~gone~~"), 0700)
+	var stdout bytes.Buffer
+	err := runRenderPost([]string{filename, "-markdownextensions", "strikethrough"}, nil, &stdout)
+	if err != nil || !strings.Contains(stdout.String(), "<del>gone</del>") {
+		t.Fatalf("Render should print the html of the post, got %v %v", stdout.String(), err)
+	}
+	err = runRenderPost(nil, nil, &stdout)
+	if err == nil {
+		t.Fatal("Render should require a file")
+	}
+}
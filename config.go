@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+// settings whose values are never printed
+var secretSettings []string = []string{"password", "passwordhash", "oidcclientsecret"}
+
+// settings that apply to the whole process and can't be changed per site
+var processSettings []string = []string{"config", "basepath", "port", "metricsport", "tlscert", "tlskey", "tlsselfsigned", "redirectport", "shutdowntimeout", "loglevel", "logformat", "watch", "trustedproxies",
+	"loginratelimit", "loginfreefailures", "loginmaxlockout", "loginglobalfailures"}
+
+// settings that sites don't inherit from the default site, so credentials and stores stay separate
+var siteOnlySettings []string = []string{"baseurl", "password", "passwordhash", "credentialsfile", "usersfile", "sessionfile", "auditfile",
+	"oidcissuer", "oidcclientid", "oidcclientsecret", "oidcredirecturl", "oidcallowed"}
+
+var sitePattern *regexp.Regexp = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+var envPattern *regexp.Regexp = regexp.MustCompile(`\(env: (GOLB_[A-Z0-9_]+)\)`)
+
+// ConfigSetting is the effective value of a flag and where it came from, one of flag, env, file or default
+type ConfigSetting struct {
+	Name   string
+	Value  string
+	Source string
+}
+
+// siteSettings are the values of one entry in the sites list of the config file
+type siteSettings struct {
+	Name     string
+	Hosts    []string
+	Values   map[string]string
+	Filename string
+}
+
+// flagEnv returns the environment variable of a flag, every flag names it in its usage text
+func flagEnv(f *flag.Flag) string {
+	match := envPattern.FindStringSubmatch(f.Usage)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// applyConfigSources fills every flag that wasn't given on the command line from the environment or the config file.
+// Precedence is flags, environment, config file and finally the defaults of the flag set.
+func applyConfigSources(flags *flag.FlagSet) ([]ConfigSetting, []siteSettings, error) {
+	explicit := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	// the config file itself can only be given as flag or environment variable
+	configEnv := os.Getenv("GOLB_CONFIG")
+	if !explicit["config"] && configEnv != "" {
+		flags.Set("config", configEnv)
+	}
+	filename := flags.Lookup("config").Value.String()
+	fileValues := map[string]string{}
+	var sites []siteSettings
+	if filename != "" {
+		values, fileSites, err := readConfigFile(filename, flags)
+		if err != nil {
+			return nil, nil, err
+		}
+		fileValues = values
+		sites = fileSites
+	}
+
+	var settings []ConfigSetting
+	var errs []error
+	flags.VisitAll(func(f *flag.Flag) {
+		source := "default"
+		env := flagEnv(f)
+		fileValue, inFile := fileValues[f.Name]
+		if explicit[f.Name] {
+			source = "flag"
+		} else if env != "" && os.Getenv(env) != "" {
+			source = "env " + env
+			err := flags.Set(f.Name, os.Getenv(env))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid value %q for %v, expected %v", os.Getenv(env), env, expectedValue(f)))
+			}
+		} else if inFile {
+			source = "file " + filename
+			err := flags.Set(f.Name, fileValue)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid value %q for %v in %v, expected %v", fileValue, f.Name, filename, expectedValue(f)))
+			}
+		}
+		settings = append(settings, ConfigSetting{Name: f.Name, Value: f.Value.String(), Source: source})
+	})
+	return settings, sites, errors.Join(errs...)
+}
+
+// readConfigFile reads a json object whose keys are flag names, unknown keys and values of the wrong type are rejected.
+// Additional sites are listed under sites, each with a name, its hosts and the settings that differ from the default site.
+func readConfigFile(filename string, flags *flag.FlagSet) (map[string]string, []siteSettings, error) {
+	filebytes, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var raw map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(filebytes))
+	decoder.UseNumber()
+	err = decoder.Decode(&raw)
+	if err != nil {
+		var syntaxError *json.SyntaxError
+		if errors.As(err, &syntaxError) {
+			line := bytes.Count(filebytes[:syntaxError.Offset], []byte("\n")) + 1
+			return nil, nil, fmt.Errorf("%v:%v: %v", filename, line, err)
+		}
+		return nil, nil, fmt.Errorf("%v: the config file must contain a single json object: %v", filename, err)
+	}
+	if decoder.More() {
+		return nil, nil, fmt.Errorf("%v: the config file must contain a single json object", filename)
+	}
+
+	var sites []siteSettings
+	var errs []error
+	rawSites, ok := raw["sites"]
+	delete(raw, "sites")
+	if ok {
+		entries, ok := rawSites.([]any)
+		if !ok {
+			errs = append(errs, fmt.Errorf("invalid value for sites in %v: expected a list of sites", filename))
+		}
+		for i, entry := range entries {
+			site, err := readSiteSettings(entry, i, filename, flags)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			sites = append(sites, site)
+		}
+	}
+
+	values, err := settingValues(raw, flags, filename)
+	return values, sites, errors.Join(append(errs, err)...)
+}
+
+func readSiteSettings(entry any, index int, filename string, flags *flag.FlagSet) (siteSettings, error) {
+	raw, ok := entry.(map[string]any)
+	if !ok {
+		return siteSettings{}, fmt.Errorf("invalid site %v in %v: expected an object with name, hosts and settings", index+1, filename)
+	}
+
+	name, _ := raw["name"].(string)
+	if !sitePattern.MatchString(name) || name == DEFAULT_SITE {
+		return siteSettings{}, fmt.Errorf("invalid site %v in %v: the name must consist of 1 to 32 lowercase letters, digits, - or _ and can't be %v", index+1, filename, DEFAULT_SITE)
+	}
+	where := fmt.Sprintf("%v (site %v)", filename, name)
+
+	var hosts []string
+	rawHosts, _ := raw["hosts"].([]any)
+	for _, rawHost := range rawHosts {
+		host, ok := rawHost.(string)
+		if !ok || host == "" {
+			return siteSettings{}, fmt.Errorf("invalid hosts in %v: expected a list of host names", where)
+		}
+		hosts = append(hosts, strings.TrimSuffix(strings.ToLower(host), "."))
+	}
+	if len(hosts) == 0 {
+		return siteSettings{}, fmt.Errorf("invalid hosts in %v: a site needs at least one host", where)
+	}
+	delete(raw, "name")
+	delete(raw, "hosts")
+
+	var errs []error
+	for key := range raw {
+		if slices.Contains(processSettings, key) {
+			errs = append(errs, fmt.Errorf("%v can't be set per site in %v, it applies to all sites", key, where))
+			delete(raw, key)
+		}
+	}
+	values, err := settingValues(raw, flags, where)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return siteSettings{Name: name, Hosts: hosts, Values: values, Filename: filename}, errors.Join(errs...)
+}
+
+// settingValues converts the json values of known settings into their flag form
+func settingValues(raw map[string]any, flags *flag.FlagSet, where string) (map[string]string, error) {
+	var names []string
+	for name := range raw {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	values := map[string]string{}
+	var errs []error
+	for _, name := range names {
+		f := flags.Lookup(name)
+		if f == nil || name == "config" {
+			message := fmt.Sprintf("unknown setting %q in %v", name, where)
+			suggestion := suggestSetting(name, flags)
+			if suggestion != "" {
+				message += fmt.Sprintf(", did you mean %q?", suggestion)
+			}
+			errs = append(errs, errors.New(message))
+			continue
+		}
+		value, err := configValue(raw[name], f)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid value for %v in %v: %v", name, where, err))
+			continue
+		}
+		values[name] = value
+	}
+	return values, errors.Join(errs...)
+}
+
+// configValue converts a json value into the string form the flag parses
+func configValue(value any, f *flag.Flag) (string, error) {
+	kind, _ := flag.UnquoteUsage(f)
+	switch v := value.(type) {
+	case bool:
+		if kind == "" {
+			return fmt.Sprint(v), nil
+		}
+	case json.Number:
+		if kind == "int" {
+			return v.String(), nil
+		}
+	case string:
+		if kind == "string" {
+			return v, nil
+		}
+	case []any:
+		separator := listSeparator(f)
+		if kind != "string" || separator == "" {
+			break
+		}
+		var items []string
+		for _, item := range v {
+			text, ok := item.(string)
+			if !ok {
+				return "", errors.New("expected a list of strings")
+			}
+			items = append(items, text)
+		}
+		return strings.Join(items, separator), nil
+	case map[string]any:
+		separator := listSeparator(f)
+		if kind != "string" || separator == "" || !strings.Contains(f.Usage, "option=value") {
+			break
+		}
+		var items []string
+		for _, name := range slices.Sorted(maps.Keys(v)) {
+			switch item := v[name].(type) {
+			case string, bool:
+				items = append(items, fmt.Sprintf("%v=%v", name, item))
+			default:
+				return "", errors.New("expected an object of strings and booleans")
+			}
+		}
+		return strings.Join(items, separator), nil
+	}
+	return "", fmt.Errorf("expected %v", expectedValue(f))
+}
+
+func listSeparator(f *flag.Flag) string {
+	if strings.Contains(f.Usage, "comma separated") {
+		return ","
+	}
+	if strings.Contains(f.Usage, "space separated") {
+		return " "
+	}
+	if strings.Contains(f.Usage, "semicolon separated") {
+		return ";"
+	}
+	return ""
+}
+
+func expectedValue(f *flag.Flag) string {
+	kind, _ := flag.UnquoteUsage(f)
+	switch {
+	case kind == "":
+		return "true or false"
+	case kind == "int":
+		return "a whole number"
+	case listSeparator(f) != "":
+		return "a string or a list of strings"
+	}
+	return "a string"
+}
+
+// suggestSetting returns the flag that was most likely meant by an unknown setting, or an empty string
+func suggestSetting(name string, flags *flag.FlagSet) string {
+	normalized := strings.ToLower(strings.NewReplacer("_", "", "-", "", ".", "").Replace(name))
+	suggestion := ""
+	best := 3
+	flags.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		if f.Name == normalized || flagEnv(f) == name {
+			suggestion = f.Name
+			best = -1
+			return
+		}
+		distance := editDistance(normalized, f.Name)
+		if distance < best {
+			suggestion = f.Name
+			best = distance
+		}
+	})
+	return suggestion
+}
+
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// siteConfiguration builds the configuration of a site, settings it doesn't set are inherited from the default site
+func siteConfiguration(defaults []ConfigSetting, site siteSettings) (SiteConfiguration, error) {
+	flags, build := configurationFlags()
+	var settings []ConfigSetting
+	var errs []error
+	for _, setting := range defaults {
+		value, ok := site.Values[setting.Name]
+		if ok {
+			setting = ConfigSetting{Name: setting.Name, Value: value, Source: "file " + site.Filename}
+		} else if slices.Contains(siteOnlySettings, setting.Name) {
+			setting = ConfigSetting{Name: setting.Name, Value: flags.Lookup(setting.Name).DefValue, Source: "default"}
+		}
+		err := flags.Set(setting.Name, setting.Value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid value %q for %v of site %v, expected %v", setting.Value, setting.Name, site.Name, expectedValue(flags.Lookup(setting.Name))))
+		}
+		settings = append(settings, setting)
+	}
+	if len(errs) > 0 {
+		return SiteConfiguration{}, errors.Join(errs...)
+	}
+
+	config, err := build(settings)
+	if err != nil {
+		return SiteConfiguration{}, fmt.Errorf("site %v: %w", site.Name, err)
+	}
+	return SiteConfiguration{Name: site.Name, Hosts: site.Hosts, Config: config, Settings: settings}, nil
+}
+
+// validateSites makes sure sites don't share hosts, posts or stores
+func validateSites(config BlogConfiguration) error {
+	names := map[string]bool{}
+	hosts := map[string]string{}
+	files := map[string]string{config.PostDir: DEFAULT_SITE}
+	for _, file := range []string{config.SessionFile, config.UsersFile, config.AuditFile} {
+		if file != "" {
+			files[file] = DEFAULT_SITE
+		}
+	}
+
+	for _, site := range config.Sites {
+		if names[site.Name] {
+			return errors.New("site " + site.Name + " is configured twice")
+		}
+		names[site.Name] = true
+		if site.Config.BaseURL != "" && basePathOf(site.Config.BaseURL) != config.BasePath {
+			return fmt.Errorf("baseurl %v of site %v isn't below the base path %q of the default site, all sites share one base path, set -basepath", site.Config.BaseURL, site.Name, config.BasePath)
+		}
+
+		for _, host := range site.Hosts {
+			other, exists := hosts[host]
+			if exists {
+				return fmt.Errorf("host %v is used by site %v and %v", host, other, site.Name)
+			}
+			hosts[host] = site.Name
+		}
+
+		for _, file := range []string{site.Config.PostDir, site.Config.SessionFile, site.Config.UsersFile, site.Config.AuditFile} {
+			if file == "" {
+				continue
+			}
+			other, exists := files[file]
+			if exists {
+				return fmt.Errorf("site %v and %v can't share %v, every site needs its own post directory and files", other, site.Name, file)
+			}
+			files[file] = site.Name
+		}
+	}
+	return nil
+}
+
+// settingError names the setting and where its value came from
+func settingError(settings []ConfigSetting, name string, err error) error {
+	for _, setting := range settings {
+		if setting.Name == name {
+			return fmt.Errorf("invalid %v (%v): %w", name, setting.Source, err)
+		}
+	}
+	return fmt.Errorf("invalid %v: %w", name, err)
+}
+
+// runConfigCheck validates the configuration and prints the effective settings with secrets redacted
+func runConfigCheck(args []string, stdout io.Writer) error {
+	config, settings, err := parseConfiguration(args)
+	if err != nil {
+		return err
+	}
+
+	err = checkDirectories(config, settings)
+	if err != nil {
+		return err
+	}
+	printSettings(stdout, settings)
+	if config.isPasswordless() {
+		fmt.Fprintln(stdout, "no password, users file or single sign-on configured, the default site runs in view only mode")
+	}
+
+	for _, site := range config.Sites {
+		err = checkDirectories(site.Config, site.Settings)
+		if err != nil {
+			return fmt.Errorf("site %v: %w", site.Name, err)
+		}
+		fmt.Fprintf(stdout, "\nsite %v, serving %v\n", site.Name, strings.Join(site.Hosts, ", "))
+		printSettings(stdout, site.Settings)
+		if site.Config.isPasswordless() {
+			fmt.Fprintf(stdout, "no password, users file or single sign-on configured, site %v runs in view only mode\n", site.Name)
+		}
+	}
+	fmt.Fprintln(stdout, "configuration is valid")
+	return nil
+}
+
+func checkDirectories(config BlogConfiguration, settings []ConfigSetting) error {
+	_, err := loadTemplates(config, config.theme)
+	if err != nil {
+		return settingError(settings, "templatedir", err)
+	}
+	info, err := os.Stat(config.PostDir)
+	if err != nil {
+		return settingError(settings, "postdir", err)
+	} else if !info.IsDir() {
+		return settingError(settings, "postdir", errors.New(config.PostDir+" is not a directory"))
+	}
+	return nil
+}
+
+func printSettings(stdout io.Writer, settings []ConfigSetting) {
+	writer := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "SETTING\tVALUE\tSOURCE")
+	for _, setting := range settings {
+		value := fmt.Sprintf("%q", setting.Value)
+		if slices.Contains(secretSettings, setting.Name) && setting.Value != "" {
+			value = "[redacted]"
+		}
+		fmt.Fprintf(writer, "%v\t%v\t%v\n", setting.Name, value, setting.Source)
+	}
+	writer.Flush()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	filename := filepath.Join(t.TempDir(), "golb.json")
+	err := os.WriteFile(filename, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func findSetting(settings []ConfigSetting, name string) ConfigSetting {
+	for _, setting := range settings {
+		if setting.Name == name {
+			return setting
+		}
+	}
+	return ConfigSetting{}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	filename := writeConfigFile(t, `{
+	"title": "From file",
+	"port": 9000,
+	"postsperpage": 5,
+	"watch": true,
+	"trustedproxies": ["10.0.0.0/8", "127.0.0.1"],
+	"timezone": "Europe/Berlin"
+}`)
+	t.Setenv("GOLB_CONFIG", filename)
+	t.Setenv("GOLB_PORT", "9001")
+
+	config, settings, err := parseConfiguration([]string{"-title", "From flag"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Title != "From flag" || config.Port != 9001 || config.PostsPerPage != 5 || !config.Watch || len(config.TrustedProxies) != 2 || config.TemplateDir != "templates" {
+		t.Fatal("Flags should override the environment, which overrides the config file, which overrides defaults")
+	}
+	if config.location().String() != "Europe/Berlin" || config.ConfigFile != filename {
+		t.Fatal("Time zone should be loaded from the config file")
+	}
+	if findSetting(settings, "title").Source != "flag" || findSetting(settings, "port").Source != "env GOLB_PORT" ||
+		findSetting(settings, "postsperpage").Source != "file "+filename || findSetting(settings, "templatedir").Source != "default" {
+		t.Fatal("Settings should record where their value came from")
+	}
+}
+
+func TestConfigFileValidation(t *testing.T) {
+	cases := map[string]string{
+		`{"titel": "Typo"}`:                    `did you mean "title"?`,
+		`{"GOLB_PORT": 9000}`:                  `did you mean "port"?`,
+		`{"port": "9000"}`:                     "expected a whole number",
+		`{"port": 9000.5}`:                     "expected a whole number",
+		`{"watch": "yes"}`:                     "expected true or false",
+		`{"title": ["a", "b"]}`:                "expected a string",
+		`{"port": 70000}`:                      "must be between 1 and 65535",
+		`{"postsperpage": 0}`:                  "invalid postsperpage (file ",
+		`{"timezone": "Mars/Olympus"}`:         "timezone",
+		`{"baseurl": "blog.example.com"}`:      "absolute http or https url",
+		`{"markdownextensions": ["tables"]}`:   "unknown markdown extension tables",
+		`{"config": "other.json"}`:             `unknown setting "config"`,
+		"{\n\"title\": \"Golb\",\n\"port\": }": ":3:",
+		`{"title": "Golb"} {"port": 9000}`:     "single json object",
+	}
+	for content, expected := range cases {
+		_, _, err := parseConfiguration([]string{"-config", writeConfigFile(t, content)})
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("Config %v should fail with %v, got %v", content, expected, err)
+		}
+	}
+}
+
+func TestConfigInvalidEnvironment(t *testing.T) {
+	t.Setenv("GOLB_PORT", "abc")
+	_, _, err := parseConfiguration([]string{})
+	if err == nil || !strings.Contains(err.Error(), "GOLB_PORT") {
+		t.Fatalf("Invalid environment variables should be rejected, got %v", err)
+	}
+}
+
+func TestConfigBaseURL(t *testing.T) {
+	filename := writeConfigFile(t, `{"baseurl": "https://blog.example.com/", "oidcissuer": "https://id.example.com", "oidcclientid": "golb", "oidcallowed": ["email:alice@example.com"]}`)
+	config, err := parseFlags([]string{"-config", filename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.BaseURL != "https://blog.example.com" || config.OIDCRedirectURL != "https://blog.example.com/login/oidc/callback" {
+		t.Fatal("The redirect url should default to the base url")
+	}
+}
+
+func TestConfigCheck(t *testing.T) {
+	hashed, err := hashPassword("secret", testArgon2Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := writeConfigFile(t, `{"oidcclientsecret": "verysecret", "title": "Checked"}`)
+
+	var output strings.Builder
+	err = runConfigCheck([]string{"-config", filename, "-passwordhash", hashed}, &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(output.String(), "verysecret") || strings.Contains(output.String(), hashed) || !strings.Contains(output.String(), "[redacted]") {
+		t.Fatal("Secrets should be redacted")
+	}
+	if !strings.Contains(output.String(), `"Checked"`) || !strings.Contains(output.String(), "configuration is valid") {
+		t.Fatal("Effective settings should be printed")
+	}
+
+	templateDir := t.TempDir()
+	os.WriteFile(filepath.Join(templateDir, "index.html"), []byte("{{.Title"), 0700)
+	err = runConfigCheck([]string{"-templatedir", templateDir}, &output)
+	if err == nil {
+		t.Fatal("Check should fail with broken templates")
+	}
+}
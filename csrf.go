@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const CSRF_COOKIE string = "golb_csrf"
+const CSRF_FIELD string = "csrf_token"
+
+// csrfToken returns the token forms need to include. Logged in users get the synchronizer token of their session,
+// anonymous users (the login form) get a double submit token which is stored in a cookie when it doesn't exist yet.
+func csrfToken(w http.ResponseWriter, r *http.Request, bc BlogConfiguration) string {
+	session, err := currentSession(r, bc)
+	if err == nil {
+		return session.CSRFToken
+	}
+
+	cookie, err := r.Cookie(CSRF_COOKIE)
+	if err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return ""
+	}
+	http.SetCookie(w, &http.Cookie{Name: CSRF_COOKIE, Value: token, Path: bc.BasePath + "/", Secure: true, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	// later calls for the same request need to see the new token too
+	r.AddCookie(&http.Cookie{Name: CSRF_COOKIE, Value: token})
+	return token
+}
+
+// sameOrigin checks the Origin header, or the Referer when no Origin is sent, against the public host of the request,
+// which behind trusted proxies is the forwarded one. Requests over https don't accept http origins.
+func sameOrigin(r *http.Request, bc BlogConfiguration) bool {
+	source := r.Header.Get("Origin")
+	if source == "" || source == "null" {
+		source = r.Header.Get("Referer")
+	}
+	if source == "" {
+		return r.Header.Get("Origin") != "null"
+	}
+
+	parsed, err := url.Parse(source)
+	if err != nil {
+		return false
+	}
+	if isHTTPS(r, bc) && parsed.Scheme != "https" {
+		return false
+	}
+	return strings.EqualFold(parsed.Host, forwardedHost(r, bc))
+}
+
+// checkCSRF validates the token of a state changing request, the form has to be parsed already
+func checkCSRF(r *http.Request, bc BlogConfiguration) error {
+	if !sameOrigin(r, bc) {
+		return errors.New("cross origin request")
+	}
+
+	submitted := r.PostFormValue(CSRF_FIELD)
+	if submitted == "" {
+		submitted = r.Header.Get("X-CSRF-Token")
+	}
+	if submitted == "" {
+		return errors.New("missing csrf token")
+	}
+
+	var expected string
+	session, err := currentSession(r, bc)
+	if err == nil {
+		expected = session.CSRFToken
+	} else {
+		cookie, err := r.Cookie(CSRF_COOKIE)
+		if err != nil {
+			return errors.New("missing csrf cookie")
+		}
+		expected = cookie.Value
+	}
+
+	if expected == "" || subtle.ConstantTimeCompare([]byte(submitted), []byte(expected)) != 1 {
+		return errors.New("invalid csrf token")
+	}
+	return nil
+}
+
+func renderCSRFError(w http.ResponseWriter, r *http.Request, err error) {
+	requestLogger(r).Warn("rejected request", "error", err, "remote_addr", clientIP(r, blogConfig.Get().TrustedProxies))
+	renderError(w, r, forbidden("This form has expired, please reload the page and try again."))
+}
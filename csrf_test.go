@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func newFormRequest(target string, body string) *http.Request {
+	r := httptest.NewRequest("POST", target, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.ParseForm()
+	return r
+}
+
+func TestCheckCSRFSession(t *testing.T) {
+	sessionStore = newMemorySessionStore()
+	config := BlogConfiguration{Hash: "filler", SessionTimeout: 60, RememberMeDays: 30}
+
+	recorder := httptest.NewRecorder()
+	session, err := createSession(recorder, httptest.NewRequest("POST", "/login", nil), config, LEGACY_ADMIN, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := recorder.Result().Cookies()[0]
+
+	r := newFormRequest("/create", "title=test")
+	r.AddCookie(cookie)
+	if checkCSRF(r, config) == nil {
+		t.Fatal("Request without csrf token should be rejected")
+	}
+
+	r = newFormRequest("/create", "csrf_token=wrong")
+	r.AddCookie(cookie)
+	if checkCSRF(r, config) == nil {
+		t.Fatal("Request with wrong csrf token should be rejected")
+	}
+
+	r = newFormRequest("/create", "csrf_token="+session.CSRFToken)
+	r.AddCookie(cookie)
+	if checkCSRF(r, config) != nil {
+		t.Fatal("Request with the session csrf token should be accepted")
+	}
+
+	r = newFormRequest("/create", "csrf_token="+session.CSRFToken)
+	r.AddCookie(cookie)
+	r.Header.Set("Origin", "https://evil.example")
+	if checkCSRF(r, config) == nil {
+		t.Fatal("Cross origin request should be rejected")
+	}
+
+	r = newFormRequest("/create", "csrf_token="+session.CSRFToken)
+	r.AddCookie(cookie)
+	r.Header.Set("Referer", "http://"+r.Host+"/create")
+	if checkCSRF(r, config) != nil {
+		t.Fatal("Same origin request should be accepted")
+	}
+}
+
+func TestSameOriginBehindProxy(t *testing.T) {
+	config := BlogConfiguration{TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	request := func(remoteAddr string, origin string) *http.Request {
+		r := newFormRequest("/create", "")
+		r.Host = "golb:8080"
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("X-Forwarded-Host", "blog.example.com")
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("Origin", origin)
+		return r
+	}
+
+	if !sameOrigin(request("10.0.0.1:1234", "https://blog.example.com"), config) {
+		t.Fatal("The forwarded host of a trusted proxy should be the origin")
+	}
+	if sameOrigin(request("10.0.0.1:1234", "http://blog.example.com"), config) {
+		t.Fatal("Http origins should be rejected for https requests")
+	}
+	if sameOrigin(request("10.0.0.1:1234", "https://golb:8080"), config) {
+		t.Fatal("The internal host shouldn't be accepted when the proxy forwards another one")
+	}
+	if sameOrigin(request("192.0.2.1:1234", "https://blog.example.com"), config) {
+		t.Fatal("Forwarded hosts of untrusted clients should be ignored")
+	}
+}
+
+func TestCheckCSRFDoubleSubmit(t *testing.T) {
+	sessionStore = newMemorySessionStore()
+	config := BlogConfiguration{Hash: "filler", SessionTimeout: 60, RememberMeDays: 30}
+
+	recorder := httptest.NewRecorder()
+	token := csrfToken(recorder, httptest.NewRequest("GET", "/login", nil), config)
+	cookies := recorder.Result().Cookies()
+	if token == "" || len(cookies) != 1 || cookies[0].Value != token {
+		t.Fatal("Anonymous csrf token should be stored in a cookie")
+	}
+
+	r := newFormRequest("/login", "csrf_token="+token)
+	if checkCSRF(r, config) == nil {
+		t.Fatal("Double submit token without cookie should be rejected")
+	}
+
+	r = newFormRequest("/login", "csrf_token="+token)
+	r.AddCookie(cookies[0])
+	if checkCSRF(r, config) != nil {
+		t.Fatal("Double submit token matching the cookie should be accepted")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const INTERNAL_ERROR_MESSAGE string = "Something went wrong, please check back later!"
+
+// HTTPError is an error shown to the visitor on the error page for its status, the cause is only logged
+type HTTPError struct {
+	Status  int
+	Message string
+	Allow   []string
+	Cause   error
+}
+
+func (e *HTTPError) Error() string {
+	if e.Cause != nil {
+		return e.Cause.Error()
+	}
+	return e.Message
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Cause
+}
+
+func badRequest(message string) *HTTPError {
+	return &HTTPError{Status: http.StatusBadRequest, Message: message}
+}
+
+func notFound(message string) *HTTPError {
+	return &HTTPError{Status: http.StatusNotFound, Message: message}
+}
+
+func forbidden(message string) *HTTPError {
+	return &HTTPError{Status: http.StatusForbidden, Message: message}
+}
+
+func methodNotAllowed(allowed ...string) *HTTPError {
+	return &HTTPError{Status: http.StatusMethodNotAllowed, Message: "Method not allowed!", Allow: allowed}
+}
+
+func internalError(cause error) *HTTPError {
+	return &HTTPError{Status: http.StatusInternalServerError, Message: INTERNAL_ERROR_MESSAGE, Cause: cause}
+}
+
+// renderError renders the template for the status of the error (e.g. 404.html) or error.html,
+// errors that aren't an HTTPError are internal errors and logged
+func renderError(w http.ResponseWriter, r *http.Request, err error) {
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		httpErr = internalError(err)
+	}
+	if httpErr.Status >= 500 {
+		requestLogger(r).Error("request failed", "status", httpErr.Status, "error", err)
+	}
+	if len(httpErr.Allow) > 0 {
+		w.Header().Set("Allow", strings.Join(httpErr.Allow, ", "))
+	}
+	renderPageWithStatus(w, r, httpErr.Status, strconv.Itoa(httpErr.Status)+".html", httpErr.Message)
+}
+
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	renderError(w, r, notFound("Page not found!"))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestErrorPages(t *testing.T) {
+	postDir, templateDir := t.TempDir(), t.TempDir()
+	writeTestPost(t, postDir, "Hello")
+	os.WriteFile(filepath.Join(templateDir, "404.html"), []byte("<h2>custom 404: {{.}}</h2>"), 0700)
+	defaultSite.SetConfig(BlogConfiguration{Title: "Errors", PostDir: postDir, TemplateDir: templateDir, PostsPerPage: 10, ViewOnly: true})
+	err := reloadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshPosts()
+	mux := http.NewServeMux()
+	registerPublicRoutes(mux, "")
+
+	serve := func(method string, target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+		return recorder
+	}
+	for _, target := range []string{"/missing", "/posts/missing"} {
+		recorder := serve("GET", target)
+		if recorder.Code != http.StatusNotFound || !strings.Contains(recorder.Body.String(), "custom 404") || !strings.Contains(recorder.Body.String(), "<title>Errors</title>") {
+			t.Fatalf("%v should render 404.html with status 404, got %v: %v", target, recorder.Code, recorder.Body.String())
+		}
+	}
+	if recorder := serve("GET", "/posts/hello"); recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("Existing posts should be served with 200, got %v", recorder.Code)
+	}
+
+	recorder := httptest.NewRecorder()
+	logoutHandler(recorder, httptest.NewRequest("GET", "/logout", nil))
+	if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("Allow") != "POST" || !strings.Contains(recorder.Body.String(), "Method not allowed!") {
+		t.Fatalf("Wrong methods should render error.html with status 405, got %v: %v", recorder.Code, recorder.Body.String())
+	}
+
+	os.WriteFile(filepath.Join(templateDir, "post.html"), []byte("partial {{.PageData.Missing}}"), 0700)
+	err = reloadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder = serve("GET", "/posts/hello")
+	if recorder.Code != http.StatusInternalServerError || strings.Contains(recorder.Body.String(), "partial") || !strings.Contains(recorder.Body.String(), INTERNAL_ERROR_MESSAGE) {
+		t.Fatalf("A failing template should result in a clean 500 page, got %v: %v", recorder.Code, recorder.Body.String())
+	}
+
+	os.WriteFile(filepath.Join(templateDir, "500.html"), []byte("{{.Missing}}"), 0700)
+	reloadTemplates()
+	recorder = serve("GET", "/posts/hello")
+	if recorder.Code != http.StatusInternalServerError || strings.TrimSpace(recorder.Body.String()) != "Internal Server Error" {
+		t.Fatalf("A failing error page should fall back to plain text, got %v: %v", recorder.Code, recorder.Body.String())
+	}
+}
@@ -2,4 +2,12 @@ module golb
 
 go 1.23.4
 
-require github.com/yuin/goldmark v1.7.8 // indirect
+require (
+	github.com/yuin/goldmark v1.7.8
+	rsc.io/qr v0.2.0
+)
+
+require (
+	golang.org/x/crypto v0.36.0
+	golang.org/x/sys v0.31.0 // indirect
+)
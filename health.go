@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+)
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+func checkReadiness() error {
+	for _, site := range allSites() {
+		if site.Templates() == nil {
+			return errors.New(site.Name + ": templates not loaded")
+		}
+
+		_, err := os.ReadDir(site.Config().PostDir)
+		if err != nil {
+			return errors.New(site.Name + ": post directory not readable")
+		}
+
+		if site.postHeaders.Get() == nil {
+			return errors.New(site.Name + ": post cache not populated")
+		}
+	}
+
+	return nil
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	err := checkReadiness()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+type requestIDKey struct{}
+
+var logLevel *slog.LevelVar = &slog.LevelVar{}
+
+func setupLogging(format string) {
+	options := &slog.HandlerOptions{Level: logLevel}
+	if format == "text" {
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, options)))
+		return
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, options)))
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	var lvl slog.Level
+	err := lvl.UnmarshalText([]byte(level))
+	if err != nil {
+		return slog.LevelInfo, errors.New("invalid log level " + level + ", use debug, info, warn or error")
+	}
+	return lvl, nil
+}
+
+func parseTrustedProxies(proxies string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix = []netip.Prefix{}
+	for _, proxy := range strings.Split(proxies, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+
+		if strings.Contains(proxy, "/") {
+			prefix, err := netip.ParsePrefix(proxy)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(proxy)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func isTrustedProxy(addr netip.Addr, trusted []netip.Prefix) bool {
+	for _, prefix := range trusted {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// clientIP returns the address of the client, X-Forwarded-For is only used when the request came from a trusted proxy.
+// The header is read from right to left, the first address that isn't a trusted proxy is the client.
+func clientIP(r *http.Request, trusted []netip.Prefix) string {
+	addr, ok := remoteAddr(r)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !isTrustedProxy(addr, trusted) {
+		return addr.String()
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !isTrustedProxy(addr, trusted) {
+			break
+		}
+	}
+	return addr.String()
+}
+
+func generateRequestID() string {
+	randbytes := make([]byte, 8)
+	_, err := rand.Read(randbytes)
+	if err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(randbytes)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLogger returns the default logger annotated with the id of the request
+func requestLogger(r *http.Request) *slog.Logger {
+	return slog.Default().With("request_id", requestID(r))
+}
+
+// accessLogHandler assigns every request an id, echoes it in the X-Request-ID header and writes an access log line once the request is handled
+func accessLogHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		trusted := blogConfig.Get().TrustedProxies
+
+		id := r.Header.Get("X-Request-ID")
+		addr, ok := remoteAddr(r)
+		if !ok || !isTrustedProxy(addr, trusted) || !validRequestID(id) {
+			id = generateRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "request",
+			slog.String("request_id", id),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Int("bytes", recorder.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote_addr", clientIP(r, trusted)),
+			slog.String("user_agent", r.UserAgent()),
+		)
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "203.0.113.5:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if ip := clientIP(r, trusted); ip != "203.0.113.5" {
+		t.Fatalf("X-Forwarded-For from an untrusted peer should be ignored, got %v", ip)
+	}
+
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 192.168.1.1")
+	if ip := clientIP(r, trusted); ip != "198.51.100.1" {
+		t.Fatalf("X-Forwarded-For from a trusted proxy should be used, got %v", ip)
+	}
+
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.9")
+	if ip := clientIP(r, trusted); ip != "203.0.113.9" {
+		t.Fatalf("Spoofed X-Forwarded-For entries before an untrusted hop should be ignored, got %v", ip)
+	}
+
+	_, err = parseTrustedProxies("not-an-ip")
+	if err == nil {
+		t.Fatal("Parsing an invalid proxy address should fail")
+	}
+}
+
+func TestAccessLogHandlerRequestID(t *testing.T) {
+	blogConfig.Set(BlogConfiguration{})
+	var seen string
+	handler := accessLogHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestID(r)
+	}))
+
+	recorder := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Request-ID", "spoofed")
+	handler.ServeHTTP(recorder, r)
+
+	id := recorder.Header().Get("X-Request-ID")
+	if id == "" || id != seen {
+		t.Fatal("Request id should be available to handlers and echoed in the response")
+	}
+	if id == "spoofed" {
+		t.Fatal("Request id from an untrusted client should not be used")
+	}
+}
@@ -2,132 +2,727 @@ package main
 
 import (
 	"bytes"
-	"crypto/rand"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"html/template"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"slices"
 	"strconv"
+	"strings"
 	"sync"
-	"text/template"
 	"time"
 )
 
 const TITLE string = "Golb"
 
-var templates *template.Template
-var sessions map[string]time.Time = map[string]time.Time{}
+var templates SyncCache[*template.Template] = SyncCache[*template.Template]{}
 var postHeadersCache SyncCache[map[string]PostHeader] = SyncCache[map[string]PostHeader]{}
 var sortedPostIndexCache SyncCache[[]PostHeader] = SyncCache[[]PostHeader]{}
-var sessionsMutex sync.Mutex
 
-var blogConfig BlogConfiguration = BlogConfiguration{Title: TITLE, Port: 8080}
+const DEFAULT_POSTS_PER_PAGE int = 10
 
-func parseFlags() BlogConfiguration {
-	titleEnv := os.Getenv("GOLB_TITLE")
-	passwordEnv := os.Getenv("GOLB_PASSWORD")
-	portEnv := os.Getenv("GOLB_PORT")
-	postEnv := os.Getenv("GOLB_POSTDIR")
-	templateEnv := os.Getenv("GOLB_TEMPLATEDIR")
-	fileEnv := os.Getenv("GOLB_FILEDIR")
+var blogConfig SyncCache[BlogConfiguration] = SyncCache[BlogConfiguration]{value: BlogConfiguration{Title: TITLE, Port: 8080, PostsPerPage: DEFAULT_POSTS_PER_PAGE}}
 
-	if titleEnv == "" {
-		titleEnv = TITLE
+func parseFlags(args []string) (BlogConfiguration, error) {
+	config, _, err := parseConfiguration(args)
+	return config, err
+}
+
+// parseConfiguration combines flags, environment variables, the config file and defaults, in that order of precedence
+func parseConfiguration(args []string) (BlogConfiguration, []ConfigSetting, error) {
+	config, settings, arguments, err := parseCommandLine(args)
+	if err != nil {
+		return BlogConfiguration{}, settings, err
 	}
+	if len(arguments) > 0 {
+		return BlogConfiguration{}, nil, errors.New("unexpected argument " + arguments[0])
+	}
+	return config, settings, nil
+}
 
-	if portEnv == "" {
-		portEnv = "8080"
+// parseCommandLine is parseConfiguration for commands, arguments that aren't flags can be mixed with the flags and are returned in order
+func parseCommandLine(args []string) (BlogConfiguration, []ConfigSetting, []string, error) {
+	flags, build := configurationFlags()
+	var arguments []string
+	for {
+		err := flags.Parse(args)
+		if err != nil {
+			return BlogConfiguration{}, nil, nil, err
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		if parsed := len(args) - flags.NArg(); parsed > 0 && args[parsed-1] == "--" {
+			arguments = append(arguments, flags.Args()...)
+			break
+		}
+		arguments = append(arguments, flags.Arg(0))
+		args = flags.Args()[1:]
 	}
 
-	if postEnv == "" {
-		postEnv = "posts"
+	settings, siteSettings, err := applyConfigSources(flags)
+	if err != nil {
+		return BlogConfiguration{}, settings, nil, err
 	}
 
-	if templateEnv == "" {
-		templateEnv = "templates"
+	config, err := build(settings)
+	if err != nil {
+		return BlogConfiguration{}, settings, nil, err
 	}
 
-	if fileEnv == "" {
-		fileEnv = "files"
+	for _, site := range siteSettings {
+		siteConfig, err := siteConfiguration(settings, site)
+		if err != nil {
+			return BlogConfiguration{}, settings, nil, err
+		}
+		siteConfig.Config.BasePath = config.BasePath
+		config.Sites = append(config.Sites, siteConfig)
 	}
+	err = validateSites(config)
+	if err != nil {
+		return BlogConfiguration{}, settings, nil, err
+	}
+	return config, settings, arguments, nil
+}
+
+// configurationFlags defines all settings, build validates the parsed values and turns them into a configuration
+func configurationFlags() (*flag.FlagSet, func(settings []ConfigSetting) (BlogConfiguration, error)) {
+	flags := flag.NewFlagSet("golb", flag.ContinueOnError)
+	configFile := flags.String("config", "", "specifies a json file with settings, keys are flag names, flags and environment variables take precedence (env: GOLB_CONFIG)")
+	title := flags.String("title", TITLE, "specifies the blog title (env: GOLB_TITLE)")
+	baseURL := flags.String("baseurl", "", "specifies the public url of the blog, e.g. https://blog.example.com (env: GOLB_BASE_URL)")
+	basePath := flags.String("basepath", "", "specifies the path the blog is served under behind a reverse proxy, e.g. /blog, defaults to the path of -baseurl (env: GOLB_BASE_PATH)")
+	password := flags.String("password", "", "specifies the management password, prefer -passwordhash or -credentialsfile (env: GOLB_PASSWORD)")
+	passwordHash := flags.String("passwordhash", "", "specifies the argon2id hash of the management password, see golb hash-password (env: GOLB_PASSWORD_HASH)")
+	credentialsFile := flags.String("credentialsfile", "", "specifies a file containing the argon2id hash of the management password (env: GOLB_CREDENTIALS_FILE)")
+	usersFile := flags.String("usersfile", "", "specifies a json file with user accounts, managed at /users by admins (env: GOLB_USERS_FILE)")
+	auditFile := flags.String("auditfile", "", "specifies a file the audit log of logins and changes is appended to as json lines, the last 1000 events are kept in memory when empty (env: GOLB_AUDIT_FILE)")
+	require2FA := flags.Bool("require2fa", false, "require admins to use two-factor authentication, they have to enroll on their next login (env: GOLB_REQUIRE_2FA)")
+	oidcIssuer := flags.String("oidcissuer", "", "specifies the OpenID Connect issuer url to enable single sign-on (env: GOLB_OIDC_ISSUER)")
+	oidcClientID := flags.String("oidcclientid", "", "specifies the OpenID Connect client id (env: GOLB_OIDC_CLIENT_ID)")
+	oidcClientSecret := flags.String("oidcclientsecret", "", "specifies the OpenID Connect client secret, public clients leave it empty (env: GOLB_OIDC_CLIENT_SECRET)")
+	oidcRedirectURL := flags.String("oidcredirecturl", "", "specifies the public url of /login/oidc/callback registered at the identity provider, derived from -baseurl when empty (env: GOLB_OIDC_REDIRECT_URL)")
+	oidcScopes := flags.String("oidcscopes", "openid email profile", "specifies the space separated scopes requested from the identity provider (env: GOLB_OIDC_SCOPES)")
+	oidcGroupsClaim := flags.String("oidcgroupsclaim", "groups", "specifies the id token claim that contains the groups of a user (env: GOLB_OIDC_GROUPS_CLAIM)")
+	oidcAllowed := flags.String("oidcallowed", "", "comma separated list of email:, sub: and group: rules for single sign-on users that get admin access (env: GOLB_OIDC_ALLOWED)")
+	port := flags.Int("port", 8080, "specifies the port to use (env: GOLB_PORT)")
+	postDir := flags.String("postdir", "posts", "specifies the directory to use for posts (env: GOLB_POSTDIR)")
+	templateDir := flags.String("templatedir", "templates", "specifies the directory to use for templates (env: GOLB_TEMPLATEDIR)")
+	fileDir := flags.String("filedir", "files", "specifies the directory to use for files (env: GOLB_FILEDIR)")
+	postsPerPage := flags.Int("postsperpage", DEFAULT_POSTS_PER_PAGE, "specifies how many posts are listed per page, between 1 and 100 (env: GOLB_POSTS_PER_PAGE)")
+	timezone := flags.String("timezone", "Local", "specifies the IANA time zone post timestamps are written and shown in, e.g. Europe/Berlin (env: GOLB_TIMEZONE)")
+	dateFormat := flags.String("dateformat", time.RFC1123, "specifies the go time layout dates are shown with, e.g. \"2 January 2006\" (env: GOLB_DATE_FORMAT)")
+	locale := flags.String("locale", DEFAULT_LOCALE, "specifies the language of the blog, translations are looked up in i18n/<locale>.json of the theme and template directory, falling back to english (env: GOLB_LOCALE)")
+	markdownExtensions := flags.String("markdownextensions", "", "comma separated list of markdown extensions, any of definitionlist, footnote, gfm, linkify, strikethrough, table, tasklist and typographer (env: GOLB_MARKDOWN_EXTENSIONS)")
+	markdownUnsafe := flags.Bool("markdownunsafe", false, "render raw html and javascript: links in posts, only for blogs whose authors are all trusted (env: GOLB_MARKDOWN_UNSAFE)")
+	markdownHardWraps := flags.Bool("markdownhardwraps", false, "render line breaks in posts as <br> (env: GOLB_MARKDOWN_HARD_WRAPS)")
+	theme := flags.String("theme", "", "specifies the active theme, one of the directories in -themedir, the built-in look is used when empty (env: GOLB_THEME)")
+	themeDir := flags.String("themedir", "themes", "specifies the directory with installed themes, every theme is a directory with a theme.json manifest (env: GOLB_THEMEDIR)")
+	themeOptions := flags.String("themeoptions", "", "semicolon separated list of option=value settings for the active theme, the options are listed in its theme.json (env: GOLB_THEME_OPTIONS)")
+	watch := flags.Bool("watch", false, "watch the post, template and file directories and apply changes instantly (env: GOLB_WATCH)")
+	shutdownTimeout := flags.Int("shutdowntimeout", 15, "specifies how many seconds in-flight requests get to finish on shutdown (env: GOLB_SHUTDOWN_TIMEOUT)")
+	tlsCert := flags.String("tlscert", "", "specifies the certificate file to serve https with, reloaded when it changes (env: GOLB_TLS_CERT)")
+	tlsKey := flags.String("tlskey", "", "specifies the private key file of -tlscert (env: GOLB_TLS_KEY)")
+	tlsSelfSigned := flags.Bool("tlsselfsigned", false, "serve https with a generated self-signed certificate for localhost and the site hosts, only for development (env: GOLB_TLS_SELF_SIGNED)")
+	redirectPort := flags.Int("redirectport", 0, "specifies a port that redirects http requests to https, 0 disables the redirect (env: GOLB_REDIRECT_PORT)")
+	metricsPort := flags.Int("metricsport", 0, "specifies a separate port for the /metrics endpoint, 0 serves it on the main port (env: GOLB_METRICS_PORT)")
+	logLevel := flags.String("loglevel", "info", "specifies the log level, one of debug, info, warn or error (env: GOLB_LOG_LEVEL)")
+	logFormat := flags.String("logformat", "json", "specifies the log format, json or text (env: GOLB_LOG_FORMAT)")
+	trustedProxies := flags.String("trustedproxies", "", "comma separated list of proxy addresses or CIDR ranges whose X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host headers are trusted (env: GOLB_TRUSTED_PROXIES)")
+	csp := flags.String("csp", DEFAULT_CSP, "specifies the Content-Security-Policy, {nonce} is replaced by the per request nonce, off disables the header (env: GOLB_CSP)")
+	referrerPolicy := flags.String("referrerpolicy", DEFAULT_REFERRER_POLICY, "specifies the Referrer-Policy, off disables the header (env: GOLB_REFERRER_POLICY)")
+	permissionsPolicy := flags.String("permissionspolicy", DEFAULT_PERMISSIONS_POLICY, "specifies the Permissions-Policy, off disables the header (env: GOLB_PERMISSIONS_POLICY)")
+	frameOptions := flags.String("frameoptions", "deny", "specifies who may embed the blog in a frame, one of deny, sameorigin or allow (env: GOLB_FRAME_OPTIONS)")
+	hstsMaxAge := flags.Int("hstsmaxage", 31536000, "specifies the Strict-Transport-Security max-age in seconds for requests served over TLS, 0 disables the header (env: GOLB_HSTS_MAX_AGE)")
+	sessionFile := flags.String("sessionfile", "", "specifies a file to store sessions in so they survive restarts, sessions are kept in memory when empty (env: GOLB_SESSION_FILE)")
+	sessionTimeout := flags.Int("sessiontimeout", 60, "specifies after how many minutes of inactivity a session expires (env: GOLB_SESSION_TIMEOUT)")
+	rememberMeDays := flags.Int("remembermedays", 30, "specifies after how many days of inactivity a remembered session expires (env: GOLB_REMEMBER_ME_DAYS)")
+	loginRateLimit := flags.Int("loginratelimit", 20, "specifies how many requests per minute a single ip may send to /login, 0 disables the limit (env: GOLB_LOGIN_RATE_LIMIT)")
+	loginFreeFailures := flags.Int("loginfreefailures", 5, "specifies how many failed logins an ip gets before it has to wait, the wait doubles with every failure (env: GOLB_LOGIN_FREE_FAILURES)")
+	loginMaxLockout := flags.Int("loginmaxlockout", 60, "specifies the longest time in minutes an ip is locked out after failed logins (env: GOLB_LOGIN_MAX_LOCKOUT)")
+	loginGlobalFailures := flags.Int("loginglobalfailures", 0, "specifies how many failed logins per minute are allowed across all ips before all password logins are locked, 0 disables the limit (env: GOLB_LOGIN_GLOBAL_FAILURES)")
+
+	build := func(settings []ConfigSetting) (BlogConfiguration, error) {
+		if *port < 1 || *port > 65535 {
+			return BlogConfiguration{}, settingError(settings, "port", errors.New("must be between 1 and 65535"))
+		}
+
+		if *metricsPort < 0 || *metricsPort > 65535 || *metricsPort == *port {
+			return BlogConfiguration{}, settingError(settings, "metricsport", errors.New("must be between 0 and 65535 and differ from the port"))
+		}
+
+		if (*tlsCert == "") != (*tlsKey == "") {
+			return BlogConfiguration{}, errors.New("tls certificate and key must be set together")
+		}
+
+		if *tlsSelfSigned && *tlsCert != "" {
+			return BlogConfiguration{}, settingError(settings, "tlsselfsigned", errors.New("can't be combined with a tls certificate"))
+		}
+
+		useTLS := *tlsCert != "" || *tlsSelfSigned
+		if *redirectPort < 0 || *redirectPort > 65535 || (*redirectPort != 0 && (!useTLS || *redirectPort == *port || *redirectPort == *metricsPort)) {
+			return BlogConfiguration{}, settingError(settings, "redirectport", errors.New("requires tls and must be between 0 and 65535 and differ from the other ports"))
+		}
+
+		if *shutdownTimeout < 0 {
+			return BlogConfiguration{}, settingError(settings, "shutdowntimeout", errors.New("can't be negative"))
+		}
+
+		if *hstsMaxAge < 0 {
+			return BlogConfiguration{}, settingError(settings, "hstsmaxage", errors.New("can't be negative"))
+		}
+
+		if *postsPerPage < 1 || *postsPerPage > 100 {
+			return BlogConfiguration{}, settingError(settings, "postsperpage", errors.New("must be between 1 and 100"))
+		}
+
+		if *loginRateLimit < 0 || *loginFreeFailures < 0 || *loginMaxLockout < 1 || *loginGlobalFailures < 0 {
+			return BlogConfiguration{}, errors.New("login limits can't be negative and the max lockout must be at least 1 minute")
+		}
+
+		if *sessionTimeout < 1 || *rememberMeDays < 1 {
+			return BlogConfiguration{}, errors.New("session timeout and remember me days must be at least 1")
+		}
+
+		if *require2FA && *usersFile == "" {
+			return BlogConfiguration{}, settingError(settings, "require2fa", errors.New("needs -usersfile to store the two-factor secrets of admins"))
+		}
+
+		if *sessionFile != "" {
+			*sessionFile = filepath.Clean(*sessionFile)
+		}
+		if *usersFile != "" {
+			*usersFile = filepath.Clean(*usersFile)
+		}
+		if *auditFile != "" {
+			*auditFile = filepath.Clean(*auditFile)
+		}
+		if *tlsCert != "" {
+			*tlsCert = filepath.Clean(*tlsCert)
+			*tlsKey = filepath.Clean(*tlsKey)
+		}
+
+		*postDir = filepath.Clean(*postDir)
+		*templateDir = filepath.Clean(*templateDir)
+		*fileDir = filepath.Clean(*fileDir)
+
+		var err error
+		*baseURL, err = parseBaseURL(*baseURL)
+		if err != nil {
+			return BlogConfiguration{}, settingError(settings, "baseurl", err)
+		}
+		*basePath, err = parseBasePath(*basePath)
+		if err != nil {
+			return BlogConfiguration{}, settingError(settings, "basepath", err)
+		}
+		if *basePath == "" {
+			*basePath, err = parseBasePath(basePathOf(*baseURL))
+			if err != nil {
+				return BlogConfiguration{}, settingError(settings, "baseurl", err)
+			}
+		} else if *baseURL != "" && basePathOf(*baseURL) != *basePath {
+			return BlogConfiguration{}, settingError(settings, "baseurl", errors.New(*baseURL+" has to end with the base path "+*basePath))
+		}
+
+		location, err := time.LoadLocation(*timezone)
+		if err != nil {
+			return BlogConfiguration{}, settingError(settings, "timezone", err)
+		}
+
+		if strings.TrimSpace(*dateFormat) == "" {
+			return BlogConfiguration{}, settingError(settings, "dateformat", errors.New("can't be empty"))
+		}
+
+		if !localePattern.MatchString(*locale) {
+			return BlogConfiguration{}, settingError(settings, "locale", errors.New(*locale+" is not a language tag like en or de-AT"))
+		}
+
+		extensions, err := parseMarkdownExtensions(*markdownExtensions)
+		if err != nil {
+			return BlogConfiguration{}, settingError(settings, "markdownextensions", err)
+		}
+
+		*themeDir = filepath.Clean(*themeDir)
+		options, err := parseThemeOptions(*themeOptions)
+		if err != nil {
+			return BlogConfiguration{}, settingError(settings, "themeoptions", err)
+		}
+		activeTheme := Theme{}
+		if *theme != "" {
+			activeTheme, err = loadTheme(*themeDir, *theme, options)
+			if err != nil {
+				return BlogConfiguration{}, settingError(settings, "theme", err)
+			}
+		} else if len(options) > 0 {
+			return BlogConfiguration{}, settingError(settings, "themeoptions", errors.New("theme options need a -theme"))
+		}
+
+		level, err := parseLogLevel(*logLevel)
+		if err != nil {
+			return BlogConfiguration{}, settingError(settings, "loglevel", err)
+		}
+
+		if *logFormat != "json" && *logFormat != "text" {
+			return BlogConfiguration{}, settingError(settings, "logformat", errors.New(*logFormat+" is not supported, use json or text"))
+		}
+
+		proxies, err := parseTrustedProxies(*trustedProxies)
+		if err != nil {
+			return BlogConfiguration{}, settingError(settings, "trustedproxies", err)
+		}
+
+		oidcRules, err := parseOIDCAllowed(*oidcAllowed)
+		if err != nil {
+			return BlogConfiguration{}, settingError(settings, "oidcallowed", err)
+		}
+		if *oidcRedirectURL == "" && *baseURL != "" {
+			*oidcRedirectURL = *baseURL + "/login/oidc/callback"
+		}
+		if *oidcIssuer != "" && (*oidcClientID == "" || *oidcRedirectURL == "" || len(oidcRules) == 0) {
+			return BlogConfiguration{}, errors.New("single sign-on needs -oidcclientid, -oidcredirecturl or -baseurl and at least one -oidcallowed rule")
+		}
+
+		frameOption, err := parseFrameOptions(*frameOptions)
+		if err != nil {
+			return BlogConfiguration{}, settingError(settings, "frameoptions", err)
+		}
 
-	defPort, err := strconv.Atoi(portEnv)
+		for _, header := range []*string{csp, referrerPolicy, permissionsPolicy} {
+			if *header == "off" {
+				*header = ""
+			}
+		}
+
+		config := BlogConfiguration{ConfigFile: *configFile, Title: *title, BaseURL: *baseURL, BasePath: *basePath, Hash: "", Port: *port, PostDir: *postDir, TemplateDir: *templateDir, FileDir: *fileDir,
+			PostsPerPage: *postsPerPage, Location: location, MarkdownExtensions: extensions, MarkdownUnsafe: *markdownUnsafe, MarkdownHardWraps: *markdownHardWraps,
+			DateFormat: *dateFormat, Locale: *locale, Theme: *theme, ThemeDir: *themeDir, ThemeOptions: options, theme: activeTheme,
+			Watch: *watch, ShutdownTimeout: *shutdownTimeout, MetricsPort: *metricsPort, TLSCert: *tlsCert, TLSKey: *tlsKey, TLSSelfSigned: *tlsSelfSigned, RedirectPort: *redirectPort, LogLevel: level, LogFormat: *logFormat, TrustedProxies: proxies,
+			ContentSecurityPolicy: *csp, ReferrerPolicy: *referrerPolicy, PermissionsPolicy: *permissionsPolicy, FrameOptions: frameOption, HSTSMaxAge: *hstsMaxAge,
+			UsersFile: *usersFile, AuditFile: *auditFile, Require2FA: *require2FA,
+			OIDCIssuer: *oidcIssuer, OIDCClientID: *oidcClientID, OIDCClientSecret: *oidcClientSecret, OIDCRedirectURL: *oidcRedirectURL, OIDCScopes: *oidcScopes, OIDCGroupsClaim: *oidcGroupsClaim, OIDCAllowed: oidcRules,
+			SessionFile: *sessionFile, SessionTimeout: *sessionTimeout, RememberMeDays: *rememberMeDays,
+			LoginRateLimit: *loginRateLimit, LoginFreeFailures: *loginFreeFailures, LoginMaxLockout: *loginMaxLockout, LoginGlobalFailures: *loginGlobalFailures, ViewOnly: true}
+
+		hashed, err := resolvePasswordHash(*password, *passwordHash, *credentialsFile)
+		if err != nil {
+			return BlogConfiguration{}, err
+		}
+		config.Hash = hashed
+		config.ViewOnly = hashed == "" && config.UsersFile == "" && config.OIDCIssuer == ""
+		return config, nil
+	}
+	return flags, build
+}
+
+// parseBaseURL accepts an absolute http or https url and removes the trailing slash
+func parseBaseURL(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	parsed, err := url.Parse(value)
 	if err != nil {
-		defPort = 8080
+		return "", err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", errors.New(value + " must be an absolute http or https url")
+	}
+	if parsed.RawQuery != "" || parsed.Fragment != "" || parsed.User != nil {
+		return "", errors.New(value + " can't contain credentials, a query or a fragment")
+	}
+	return strings.TrimSuffix(parsed.String(), "/"), nil
+}
+
+// resolvePasswordHash returns the password hash from the hash, credentials file or plaintext password, in that order of preference.
+// An empty hash without error means no credentials were supplied.
+func resolvePasswordHash(password string, passwordHash string, credentialsFile string) (string, error) {
+	if passwordHash != "" && credentialsFile != "" {
+		return "", errors.New("supply either a password hash or a credentials file, not both")
+	}
+
+	if credentialsFile != "" {
+		hashed, err := readCredentialsFile(credentialsFile)
+		if err != nil {
+			return "", err
+		}
+		passwordHash = hashed
+	}
+
+	if passwordHash != "" {
+		_, _, _, err := decodePasswordHash(passwordHash)
+		if err != nil {
+			return "", err
+		}
+		if password != "" {
+			slog.Warn("both a password and a password hash are supplied, ignoring the plaintext password")
+		}
+		return passwordHash, nil
+	}
+
+	if password == "" {
+		return "", nil
+	}
+
+	return hashPassword(password, defaultArgon2Params)
+}
+
+func applyLoginLimits(config BlogConfiguration) {
+	loginLimiter.SetLimit(config.LoginRateLimit, time.Minute)
+	loginGuard.SetLimits(config.LoginFreeFailures, time.Duration(config.LoginMaxLockout)*time.Minute, config.LoginGlobalFailures)
+}
+
+func logConfiguration(config BlogConfiguration) {
+	slog.Info("parsed flags", "config", config.ConfigFile, "title", config.Title, "baseurl", config.BaseURL, "basepath", config.BasePath, "port", config.Port, "postdir", config.PostDir, "templatedir", config.TemplateDir, "filedir", config.FileDir, "postsperpage", config.PostsPerPage,
+		"timezone", config.location().String(), "watch", config.Watch, "shutdowntimeout", config.ShutdownTimeout, "metricsport", config.MetricsPort, "tlscert", config.TLSCert, "tlsselfsigned", config.TLSSelfSigned, "redirectport", config.RedirectPort, "loglevel", config.LogLevel.String(), "trustedproxies", config.TrustedProxies)
+	if config.isPasswordless() {
+		slog.Info("no password or users file supplied, running in view only mode")
+	}
+}
+
+func main() {
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
 	}
 
-	title := flag.String("title", titleEnv, "specifies the blog title (env: GOLB_TITLE)")
-	password := flag.String("password", passwordEnv, "specifies the management password (env: GOLB_PASSWORD)")
-	port := flag.Int("port", defPort, "specifies the port to use, default is 8080 (env: GOLB_PORT)")
-	postDir := flag.String("postdir", postEnv, "specifies the directory to use for posts (env: GOLB_POSTDIR)")
-	templateDir := flag.String("templatedir", templateEnv, "specifies the directory to use for templates (env: GOLB_TEMPLATEDIR)")
-	fileDir := flag.String("filedir", fileEnv, "specifies the directory to use for files (env: GOLB_FILEDIR)")
-	flag.Parse()
+	if command == "serve" {
+		runServer(args)
+		return
+	}
 
-	*postDir = filepath.Clean(*postDir)
-	*templateDir = filepath.Clean(*templateDir)
-	*fileDir = filepath.Clean(*fileDir)
+	run, ok := commands[command]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %v\n\n", command)
+		printUsage(os.Stderr)
+		os.Exit(2)
+	}
+	err := run(args, os.Stdin, os.Stdout)
+	if err != nil && err != flag.ErrHelp {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
 
-	log.Printf("parsed flags, title = %v, port = %v, postdir = %v, templatedir = %v, filedir = %v", *title, *port, *postDir, *templateDir, *fileDir)
+// serverArgs are the arguments the server was started with, they are parsed again on reload
+var serverArgs []string
 
-	if *password == "" {
-		log.Println("no password supplied, running in view only mode")
-		return BlogConfiguration{Title: *title, Hash: "", Salt: [4]byte{}, Port: *port, PostDir: *postDir, TemplateDir: *templateDir, FileDir: *fileDir, ViewOnly: true}
+func runServer(args []string) {
+	serverArgs = args
+	config, err := parseFlags(args)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(1)
 	}
+	defaultSite.SetConfig(config)
+	logLevel.Set(config.LogLevel)
+	setupLogging(config.LogFormat)
+	logConfiguration(config)
+	applyLoginLimits(config)
 
-	randbytes := make([]byte, 4)
-	_, err = rand.Read(randbytes)
+	err = defaultSite.reloadTemplates()
 	if err != nil {
-		log.Fatal("couldn't read cryptographically secure rand")
+		slog.Error("couldn't load templates", "error", err)
+		os.Exit(1)
 	}
 
-	hashed, err := calcHash(*password, randbytes)
+	err = defaultSite.openStores(config)
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("couldn't open stores", "error", err)
+		os.Exit(1)
 	}
 
-	return BlogConfiguration{Title: *title, Hash: hashed, Salt: [4]byte(randbytes), Port: *port, PostDir: *postDir, TemplateDir: *templateDir, FileDir: *fileDir, ViewOnly: false}
+	err = setupSites(config)
+	if err != nil {
+		slog.Error("couldn't set up sites", "error", err)
+		os.Exit(1)
+	}
+
+	refreshPosts()
+
+	base := config.BasePath
+	registerPublicRoutes(http.DefaultServeMux, base)
+	http.HandleFunc(base+"/healthz", healthzHandler)
+	http.HandleFunc(base+"/readyz", readyzHandler)
+	if config.MetricsPort == 0 {
+		http.HandleFunc(base+"/metrics", metricsHandler)
+	}
+
+	if slices.ContainsFunc(allSites(), func(site *Site) bool { return !site.Config().isPasswordless() }) {
+		http.Handle(base+"/login", managementHandler(rateLimitHandler(loginLimiter, http.HandlerFunc(loginHandler))))
+		http.Handle(base+"/create", managementHandler(http.HandlerFunc(createPostHandler)))
+		http.Handle(base+"/create/{postId}", managementHandler(http.HandlerFunc(editPostHandler)))
+		http.Handle(base+"/delete/{postId}", managementHandler(http.HandlerFunc(deletePostHandler)))
+		http.Handle(base+"/logout", managementHandler(http.HandlerFunc(logoutHandler)))
+		http.Handle(base+"/sessions", managementHandler(http.HandlerFunc(sessionsHandler)))
+		http.Handle(base+"/users", managementHandler(http.HandlerFunc(usersHandler)))
+		http.Handle(base+"/audit", managementHandler(http.HandlerFunc(auditHandler)))
+		http.Handle(base+"/themes", managementHandler(http.HandlerFunc(themesHandler)))
+		http.Handle(base+"/2fa", managementHandler(http.HandlerFunc(twoFactorHandler)))
+		http.Handle(base+"/login/oidc", managementHandler(rateLimitHandler(loginLimiter, http.HandlerFunc(oidcLoginHandler))))
+		http.Handle(base+"/login/oidc/callback", managementHandler(rateLimitHandler(loginLimiter, http.HandlerFunc(oidcCallbackHandler))))
+	}
+
+	hostname := fmt.Sprintf(":%v", config.Port)
+	err = serve(hostname)
+	if err != nil {
+		slog.Error("server failed", "error", err)
+		os.Exit(1)
+	}
 }
 
-func main() {
-	blogConfig = parseFlags()
+// registerPublicRoutes registers the pages everyone can see below the base path, they are also what golb build exports
+func registerPublicRoutes(mux *http.ServeMux, basePath string) {
+	mux.Handle(basePath+"/files/", http.StripPrefix(basePath+"/files/", http.HandlerFunc(fileHandler)))
+	mux.HandleFunc(basePath+"/favicon.ico", faviconHandler)
+	mux.HandleFunc(basePath+"/{$}", homeHandler)
+	mux.HandleFunc("/", notFoundHandler)
+	if basePath != "" {
+		mux.Handle(basePath, http.RedirectHandler(basePath+"/", http.StatusMovedPermanently))
+	}
+	mux.HandleFunc(basePath+"/page/{pageIndex}", homeHandler)
+	mux.HandleFunc(basePath+"/posts", homeHandler)
+	mux.HandleFunc(basePath+"/posts/{postId}", postsHandler)
+}
 
-	tempDir := filepath.Join(blogConfig.TemplateDir, "*.html")
-	templates = template.Must(template.ParseGlob(tempDir))
+// reloadConfiguration re-reads flags, environment and config file and applies the settings that can change while running
+func reloadConfiguration() error {
+	current := blogConfig.Get()
+	config, err := parseFlags(serverArgs)
+	if err != nil {
+		return err
+	}
 
-	if templates == nil {
-		log.Fatal("no templates loaded")
+	config = keepRestartSettings(DEFAULT_SITE, current, config)
+	if config.LogFormat != current.LogFormat {
+		slog.Warn("log format changes require a restart", "logformat", current.LogFormat)
+		config.LogFormat = current.LogFormat
+	}
+	if config.Port != current.Port || config.MetricsPort != current.MetricsPort {
+		slog.Warn("port changes require a restart", "port", current.Port, "metricsport", current.MetricsPort)
+		config.Port = current.Port
+		config.MetricsPort = current.MetricsPort
+	}
+	if config.BasePath != current.BasePath {
+		slog.Warn("base path changes require a restart", "basepath", current.BasePath)
+		config.BasePath = current.BasePath
+	}
+	if config.TLSCert != current.TLSCert || config.TLSKey != current.TLSKey || config.TLSSelfSigned != current.TLSSelfSigned || config.RedirectPort != current.RedirectPort {
+		slog.Warn("tls changes require a restart, certificates are reloaded when their files change", "tlscert", current.TLSCert, "redirectport", current.RedirectPort)
+		config.TLSCert = current.TLSCert
+		config.TLSKey = current.TLSKey
+		config.TLSSelfSigned = current.TLSSelfSigned
+		config.RedirectPort = current.RedirectPort
 	}
 
-	refreshPosts(0)
+	for _, site := range sites.Get() {
+		index := slices.IndexFunc(config.Sites, func(siteConfig SiteConfiguration) bool { return siteConfig.Name == site.Name })
+		if index == -1 {
+			slog.Warn("removing sites requires a restart, keeping previous configuration", "site", site.Name)
+			continue
+		}
+		if !slices.Equal(config.Sites[index].Hosts, site.Hosts) {
+			slog.Warn("host changes require a restart", "site", site.Name, "hosts", site.Hosts)
+		}
+		site.SetConfig(keepRestartSettings(site.Name, site.Config(), config.Sites[index].Config))
+	}
+	for _, siteConfig := range config.Sites {
+		if !slices.ContainsFunc(sites.Get(), func(site *Site) bool { return site.Name == siteConfig.Name }) {
+			slog.Warn("adding sites requires a restart", "site", siteConfig.Name)
+		}
+	}
 
-	http.Handle("/files/", http.StripPrefix("/files/", http.FileServer(http.Dir(blogConfig.FileDir))))
-	http.Handle("/favicon.ico", http.RedirectHandler(filepath.Join(blogConfig.FileDir, "favicon.ico"), 301))
-	http.HandleFunc("/", homeHandler)
-	http.HandleFunc("/page/{pageIndex}", homeHandler)
-	http.HandleFunc("/posts", homeHandler)
-	http.HandleFunc("/posts/{postId}", postsHandler)
+	defaultSite.SetConfig(config)
+	logLevel.Set(config.LogLevel)
+	logConfiguration(config)
+	applyLoginLimits(config)
 
-	if !blogConfig.isPasswordless() {
-		http.HandleFunc("/login", loginHandler)
-		http.HandleFunc("/create", createPostHandler)
-		http.HandleFunc("/create/{postId}", editPostHandler)
-		http.HandleFunc("/delete/{postId}", deletePostHandler)
+	err = refreshPosts()
+	if err != nil {
+		return err
 	}
+	return reloadTemplates()
+}
 
-	go refreshPosts(30)
-	go expireSessions(60)
-	hostname := fmt.Sprintf(":%v", blogConfig.Port)
-	fmt.Println("Server running on ", hostname)
-	log.Fatal(http.ListenAndServe(hostname, nil))
+// keepRestartSettings keeps the current value of site settings that only apply on startup
+func keepRestartSettings(name string, current BlogConfiguration, config BlogConfiguration) BlogConfiguration {
+	config.BasePath = current.BasePath
+	if config.SessionFile != current.SessionFile {
+		slog.Warn("session file changes require a restart", "site", name, "sessionfile", current.SessionFile)
+		config.SessionFile = current.SessionFile
+	}
+	if config.AuditFile != current.AuditFile {
+		slog.Warn("audit file changes require a restart", "site", name, "auditfile", current.AuditFile)
+		config.AuditFile = current.AuditFile
+	}
+	if config.UsersFile != current.UsersFile {
+		slog.Warn("users file changes require a restart", "site", name, "usersfile", current.UsersFile)
+		config.UsersFile = current.UsersFile
+	}
+	if config.isPasswordless() != current.isPasswordless() {
+		slog.Warn("switching view only mode requires a restart, keeping previous credentials", "site", name)
+		config.Hash = current.Hash
+		config.ViewOnly = current.ViewOnly
+	}
+	return config
+}
+
+// loadTemplates parses the embedded templates, then the templates of the theme and the template directory, which replace templates with the same name
+func loadTemplates(config BlogConfiguration, theme Theme) (*template.Template, error) {
+	catalog, err := loadCatalog(config, theme)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New("").Funcs(templateFuncs).Funcs(siteFuncs(config, theme, catalog)).ParseFS(embeddedTemplates, "templates/*.html")
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	if theme.Dir != "" {
+		dirs = append(dirs, filepath.Join(theme.Dir, "templates"))
+	}
+	for _, dir := range append(dirs, config.TemplateDir) {
+		overrides, err := filepath.Glob(filepath.Join(dir, "*.html"))
+		if err != nil {
+			return nil, err
+		}
+		if len(overrides) > 0 {
+			tmpl, err = tmpl.ParseFiles(overrides...)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return tmpl, nil
+}
+
+// reloadTemplates swaps in a freshly parsed template set for every site
+func reloadTemplates() error {
+	var errs []error
+	for _, site := range allSites() {
+		errs = append(errs, site.reloadTemplates())
+	}
+	return errors.Join(errs...)
 }
 
-func generatePostFilenamesList() ([]string, error) {
-	postpaths, err := filepath.Glob(filepath.Join(blogConfig.PostDir, "*.md"))
+// reloadTemplates swaps in a freshly parsed template set, the current set stays active if parsing fails
+func (site *Site) reloadTemplates() error {
+	config := site.Config()
+	tmpl, err := loadTemplates(config, config.theme)
+	if err != nil {
+		return err
+	}
+	templateSetsMutex.Lock()
+	defer templateSetsMutex.Unlock()
+	templatePools.Store(tmpl, &sync.Pool{})
+	previous := site.Templates()
+	site.templates.Set(tmpl)
+	forgetTemplates(previous)
+	return nil
+}
+
+// templatePools keep clones of the loaded template sets, a request sets its own functions (like nonce) on a clone
+// no other request uses at the same time, so a set is only cloned when all of its clones are busy
+var templatePools sync.Map
+
+// previewTemplateSets caches the template sets of previewed themes by the template set of the site until it is reloaded
+var previewTemplateSets sync.Map
+
+// templateSetsMutex serializes adding and forgetting template sets, so no pool or preview outlives the set it belongs to
+var templateSetsMutex sync.Mutex
+
+type previewKey struct {
+	base     *template.Template
+	themeDir string
+}
+
+// acquireTemplates takes a clone from the pool of the set, sets that were replaced in the meantime are cloned without pooling
+func acquireTemplates(base *template.Template) (*template.Template, error) {
+	if pool, ok := templatePools.Load(base); ok {
+		if tmpls, ok := pool.(*sync.Pool).Get().(*template.Template); ok {
+			return tmpls, nil
+		}
+	}
+	return base.Clone()
+}
+
+// releaseTemplates returns a clone to its pool, clones of replaced template sets are dropped
+func releaseTemplates(base *template.Template, tmpls *template.Template) {
+	if pool, ok := templatePools.Load(base); ok {
+		pool.(*sync.Pool).Put(tmpls)
+	}
+}
+
+// previewTemplates loads the set of a previewed theme, it is only cached while the site still uses base
+func previewTemplates(base *template.Template, config BlogConfiguration, theme Theme) (*template.Template, error) {
+	key := previewKey{base: base, themeDir: theme.Dir}
+	if tmpls, ok := previewTemplateSets.Load(key); ok {
+		return tmpls.(*template.Template), nil
+	}
+	tmpls, err := loadTemplates(config, theme)
+	if err != nil {
+		return nil, err
+	}
+
+	templateSetsMutex.Lock()
+	defer templateSetsMutex.Unlock()
+	if _, ok := templatePools.Load(base); !ok {
+		return tmpls, nil
+	}
+	if cached, ok := previewTemplateSets.Load(key); ok {
+		return cached.(*template.Template), nil
+	}
+	templatePools.Store(tmpls, &sync.Pool{})
+	previewTemplateSets.Store(key, tmpls)
+	return tmpls, nil
+}
+
+// forgetTemplates drops the clones and previews of a template set that was replaced, templateSetsMutex must be held
+func forgetTemplates(base *template.Template) {
+	if base == nil {
+		return
+	}
+	templatePools.Delete(base)
+	previewTemplateSets.Range(func(key any, tmpls any) bool {
+		if key.(previewKey).base == base {
+			previewTemplateSets.Delete(key)
+			templatePools.Delete(tmpls)
+		}
+		return true
+	})
+}
+
+func applyDirectoryChange(dir string) {
+	changed := false
+	for _, site := range allSites() {
+		config := site.Config()
+		switch dir {
+		case config.PostDir:
+			slog.Info("detected changes, refreshing posts", "site", site.Name, "dir", dir)
+			site.refreshPosts()
+			changed = true
+		case config.TemplateDir:
+			slog.Info("detected changes, reloading templates", "site", site.Name, "dir", dir)
+			err := site.reloadTemplates()
+			if err != nil {
+				slog.Error("keeping previous templates, reload failed", "site", site.Name, "error", err)
+			}
+			changed = true
+		}
+	}
+	if !changed {
+		slog.Info("detected changes", "dir", dir)
+	}
+}
+
+func generatePostFilenamesList(postDir string) ([]string, error) {
+	postpaths, err := filepath.Glob(filepath.Join(postDir, "*.md"))
 	if err != nil {
 		return []string{}, err
 	}
@@ -140,18 +735,18 @@ func generatePostFilenamesList() ([]string, error) {
 	return postlist, nil
 }
 
-func generatePostHeaderCaches() (map[string]PostHeader, []PostHeader, error) {
+func generatePostHeaderCaches(postDir string) (map[string]PostHeader, []PostHeader, error) {
 	var postsCache map[string]PostHeader = map[string]PostHeader{}
 	var postHeaders []PostHeader = []PostHeader{}
-	postsList, err := generatePostFilenamesList()
+	postsList, err := generatePostFilenamesList(postDir)
 	if err != nil {
-		log.Println(err)
+		slog.Error("couldn't list posts", "dir", postDir, "error", err)
 		return map[string]PostHeader{}, []PostHeader{}, err
 	}
 	for _, name := range postsList {
-		postheader, err := readPostHeader(name, blogConfig.PostDir)
+		postheader, err := readPostHeader(name, postDir)
 		if err != nil {
-			log.Println(err)
+			slog.Error("couldn't read post header", "post", name, "error", err)
 			return map[string]PostHeader{}, []PostHeader{}, err
 		}
 
@@ -161,175 +756,229 @@ func generatePostHeaderCaches() (map[string]PostHeader, []PostHeader, error) {
 	return postsCache, postHeaders, nil
 }
 
-func refreshPosts(sleepseconds int) {
-	for {
-		availablePosts, postHeaders, err := generatePostHeaderCaches()
-		if err != nil {
-			log.Println(err)
-			return
-		}
+// refreshPosts refreshes the post caches of every site
+func refreshPosts() error {
+	var errs []error
+	for _, site := range allSites() {
+		errs = append(errs, site.refreshPosts())
+	}
+	return errors.Join(errs...)
+}
 
-		slices.SortStableFunc(postHeaders, func(a PostHeader, b PostHeader) int {
-			atime, err := time.Parse(time.RFC1123, a.Timestamp)
-			if err != nil {
-				return -1
-			}
-			btime, err := time.Parse(time.RFC1123, b.Timestamp)
-			if err != nil {
-				return 1
-			}
+func (site *Site) refreshPosts() error {
+	start := time.Now()
+	availablePosts, postHeaders, err := generatePostHeaderCaches(site.Config().PostDir)
+	if err != nil {
+		slog.Error("couldn't refresh post cache", "site", site.Name, "error", err)
+		cacheRefreshErrors.Inc()
+		cacheRefreshDuration.Observe(time.Since(start).Seconds(), "error")
+		return err
+	}
 
-			return btime.Compare(atime)
-		})
+	slices.SortStableFunc(postHeaders, comparePostHeaders)
+	site.sortedPostIndex.Set(postHeaders)
+	site.postHeaders.Set(availablePosts)
+	cacheRefreshDuration.Observe(time.Since(start).Seconds(), "success")
+	return nil
+}
 
-		sortedPostIndexCache.Set(postHeaders)
-		postHeadersCache.Set(availablePosts)
-		if sleepseconds < 1 {
-			break
+func refreshPostsPeriodically(ctx context.Context, sleepseconds int) {
+	ticker := time.NewTicker(time.Duration(sleepseconds) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			refreshPosts()
 		}
-		time.Sleep(time.Duration(sleepseconds) * time.Second)
 	}
 }
 
+// homeHandler lists the posts by page number, or with ?before=<unix timestamp> the posts written before that time
 func homeHandler(w http.ResponseWriter, r *http.Request) {
-	postHeaders := sortedPostIndexCache.Get()
-	sess, _ := checkSession(r, blogConfig)
-	page := 0
-	prevPage := 0
+	site := requestSite(r)
+	config := site.Config()
+	postHeaders := site.sortedPostIndex.Get()
+	sess, _ := checkSession(r, config)
+
+	perPage := config.PostsPerPage
+	if perPage < 1 {
+		perPage = DEFAULT_POSTS_PER_PAGE
+	}
+	parameters := PageParameters[[]PostHeader]{HasSession: sess, TotalPages: pageCount(len(postHeaders), perPage)}
 
-	pageIndex := r.PathValue("pageIndex")
+	if before := r.URL.Query().Get("before"); before != "" {
+		cursor, err := strconv.ParseInt(before, 10, 64)
+		if err != nil {
+			renderError(w, r, badRequest("Invalid page cursor!"))
+			return
+		}
+		parameters.Cursor = before
+		parameters.PageData, parameters.NextCursor = postsBefore(postHeaders, time.Unix(cursor, 0), perPage, config.location())
+		renderPage(w, r, "index.html", parameters)
+		return
+	}
 
-	if pageIndex != "" && len(pageIndex) <= 8 {
+	page := 0
+	if pageIndex := r.PathValue("pageIndex"); pageIndex != "" {
 		conv, err := strconv.Atoi(pageIndex)
-		if err == nil && conv > 0 {
-			page = conv
-			prevPage = page - 1
+		if err != nil || conv < 0 || conv >= parameters.TotalPages {
+			renderError(w, r, notFound("Page not found!"))
+			return
 		}
+		page = conv
 	}
 
-	end := (1 + page) * 10
-	nextPage := page + 1
-	if end >= len(postHeaders) {
-		end = len(postHeaders)
-		nextPage = page
+	start := page * perPage
+	end := min(start+perPage, len(postHeaders))
+	parameters.PageData = postHeaders[start:end]
+	parameters.CurrentPage = page
+	parameters.PreviousPage = max(0, page-1)
+	parameters.NextPage = page
+	if end < len(postHeaders) {
+		parameters.NextPage = page + 1
 	}
-	start := page * 10
-	if start < 0 {
-		start = 0
-	} else if start >= end {
-		http.Redirect(w, r, "/", 307)
-		return
-	}
-
-	parameters := PageParameters[[]PostHeader]{PageData: postHeaders[start:end], HasSession: sess, CurrentPage: page, NextPage: nextPage, PreviousPage: prevPage}
+	parameters.Pages = pageLinks(page, parameters.TotalPages)
 
-	renderPage(w, "index.html", parameters)
+	renderPage(w, r, "index.html", parameters)
 }
 
 func postsHandler(w http.ResponseWriter, r *http.Request) {
+	site := requestSite(r)
+	config := site.Config()
 	postId := r.PathValue("postId")
 	postId = url.PathEscape(postId)
 	postId = fmt.Sprintf("%v.md", postId)
 
-	posts := postHeadersCache.Get()
+	posts := site.postHeaders.Get()
 	_, ok := posts[postId]
 
 	if !ok {
-		renderPage(w, "error.html", "Post not found!")
+		renderError(w, r, notFound("Post not found!"))
 		return
 	}
 
-	postdata, err := readPost(postId, blogConfig.PostDir)
+	postdata, err := readPost(postId, config.PostDir, site.Markdown())
 	if err != nil {
-		log.Println(err, postId)
-		renderPage(w, "error.html", "Something went wrong, please check back later!")
+		renderError(w, r, internalError(fmt.Errorf("couldn't read post %v: %w", postId, err)))
 		return
 	}
 
-	sess, _ := checkSession(r, blogConfig)
-	parameters := PageParameters[PostData]{PageData: postdata, HasSession: sess}
+	if postdata.Author != "" {
+		postdata.AuthorName = displayName(postdata.Author, config)
+	}
+	parameters := PageParameters[PostData]{PageData: postdata}
+	user, _, err := currentUser(r, config)
+	if err == nil {
+		parameters.HasSession = true
+		parameters.CanEdit = user.CanEditPost(postdata.Author)
+	}
 
-	renderPage(w, "post.html", parameters)
+	renderPage(w, r, "post.html", parameters)
 }
 
 func createPostHandler(w http.ResponseWriter, r *http.Request) {
-	ok, err := checkSession(r, blogConfig)
+	config := requestSite(r).Config()
+	logger := requestLogger(r)
+	user, _, err := currentUser(r, config)
 	if err != nil {
-		log.Println(err, " ", r.RemoteAddr)
-	}
-
-	if !ok {
-		http.Redirect(w, r, "login", 307)
+		logger.Info("session check failed", "remote_addr", clientIP(r, config.TrustedProxies), "error", err)
+		redirect(w, r, "/login", 307)
 		return
 	}
+	draft := draftFilename(user.Username)
 
 	form := CreatePostData{}
 	if r.Method == "GET" {
-		tmpPost, err := readCreatePost("_createpost.temp", blogConfig.PostDir)
+		tmpPost, err := readCreatePost(draft, config.PostDir)
 		if err == nil {
 			form.Title = tmpPost.Title
 			form.Text = tmpPost.Text
 			form.HTMLMessage = "Restored last unpublished preview of previous session"
-			renderPage(w, "create.html", form)
+			renderPage(w, r, "create.html", form)
 			return
 		}
 
-		renderPage(w, "create.html", form)
+		renderPage(w, r, "create.html", form)
 		return
 	} else if r.Method == "POST" {
 		err := r.ParseForm()
 		if err != nil {
-			log.Println(err)
+			logger.Warn("couldn't parse form", "error", err)
 			form.HTMLMessage = "Failed to parse data!"
-			renderPage(w, "create.html", form)
+			renderPage(w, r, "create.html", form)
+			return
+		}
+		err = checkCSRF(r, config)
+		if err != nil {
+			renderCSRFError(w, r, err)
 			return
 		}
 		publish := r.PostFormValue("publish") != ""
-		form := CreatePostData{Title: r.PostFormValue("title"), Text: r.PostFormValue("data"), Publish: publish}
+		form := CreatePostData{Title: r.PostFormValue("title"), Text: r.PostFormValue("data"), Publish: publish, Author: user.Username}
+		existing, err := readPostHeader(generatePostFilename(form.Title), config.PostDir)
+		if err == nil {
+			if !user.CanEditPost(existing.Author) {
+				logger.Warn("rejected overwriting post of another author", "post", existing.URL, "username", user.Username, "author", existing.Author)
+				form.HTMLMessage = "A post with this title by another author already exists!"
+				renderPageWithStatus(w, r, http.StatusForbidden, "create.html", form)
+				return
+			}
+			// editing keeps the original author
+			form.Author = existing.Author
+		}
 		if publish {
-			filename, err := writePost(form, blogConfig.PostDir)
+			postFile := generatePostFilename(form.Title)
+			hashBefore := postFileHash(postFile, config.PostDir)
+			filename, err := writePost(form, config.PostDir, config.location())
 			if err != nil {
-				log.Println(err)
+				logger.Error("couldn't publish post", "title", form.Title, "error", err)
 				form.HTMLMessage = "Failed publish post!"
-				renderPage(w, "create.html", form)
+				renderPage(w, r, "create.html", form)
 				return
 			}
-			form.HTMLMessage = "Published to file " + filename
-			_ = deletePost("_createpost.temp", blogConfig.PostDir)
-			refreshPosts(0)
+			form.HTMLMessage = template.HTML("Published to file " + template.HTMLEscapeString(filename))
+			logger.Info("published post", "file", filename, "username", user.Username)
+			action := AUDIT_PUBLISH
+			if hashBefore != "" {
+				action = AUDIT_EDIT
+			}
+			recordAudit(r, AuditEvent{Action: action, Actor: user.Username, PostID: strings.TrimSuffix(postFile, ".md"), HashBefore: hashBefore, HashAfter: postFileHash(postFile, config.PostDir)})
+			_ = deletePost(draft, config.PostDir)
+			siteOf(config).refreshPosts()
 		} else {
-			post, err := buildPost(form)
+			post, err := buildPost(form, config.location())
 			if err != nil {
-				log.Println(err)
+				logger.Warn("couldn't build preview", "error", err)
 				form.HTMLMessage = "Failed to generate preview!"
-				renderPage(w, "create.html", form)
+				renderPage(w, r, "create.html", form)
 				return
 			}
-			postdata, err := parsePost(post, "")
+			postdata, err := parsePost(post, "", siteOf(config).Markdown())
 			if err != nil {
-				log.Println(err)
+				logger.Warn("couldn't parse preview", "error", err)
 				form.HTMLMessage = "Failed to generate preview!"
-				renderPage(w, "create.html", form)
+				renderPage(w, r, "create.html", form)
 				return
 			}
 			form.HTMLMessage = postdata.Text
-			_, _ = writePostWithFilename(form, "_createpost.temp", blogConfig.PostDir)
+			_, _ = writePostWithFilename(form, draft, config.PostDir, config.location())
 		}
-		renderPage(w, "create.html", form)
+		renderPage(w, r, "create.html", form)
 		return
 	}
-	renderPage(w, "error.html", "Page not found!")
-	return
+	renderError(w, r, methodNotAllowed("GET", "POST"))
 }
 
 func editPostHandler(w http.ResponseWriter, r *http.Request) {
-	ok, err := checkSession(r, blogConfig)
+	config := requestSite(r).Config()
+	logger := requestLogger(r)
+	user, _, err := currentUser(r, config)
 	if err != nil {
-		log.Println(err, " ", r.RemoteAddr)
-	}
-
-	if !ok {
-		http.Redirect(w, r, "/login", 307)
+		logger.Info("session check failed", "remote_addr", clientIP(r, config.TrustedProxies), "error", err)
+		redirect(w, r, "/login", 307)
 		return
 	}
 
@@ -338,105 +987,303 @@ func editPostHandler(w http.ResponseWriter, r *http.Request) {
 		postId = url.PathEscape(postId)
 		postId = fmt.Sprintf("%v.md", postId)
 
-		createPostData, err := readCreatePost(postId, blogConfig.PostDir)
+		createPostData, err := readCreatePost(postId, config.PostDir)
 		if err != nil {
-			log.Println(err, postId)
-			renderPage(w, "error.html", "Post not found!")
+			logger.Warn("couldn't read post for editing", "post", postId, "error", err)
+			renderError(w, r, notFound("Post not found!"))
+			return
+		}
+		if !user.CanEditPost(createPostData.Author) {
+			renderError(w, r, forbidden("You can only edit your own posts!"))
 			return
 		}
-		renderPage(w, "create.html", createPostData)
+		renderPage(w, r, "create.html", createPostData)
 		return
 	}
-	renderPage(w, "error.html", "Page not found!")
-	return
+	renderError(w, r, methodNotAllowed("GET"))
 }
 
 func deletePostHandler(w http.ResponseWriter, r *http.Request) {
-	ok, err := checkSession(r, blogConfig)
+	config := requestSite(r).Config()
+	logger := requestLogger(r)
+	user, _, err := currentUser(r, config)
+	if err != nil {
+		logger.Info("session check failed", "remote_addr", clientIP(r, config.TrustedProxies), "error", err)
+		renderError(w, r, notFound("Page not found!"))
+		return
+	}
+
+	postId := r.PathValue("postId")
+	postId = url.PathEscape(postId)
+	postId = fmt.Sprintf("%v.md", postId)
+
+	header, err := readPostHeader(postId, config.PostDir)
 	if err != nil {
-		log.Println(err, " ", r.RemoteAddr)
+		renderError(w, r, notFound("Post not found!"))
+		return
+	}
+	if !user.CanEditPost(header.Author) {
+		renderError(w, r, forbidden("You can only delete your own posts!"))
+		return
 	}
 
-	if !ok {
-		renderPage(w, "error.html", "Page not found!")
+	if r.Method == "GET" {
+		renderPage(w, r, "confirmdelete.html", header)
 		return
 	}
-	if r.Method == "DELETE" || r.Method == "GET" {
-		postId := r.PathValue("postId")
-		postId = url.PathEscape(postId)
-		postId = fmt.Sprintf("%v.md", postId)
 
-		err := deletePost(postId, blogConfig.PostDir)
+	if r.Method == "DELETE" || r.Method == "POST" {
+		err := r.ParseForm()
+		if err == nil {
+			err = checkCSRF(r, config)
+		}
+		if err != nil {
+			renderCSRFError(w, r, err)
+			return
+		}
+
+		hashBefore := postFileHash(postId, config.PostDir)
+		err = deletePost(postId, config.PostDir)
 		if err != nil {
-			w.WriteHeader(404)
-			renderPage(w, "delete.html", "Deleting post failed: "+err.Error())
+			logger.Warn("couldn't delete post", "post", postId, "error", err)
+			renderPageWithStatus(w, r, http.StatusNotFound, "delete.html", "Deleting post failed: "+err.Error())
 			return
 		}
-		refreshPosts(0)
-		w.WriteHeader(200)
-		renderPage(w, "delete.html", "Post "+postId+" deleted!")
+		logger.Info("deleted post", "post", postId, "username", user.Username)
+		recordAudit(r, AuditEvent{Action: AUDIT_DELETE, Actor: user.Username, PostID: header.URL, HashBefore: hashBefore})
+		siteOf(config).refreshPosts()
+		renderPage(w, r, "delete.html", "Post "+postId+" deleted!")
 		return
 	}
-	renderPage(w, "error.html", "Page not found!")
-	return
+	renderError(w, r, methodNotAllowed("GET", "POST", "DELETE"))
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
-	if blogConfig.isPasswordless() {
-		renderPage(w, "error.html", "Page not found!")
+	config := requestSite(r).Config()
+	ip := clientIP(r, config.TrustedProxies)
+	logger := requestLogger(r).With("remote_addr", ip)
+	if config.isPasswordless() {
+		renderError(w, r, notFound("Page not found!"))
 		return
 	}
 
 	if r.Method == "POST" {
+		locked, wait, scope := loginGuard.Locked(ip)
+		if locked {
+			logger.Warn("login rejected due to lockout", "scope", scope, "retry_after", wait.String())
+			loginLockouts.Inc(scope)
+			writeRetryAfter(w, wait)
+			renderPageWithStatus(w, r, http.StatusTooManyRequests, "login.html", "Too many failed logins, try again in "+formatWait(wait))
+			return
+		}
+
 		err := r.ParseForm()
 		if err != nil {
-			log.Println("login failed for ", r.RemoteAddr, " due to invalid form data")
-			renderPage(w, "login.html", "Login failed!")
+			logger.Warn("login failed due to invalid form data", "error", err)
+			loginFailures.Inc("invalid_form")
+			renderPage(w, r, "login.html", "Login failed!")
 			return
 		}
-		password := r.PostFormValue("password")
-		res, err := calcHash(password, blogConfig.Salt[:])
+		err = checkCSRF(r, config)
 		if err != nil {
-			log.Println(err)
-			renderPage(w, "login.html", "Login failed!")
+			loginFailures.Inc("invalid_csrf")
+			renderCSRFError(w, r, err)
 			return
 		}
-		if res != blogConfig.Hash {
-			log.Println("login failed for ", r.RemoteAddr, " due to invalid password")
-			renderPage(w, "login.html", "Login failed!")
+		if r.PostFormValue(TOTP_FIELD) != "" {
+			loginSecondFactor(w, r, config, logger)
 			return
 		}
-		randbytes := make([]byte, 4)
-		_, err = rand.Read(randbytes)
+		username := strings.TrimSpace(strings.ToLower(r.PostFormValue("username")))
+		if username == "" {
+			username = LEGACY_ADMIN
+		}
+		user, exists := lookupUser(username, config)
+		hash := user.PasswordHash
+		if !exists || hash == "" {
+			// unknown users still pay for a hash, so response times don't reveal which users exist
+			hash = dummyPasswordHash()
+		}
+		password := r.PostFormValue("password")
+		valid, err := verifyPassword(password, hash)
+		valid = valid && exists && user.PasswordHash != ""
 		if err != nil {
-			log.Println("couldn't read cryptographically secure rand, session aborted")
-			renderPage(w, "login.html", "Login failed!")
+			logger.Warn("login failed, couldn't verify password", "error", err)
+			renderPage(w, r, "login.html", "Login failed!")
 			return
 		}
-		session, err := calcHash(blogConfig.Hash, randbytes)
-		if err != nil {
-			log.Println(err)
-			renderPage(w, "login.html", "Login failed!")
+		if !valid {
+			lockout := loginGuard.Failure(ip)
+			logger.Warn("login failed due to invalid credentials", "username", username, "lockout", lockout.String())
+			recordAudit(r, AuditEvent{Action: AUDIT_LOGIN_FAILED, Actor: username, Detail: "invalid credentials"})
+			loginFailures.Inc("invalid_password")
+			renderPage(w, r, "login.html", "Login failed!")
+			return
+		}
+		rememberMe := r.PostFormValue("remember") != ""
+		if user.TOTPSecret != "" {
+			err = pendingLogins.Start(w, config, user.Username, rememberMe)
+			if err != nil {
+				logger.Error("couldn't start two-factor login", "error", err)
+				renderPage(w, r, "login.html", "Login failed!")
+				return
+			}
+			logger.Info("password accepted, waiting for second factor", "username", user.Username)
+			renderPage(w, r, "logintotp.html", nil)
 			return
 		}
-		sessionsMutex.Lock()
-		sessions[session] = time.Now()
-		sessionsMutex.Unlock()
-		http.SetCookie(w, &http.Cookie{Name: "microblog_h", Value: session, Path: "/", Secure: true, MaxAge: 3600})
-		log.Println("login succeeded for ", r.RemoteAddr)
-		renderPage(w, "login.html", "Login succeeded!")
+		completeLogin(w, r, config, logger, user, rememberMe, "password")
 		return
 	}
 
-	renderPage(w, "login.html", nil)
+	renderPage(w, r, "login.html", nil)
 	return
 }
 
-func renderPage(w http.ResponseWriter, tmpl string, data any) {
+// loginSecondFactor finishes a login that passed the password check with a totp or recovery code
+func loginSecondFactor(w http.ResponseWriter, r *http.Request, config BlogConfiguration, logger *slog.Logger) {
+	ip := clientIP(r, config.TrustedProxies)
+	pending, key, ok := pendingLogins.Get(r)
+	if !ok {
+		renderPage(w, r, "login.html", "Your login has expired, please try again.")
+		return
+	}
+
+	// a pending login only continues on the site whose password was checked
+	user, exists := lookupUser(pending.Username, config)
+	if !exists || pending.Site != siteOf(config).Name {
+		pendingLogins.Finish(w, config, key)
+		renderPage(w, r, "login.html", "Login failed!")
+		return
+	}
+
+	valid, err := verifySecondFactor(user, r.PostFormValue(TOTP_FIELD), config)
+	if err != nil {
+		logger.Error("couldn't store used second factor", "username", user.Username, "error", err)
+		renderPage(w, r, "logintotp.html", "Login failed!")
+		return
+	}
+	if !valid {
+		pendingLogins.Failure(key)
+		lockout := loginGuard.Failure(ip)
+		logger.Warn("login failed due to invalid second factor", "username", user.Username, "lockout", lockout.String())
+		recordAudit(r, AuditEvent{Action: AUDIT_LOGIN_FAILED, Actor: user.Username, Detail: "invalid second factor"})
+		loginFailures.Inc("invalid_totp")
+		renderPage(w, r, "logintotp.html", "Invalid code, please try again.")
+		return
+	}
+
+	pendingLogins.Finish(w, config, key)
+	completeLogin(w, r, config, logger, user, pending.RememberMe, "password and second factor")
+}
+
+func completeLogin(w http.ResponseWriter, r *http.Request, config BlogConfiguration, logger *slog.Logger, user User, rememberMe bool, method string) {
+	loginGuard.Success(clientIP(r, config.TrustedProxies))
+	_, err := createSession(w, r, config, user.Username, rememberMe)
+	if err != nil {
+		logger.Error("couldn't create session", "error", err)
+		renderPage(w, r, "login.html", "Login failed!")
+		return
+	}
+	logger.Info("login succeeded", "username", user.Username, "remember_me", rememberMe)
+	recordAudit(r, AuditEvent{Action: AUDIT_LOGIN, Actor: user.Username, Detail: method})
+
+	if requiresTOTPEnrollment(user, config) {
+		redirect(w, r, "/2fa", 303)
+		return
+	}
+	renderPage(w, r, "login.html", "Login succeeded!")
+}
+
+func fileHandler(w http.ResponseWriter, r *http.Request) {
+	config := requestSite(r).Config()
+	theme, ok := previewTheme(r, config)
+	if !ok {
+		theme = config.theme
+	}
+	http.FileServerFS(siteFiles(config, theme)).ServeHTTP(w, r)
+}
+
+func faviconHandler(w http.ResponseWriter, r *http.Request) {
+	redirect(w, r, "/files/favicon.ico", 301)
+}
+
+func renderPage(w http.ResponseWriter, r *http.Request, tmpl string, data any) {
+	renderPageWithStatus(w, r, http.StatusOK, tmpl, data)
+}
+
+// renderPageWithStatus buffers the whole page before writing it, so a failing template results in a clean 500 page.
+// Error statuses fall back to error.html when there is no template for the status.
+func renderPageWithStatus(w http.ResponseWriter, r *http.Request, status int, tmpl string, data any) {
+	page, err := executePage(w, r, status, tmpl, data)
+	if err != nil {
+		requestLogger(r).Error("couldn't render template", "template", tmpl, "status", status, "error", err)
+		if status != http.StatusInternalServerError {
+			renderPageWithStatus(w, r, http.StatusInternalServerError, "500.html", INTERNAL_ERROR_MESSAGE)
+			return
+		}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	w.WriteHeader(status)
+	w.Write(page)
+}
+
+func executePage(w http.ResponseWriter, r *http.Request, status int, tmpl string, data any) ([]byte, error) {
+	site := requestSite(r)
+	config := site.Config()
+	base := site.Templates()
+	theme, previewing := previewTheme(r, config)
+	if previewing {
+		var err error
+		base, err = previewTemplates(base, config, theme)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load preview theme %v: %w", theme.Name, err)
+		}
+	} else {
+		theme = config.theme
+	}
+	tmpls, err := acquireTemplates(base)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseTemplates(base, tmpls)
+	if tmpls.Lookup(tmpl) == nil && status >= 400 {
+		tmpl = "error.html"
+	}
+	nonce := cspNonce(r)
+	tmpls.Funcs(template.FuncMap{
+		"nonce":  func() string { return nonce },
+		"option": func(name string) any { return theme.Values[name] },
+		"theme":  func() Theme { return theme },
+		"csrf":   func() string { return csrfToken(w, r, config) },
+		"sso":    func() bool { return config.OIDCIssuer != "" },
+		"absurl": func(parts ...any) string { return buildURL(requestBaseURL(r, config), parts...) },
+	})
 	var buf *bytes.Buffer = bytes.NewBuffer([]byte{})
-	templates.ExecuteTemplate(buf, tmpl, data)
-	s := string(buf.Bytes())
-	templatedata := TemplateData{Title: blogConfig.Title, Page: s}
+	err = tmpls.ExecuteTemplate(buf, tmpl, data)
+	if err != nil {
+		return nil, err
+	}
+	templatedata := TemplateData{Title: config.Title, Page: template.HTML(buf.String())}
+	if previewing {
+		templatedata.PreviewTheme = theme.Name
+	}
+	user, _, err := currentUser(r, config)
+	if err == nil {
+		templatedata.HasSession = true
+		templatedata.Username = user.Username
+		templatedata.IsAdmin = user.IsAdmin()
+	}
 
-	templates.ExecuteTemplate(w, "_base.html", templatedata)
+	// the page is buffered completely, so template functions can still set headers (like the csrf cookie)
+	buf.Reset()
+	err = tmpls.ExecuteTemplate(buf, "_base.html", templatedata)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
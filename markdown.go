@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/renderer/html"
+)
+
+var markdownExtensions map[string]goldmark.Extender = map[string]goldmark.Extender{
+	"definitionlist": extension.DefinitionList,
+	"footnote":       extension.Footnote,
+	"gfm":            extension.GFM,
+	"linkify":        extension.Linkify,
+	"strikethrough":  extension.Strikethrough,
+	"table":          extension.Table,
+	"tasklist":       extension.TaskList,
+	"typographer":    extension.Typographer,
+}
+
+var markdownRenderer SyncCache[goldmark.Markdown] = SyncCache[goldmark.Markdown]{value: goldmark.New()}
+
+func parseMarkdownExtensions(value string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if markdownExtensions[name] == nil {
+			var known []string
+			for extension := range markdownExtensions {
+				known = append(known, extension)
+			}
+			slices.Sort(known)
+			return nil, errors.New("unknown markdown extension " + name + ", use one of " + strings.Join(known, ", "))
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func newMarkdown(config BlogConfiguration) goldmark.Markdown {
+	var extenders []goldmark.Extender
+	for _, name := range config.MarkdownExtensions {
+		extenders = append(extenders, markdownExtensions[name])
+	}
+	options := []goldmark.Option{goldmark.WithExtensions(extenders...)}
+	if config.MarkdownUnsafe {
+		options = append(options, goldmark.WithRendererOptions(html.WithUnsafe()))
+	}
+	if config.MarkdownHardWraps {
+		options = append(options, goldmark.WithRendererOptions(html.WithHardWraps()))
+	}
+	return goldmark.New(options...)
+}
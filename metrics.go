@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var requestsTotal *counterVec = newCounterVec("golb_http_requests_total", "Number of handled http requests.", "route", "method", "code")
+var requestDuration *histogramVec = newHistogramVec("golb_http_request_duration_seconds", "Time spent handling http requests.", []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}, "route")
+var cacheRefreshDuration *histogramVec = newHistogramVec("golb_cache_refresh_duration_seconds", "Time spent refreshing the post caches.", []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}, "result")
+var cacheRefreshErrors *counterVec = newCounterVec("golb_cache_refresh_errors_total", "Number of failed post cache refreshes.")
+var loginFailures *counterVec = newCounterVec("golb_login_failures_total", "Number of failed login attempts.", "reason")
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+	mutex  sync.Mutex
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	key := formatLabels(c.labels, labelValues)
+	c.mutex.Lock()
+	c.values[key]++
+	c.mutex.Unlock()
+}
+
+func (c *counterVec) Write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v counter\n", c.name, c.help, c.name)
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%v 0\n", c.name)
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%v%v %v\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogram
+	mutex   sync.Mutex
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogram{}}
+}
+
+func (h *histogramVec) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += value
+	hist.count++
+}
+
+func (h *histogramVec) Write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.values) {
+		hist := h.values[key]
+		labelValues := strings.Split(key, "\xff")
+		bucketLabels := append(slices.Clone(h.labels), "le")
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%v_bucket%v %v\n", h.name, formatLabels(bucketLabels, append(slices.Clone(labelValues), formatFloat(bound))), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%v_bucket%v %v\n", h.name, formatLabels(bucketLabels, append(slices.Clone(labelValues), "+Inf")), hist.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", h.name, formatLabels(h.labels, labelValues), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%v_count%v %v\n", h.name, formatLabels(h.labels, labelValues), hist.count)
+	}
+}
+
+func writeGauge(w io.Writer, name string, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v gauge\n%v %v\n", name, help, name, name, formatFloat(value))
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	var builder strings.Builder
+	builder.WriteString("{")
+	for i, name := range names {
+		if i > 0 {
+			builder.WriteString(",")
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+		builder.WriteString(name + `="` + value + `"`)
+	}
+	builder.WriteString("}")
+	return builder.String()
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys[T any](values map[string]T) []string {
+	var keys []string = []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += n
+	return n, err
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// instrumentHandler records request counts and latencies, labeled with the matched route pattern
+func instrumentHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		requestsTotal.Inc(route, r.Method, strconv.Itoa(recorder.status))
+		requestDuration.Observe(time.Since(start).Seconds(), route)
+	})
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	posts := 0
+	activeSessions := 0
+	for _, site := range allSites() {
+		posts += len(site.postHeaders.Get())
+		sessions, _ := site.Sessions().List()
+		activeSessions += len(sessions)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	requestsTotal.Write(w)
+	requestDuration.Write(w)
+	writeGauge(w, "golb_posts", "Number of posts in the post caches of all sites.", float64(posts))
+	cacheRefreshDuration.Write(w)
+	cacheRefreshErrors.Write(w)
+	writeGauge(w, "golb_sessions_active", "Number of active sessions.", float64(activeSessions))
+	loginFailures.Write(w)
+	loginLockouts.Write(w)
+	rateLimited.Write(w)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	counter := newCounterVec("test_total", "Test counter.", "route", "code")
+	counter.Inc("/", "200")
+	counter.Inc("/", "200")
+	counter.Inc("/posts/{postId}", "404")
+
+	var builder strings.Builder
+	counter.Write(&builder)
+	output := builder.String()
+
+	if !strings.Contains(output, "# TYPE test_total counter\n") {
+		t.Fatal("Counter output is missing its type")
+	}
+	if !strings.Contains(output, `test_total{route="/",code="200"} 2`) || !strings.Contains(output, `test_total{route="/posts/{postId}",code="404"} 1`) {
+		t.Fatalf("Counter output does not contain the expected values:\n%v", output)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	hist := newHistogramVec("test_seconds", "Test histogram.", []float64{0.1, 1}, "route")
+	hist.Observe(0.05, "/")
+	hist.Observe(0.5, "/")
+	hist.Observe(5, "/")
+
+	var builder strings.Builder
+	hist.Write(&builder)
+	output := builder.String()
+
+	expected := []string{
+		`test_seconds_bucket{route="/",le="0.1"} 1`,
+		`test_seconds_bucket{route="/",le="1"} 2`,
+		`test_seconds_bucket{route="/",le="+Inf"} 3`,
+		`test_seconds_sum{route="/"} 5.55`,
+		`test_seconds_count{route="/"} 3`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line) {
+			t.Fatalf("Histogram output is missing %v:\n%v", line, output)
+		}
+	}
+}
+
+func TestInstrumentHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/instrumented/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := instrumentHandler(mux)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/instrumented/1", nil))
+
+	var builder strings.Builder
+	requestsTotal.Write(&builder)
+	if !strings.Contains(builder.String(), `golb_http_requests_total{route="/instrumented/{id}",method="GET",code="418"} 1`) {
+		t.Fatalf("Request was not counted under its route pattern:\n%v", builder.String())
+	}
+}
+
+func TestServerHandlerRoutes(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/chained/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	serverHandler(mux).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/chained/1", nil))
+
+	var builder strings.Builder
+	requestsTotal.Write(&builder)
+	if !strings.Contains(builder.String(), `golb_http_requests_total{route="/chained/{id}",method="GET",code="202"}`) {
+		t.Fatalf("Requests through the server handlers should be counted under their route pattern:\n%v", builder.String())
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	blogConfig.Set(BlogConfiguration{PostDir: t.TempDir()})
+	templates.Set(nil)
+	postHeadersCache.Set(nil)
+
+	recorder := httptest.NewRecorder()
+	readyzHandler(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatal("Readiness check should fail without templates and posts")
+	}
+
+	recorder = httptest.NewRecorder()
+	healthzHandler(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatal("Health check should always succeed")
+	}
+}
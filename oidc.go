@@ -0,0 +1,628 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const OIDC_COOKIE string = "golb_oidc"
+
+var oidcHTTPClient *http.Client = &http.Client{Timeout: 10 * time.Second}
+var oidcProviders *oidcProviderCache = &oidcProviderCache{}
+var oidcLogins *oidcLoginStore = &oidcLoginStore{logins: map[string]oidcLogin{}}
+
+// SSOIdentity is stored on sessions created by single sign-on, access is checked against the allowed claims on every request
+type SSOIdentity struct {
+	Subject string
+	Email   string
+	Name    string
+	Groups  []string
+}
+
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	keys                  map[string]crypto.PublicKey
+	fetched               time.Time
+}
+
+// oidcProviderCache keeps the discovery document and signing keys of every issuer for an hour, unknown key ids trigger a refresh
+type oidcProviderCache struct {
+	providers map[string]*oidcProvider
+	fetching  map[string]*oidcFetch
+	mutex     sync.Mutex
+}
+
+// oidcFetch is a running discovery, concurrent callers for the same issuer wait for it instead of fetching again
+type oidcFetch struct {
+	done     chan struct{}
+	provider *oidcProvider
+	err      error
+}
+
+// Get fetches the provider without holding the lock, so a slow identity provider doesn't block logins with other providers
+func (cache *oidcProviderCache) Get(issuer string, refresh bool) (*oidcProvider, error) {
+	cache.mutex.Lock()
+	provider, ok := cache.providers[issuer]
+	if !refresh && ok && time.Since(provider.fetched) < time.Hour {
+		cache.mutex.Unlock()
+		return provider, nil
+	}
+	fetch, running := cache.fetching[issuer]
+	if !running {
+		if cache.fetching == nil {
+			cache.fetching = map[string]*oidcFetch{}
+		}
+		fetch = &oidcFetch{done: make(chan struct{})}
+		cache.fetching[issuer] = fetch
+	}
+	cache.mutex.Unlock()
+
+	if running {
+		<-fetch.done
+		return fetch.provider, fetch.err
+	}
+
+	fetch.provider, fetch.err = discoverOIDCProvider(issuer)
+	cache.mutex.Lock()
+	delete(cache.fetching, issuer)
+	if fetch.err == nil {
+		if cache.providers == nil {
+			cache.providers = map[string]*oidcProvider{}
+		}
+		cache.providers[issuer] = fetch.provider
+	}
+	cache.mutex.Unlock()
+	close(fetch.done)
+	return fetch.provider, fetch.err
+}
+
+func fetchJSON(target string, v any) error {
+	response, err := oidcHTTPClient.Get(target)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return errors.New("unexpected status " + response.Status + " from " + target)
+	}
+	return json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(v)
+}
+
+func discoverOIDCProvider(issuer string) (*oidcProvider, error) {
+	var provider oidcProvider
+	err := fetchJSON(strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &provider)
+	if err != nil {
+		return nil, errors.New("openid discovery failed: " + err.Error())
+	}
+	if provider.Issuer != issuer {
+		return nil, errors.New("openid discovery returned issuer " + provider.Issuer + ", expected " + issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, errors.New("openid discovery document is missing endpoints")
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = fetchJSON(provider.JWKSURI, &jwks)
+	if err != nil {
+		return nil, errors.New("couldn't fetch signing keys: " + err.Error())
+	}
+	provider.keys = map[string]crypto.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			continue
+		}
+		provider.keys[jwk.Kid] = key
+	}
+	provider.fetched = time.Now()
+
+	return &provider, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(decoded) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(decoded), nil
+}
+
+func (jwk jsonWebKey) PublicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, errors.New("unsupported curve " + jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("ec key is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errors.New("unsupported key type " + jwk.Kty)
+}
+
+// audience is either a single string or a list of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	err := json.Unmarshal(data, &list)
+	*a = list
+	return err
+}
+
+type idTokenClaims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        audience `json:"aud"`
+	AuthorizedParty string   `json:"azp"`
+	Expiry          int64    `json:"exp"`
+	IssuedAt        int64    `json:"iat"`
+	Nonce           string   `json:"nonce"`
+	Email           string   `json:"email"`
+	EmailVerified   *bool    `json:"email_verified"`
+	Name            string   `json:"name"`
+}
+
+// verifySignature checks a JWS signature, only the asymmetric algorithms identity providers use for id tokens are accepted
+func verifySignature(alg string, key crypto.PublicKey, signed []byte, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512":
+		hash = crypto.SHA512
+	default:
+		return errors.New("unsupported signing algorithm " + alg)
+	}
+	hasher := hash.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	switch publicKey := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return errors.New("algorithm " + alg + " doesn't match rsa key")
+		}
+		return rsa.VerifyPKCS1v15(publicKey, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return errors.New("algorithm " + alg + " doesn't match ec key")
+		}
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid ec signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(publicKey, digest, r, s) {
+			return errors.New("invalid ec signature")
+		}
+		return nil
+	}
+	return errors.New("unsupported key type")
+}
+
+// verifyIDToken validates signature, issuer, audience, expiry and nonce of an id token and returns its claims
+func verifyIDToken(token string, bc BlogConfiguration, nonce string, now time.Time) (idTokenClaims, map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return idTokenClaims{}, nil, errors.New("malformed id token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerBytes, &header) != nil {
+		return idTokenClaims{}, nil, errors.New("malformed id token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return idTokenClaims{}, nil, errors.New("malformed id token signature")
+	}
+
+	provider, err := oidcProviders.Get(bc.OIDCIssuer, false)
+	if err != nil {
+		return idTokenClaims{}, nil, err
+	}
+	key, ok := lookupSigningKey(provider, header.Kid)
+	if !ok {
+		// the provider may have rotated its keys
+		provider, err = oidcProviders.Get(bc.OIDCIssuer, true)
+		if err != nil {
+			return idTokenClaims{}, nil, err
+		}
+		key, ok = lookupSigningKey(provider, header.Kid)
+		if !ok {
+			return idTokenClaims{}, nil, errors.New("unknown signing key " + header.Kid)
+		}
+	}
+	err = verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return idTokenClaims{}, nil, errors.New("invalid id token signature: " + err.Error())
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return idTokenClaims{}, nil, errors.New("malformed id token payload")
+	}
+	var claims idTokenClaims
+	var raw map[string]any
+	if json.Unmarshal(payload, &claims) != nil || json.Unmarshal(payload, &raw) != nil {
+		return idTokenClaims{}, nil, errors.New("malformed id token claims")
+	}
+
+	const skew time.Duration = time.Minute
+	if claims.Issuer != bc.OIDCIssuer {
+		return idTokenClaims{}, nil, errors.New("id token issued by " + claims.Issuer)
+	}
+	if !slices.Contains(claims.Audience, bc.OIDCClientID) || (len(claims.Audience) > 1 && claims.AuthorizedParty != bc.OIDCClientID) {
+		return idTokenClaims{}, nil, errors.New("id token is not meant for this client")
+	}
+	if claims.Expiry == 0 || now.Add(-skew).After(time.Unix(claims.Expiry, 0)) {
+		return idTokenClaims{}, nil, errors.New("id token expired")
+	}
+	if claims.IssuedAt != 0 && time.Unix(claims.IssuedAt, 0).After(now.Add(skew)) {
+		return idTokenClaims{}, nil, errors.New("id token issued in the future")
+	}
+	if claims.Subject == "" {
+		return idTokenClaims{}, nil, errors.New("id token has no subject")
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return idTokenClaims{}, nil, errors.New("id token nonce doesn't match")
+	}
+
+	return claims, raw, nil
+}
+
+func lookupSigningKey(provider *oidcProvider, kid string) (crypto.PublicKey, bool) {
+	key, ok := provider.keys[kid]
+	if ok || kid != "" || len(provider.keys) != 1 {
+		return key, ok
+	}
+	for _, key := range provider.keys {
+		return key, true
+	}
+	return nil, false
+}
+
+// claimStrings reads a claim that is either a string or a list of strings, like the groups claim
+func claimStrings(raw map[string]any, name string) []string {
+	var values []string = []string{}
+	switch value := raw[name].(type) {
+	case string:
+		values = append(values, value)
+	case []any:
+		for _, item := range value {
+			str, ok := item.(string)
+			if ok {
+				values = append(values, str)
+			}
+		}
+	}
+	return values
+}
+
+// ssoAllowed matches an identity against rules like email:alice@example.com, sub:1234 or group:blog-admins
+func ssoAllowed(identity SSOIdentity, rules []string) bool {
+	for _, rule := range rules {
+		kind, value, _ := strings.Cut(rule, ":")
+		switch kind {
+		case "email":
+			if identity.Email != "" && strings.EqualFold(identity.Email, value) {
+				return true
+			}
+		case "sub":
+			if identity.Subject == value {
+				return true
+			}
+		case "group":
+			if slices.Contains(identity.Groups, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parseOIDCAllowed(allowed string) ([]string, error) {
+	var rules []string = []string{}
+	for _, rule := range strings.Split(allowed, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		kind, value, found := strings.Cut(rule, ":")
+		if !found || value == "" || (kind != "email" && kind != "sub" && kind != "group") {
+			return nil, errors.New("invalid oidc rule " + rule + ", use email:, sub: or group:")
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// ssoUsername is the name sso users are known by, it can't collide with local users since those can't contain @ or :
+func ssoUsername(identity SSOIdentity) string {
+	if identity.Email != "" {
+		return strings.ToLower(identity.Email)
+	}
+	return "oidc:" + identity.Subject
+}
+
+type oidcLogin struct {
+	Site     string
+	Nonce    string
+	Verifier string
+	Expires  time.Time
+}
+
+// oidcLoginStore keeps the nonce and pkce verifier of logins that were sent to the identity provider, keyed by state
+type oidcLoginStore struct {
+	logins map[string]oidcLogin
+	mutex  sync.Mutex
+}
+
+func (store *oidcLoginStore) Start(state string, login oidcLogin) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	now := time.Now()
+	for key, existing := range store.logins {
+		if now.After(existing.Expires) {
+			delete(store.logins, key)
+		}
+	}
+	store.logins[state] = login
+}
+
+// Finish returns the login for state, a state can only be used once
+func (store *oidcLoginStore) Finish(state string) (oidcLogin, bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	login, ok := store.logins[state]
+	delete(store.logins, state)
+	if !ok || time.Now().After(login.Expires) {
+		return oidcLogin{}, false
+	}
+	return login, true
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// oidcLoginHandler sends the browser to the identity provider using the authorization code flow with PKCE
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	config := requestSite(r).Config()
+	logger := requestLogger(r)
+	if config.OIDCIssuer == "" {
+		renderError(w, r, notFound("Page not found!"))
+		return
+	}
+
+	provider, err := oidcProviders.Get(config.OIDCIssuer, false)
+	if err != nil {
+		logger.Error("couldn't reach identity provider", "issuer", config.OIDCIssuer, "error", err)
+		renderPageWithStatus(w, r, http.StatusBadGateway, "login.html", "Single sign-on is currently unavailable, please try again later.")
+		return
+	}
+
+	var tokens [3]string
+	for i := range tokens {
+		tokens[i], err = generateToken()
+		if err != nil {
+			logger.Error("couldn't generate oidc state", "error", err)
+			renderPage(w, r, "login.html", "Login failed!")
+			return
+		}
+	}
+	state, nonce, verifier := tokens[0], tokens[1], tokens[2]
+	oidcLogins.Start(state, oidcLogin{Site: siteOf(config).Name, Nonce: nonce, Verifier: verifier, Expires: time.Now().Add(10 * time.Minute)})
+
+	// the state is bound to this browser, so nobody can log someone else into their account
+	http.SetCookie(w, &http.Cookie{Name: OIDC_COOKIE, Value: state, Path: config.BasePath + "/login/oidc", Secure: true, HttpOnly: true, SameSite: http.SameSiteLaxMode, MaxAge: 600})
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", config.OIDCClientID)
+	query.Set("redirect_uri", config.OIDCRedirectURL)
+	query.Set("scope", config.OIDCScopes)
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", pkceChallenge(verifier))
+	query.Set("code_challenge_method", "S256")
+	separator := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, provider.AuthorizationEndpoint+separator+query.Encode(), 303)
+}
+
+func exchangeOIDCCode(bc BlogConfiguration, code string, verifier string) (string, error) {
+	provider, err := oidcProviders.Get(bc.OIDCIssuer, false)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", bc.OIDCRedirectURL)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", bc.OIDCClientID)
+	request, err := http.NewRequest("POST", provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if bc.OIDCClientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(bc.OIDCClientID), url.QueryEscape(bc.OIDCClientSecret))
+	}
+
+	response, err := oidcHTTPClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&tokens)
+	if err != nil {
+		return "", errors.New("couldn't parse token response: " + err.Error())
+	}
+	if response.StatusCode != http.StatusOK || tokens.Error != "" {
+		return "", errors.New("token request failed: " + response.Status + " " + tokens.Error + " " + tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("token response contains no id token")
+	}
+	return tokens.IDToken, nil
+}
+
+// oidcCallbackHandler finishes the login when the identity provider redirects back
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	config := requestSite(r).Config()
+	ip := clientIP(r, config.TrustedProxies)
+	logger := requestLogger(r).With("remote_addr", ip)
+	if config.OIDCIssuer == "" {
+		renderError(w, r, notFound("Page not found!"))
+		return
+	}
+
+	query := r.URL.Query()
+	state := query.Get("state")
+	http.SetCookie(w, &http.Cookie{Name: OIDC_COOKIE, Value: "", Path: config.BasePath + "/login/oidc", Secure: true, HttpOnly: true, SameSite: http.SameSiteLaxMode, MaxAge: -1})
+	cookie, err := r.Cookie(OIDC_COOKIE)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		logger.Warn("sso login failed due to state mismatch")
+		loginFailures.Inc("invalid_sso_state")
+		renderPage(w, r, "login.html", "Your login has expired, please try again.")
+		return
+	}
+	login, ok := oidcLogins.Finish(state)
+	if !ok || login.Site != siteOf(config).Name {
+		loginFailures.Inc("invalid_sso_state")
+		renderPage(w, r, "login.html", "Your login has expired, please try again.")
+		return
+	}
+	if query.Get("error") != "" {
+		logger.Warn("sso login rejected by identity provider", "error", query.Get("error"), "description", query.Get("error_description"))
+		loginFailures.Inc("sso_rejected")
+		renderPage(w, r, "login.html", "Login failed!")
+		return
+	}
+
+	idToken, err := exchangeOIDCCode(config, query.Get("code"), login.Verifier)
+	if err != nil {
+		logger.Error("sso code exchange failed", "error", err)
+		loginFailures.Inc("sso_exchange")
+		renderPage(w, r, "login.html", "Login failed!")
+		return
+	}
+	claims, raw, err := verifyIDToken(idToken, config, login.Nonce, time.Now())
+	if err != nil {
+		logger.Warn("sso login failed due to invalid id token", "error", err)
+		recordAudit(r, AuditEvent{Action: AUDIT_LOGIN_FAILED, Detail: "sso: " + err.Error()})
+		loginFailures.Inc("invalid_id_token")
+		renderPage(w, r, "login.html", "Login failed!")
+		return
+	}
+
+	identity := SSOIdentity{Subject: claims.Subject, Name: claims.Name, Groups: claimStrings(raw, config.OIDCGroupsClaim)}
+	if claims.EmailVerified != nil && *claims.EmailVerified {
+		identity.Email = claims.Email
+	}
+	if !ssoAllowed(identity, config.OIDCAllowed) {
+		logger.Warn("sso login failed, identity not allowed", "sub", identity.Subject, "email", identity.Email)
+		recordAudit(r, AuditEvent{Action: AUDIT_LOGIN_FAILED, Actor: ssoUsername(identity), Detail: "sso: not allowed"})
+		loginFailures.Inc("sso_not_allowed")
+		renderPageWithStatus(w, r, http.StatusForbidden, "login.html", "Your account has no access to this blog.")
+		return
+	}
+
+	session, err := createSession(w, r, config, ssoUsername(identity), false)
+	if err == nil {
+		session.SSO = &identity
+		err = siteOf(config).Sessions().Save(session)
+	}
+	if err != nil {
+		logger.Error("couldn't create session", "error", err)
+		renderPage(w, r, "login.html", "Login failed!")
+		return
+	}
+	logger.Info("sso login succeeded", "username", session.Username, "sub", identity.Subject)
+	recordAudit(r, AuditEvent{Action: AUDIT_LOGIN, Actor: session.Username, Detail: "sso"})
+	redirect(w, r, "/", 303)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubProvider is a minimal OpenID Connect provider, the authorization step is skipped by registering codes directly
+type stubProvider struct {
+	server     *httptest.Server
+	rsaKey     *rsa.PrivateKey
+	ecKey      *ecdsa.PrivateKey
+	codes      map[string]stubCode
+	tokenCalls int
+}
+
+type stubCode struct {
+	challenge string
+	claims    map[string]any
+	alg       string
+	signer    crypto.Signer
+}
+
+func newStubProvider(t *testing.T) *stubProvider {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &stubProvider{rsaKey: rsaKey, ecKey: ecKey, codes: map[string]stubCode{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 stub.server.URL,
+			"authorization_endpoint": stub.server.URL + "/authorize",
+			"token_endpoint":         stub.server.URL + "/token",
+			"jwks_uri":               stub.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		encode := func(value *big.Int) string { return base64.RawURLEncoding.EncodeToString(value.Bytes()) }
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": encode(rsaKey.N), "e": encode(big.NewInt(int64(rsaKey.E)))},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(ecKey.X), "y": encode(ecKey.Y)},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		stub.tokenCalls++
+		r.ParseForm()
+		code, ok := stub.codes[r.PostFormValue("code")]
+		delete(stub.codes, r.PostFormValue("code"))
+		clientID, secret, _ := r.BasicAuth()
+		if !ok || clientID != "golb" || secret != "secret" || pkceChallenge(r.PostFormValue("code_verifier")) != code.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": signTestJWT(t, code.signer, code.alg, code.claims), "token_type": "Bearer"})
+	})
+	stub.server = httptest.NewServer(mux)
+	t.Cleanup(stub.server.Close)
+	return stub
+}
+
+func signTestJWT(t *testing.T, signer crypto.Signer, alg string, claims map[string]any) string {
+	kid := "rsa"
+	if alg == "ES256" {
+		kid = "ec"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch key := signer.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func setupOIDCTest(t *testing.T, stub *stubProvider) BlogConfiguration {
+	sessionStore = newMemorySessionStore()
+	oidcProviders = &oidcProviderCache{}
+	oidcLogins = &oidcLoginStore{logins: map[string]oidcLogin{}}
+	oidcHTTPClient = stub.server.Client()
+	config := BlogConfiguration{TemplateDir: "templates", SessionTimeout: 60, RememberMeDays: 30,
+		OIDCIssuer: stub.server.URL, OIDCClientID: "golb", OIDCClientSecret: "secret", OIDCRedirectURL: "https://blog.example.com/login/oidc/callback",
+		OIDCScopes: "openid email", OIDCGroupsClaim: "groups", OIDCAllowed: []string{"email:alice@example.com", "group:blog-admins"}}
+	blogConfig.Set(config)
+	err := reloadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// loginWithStub runs the login flow, mutate can change the issued claims, algorithm and signing key
+func loginWithStub(t *testing.T, stub *stubProvider, config BlogConfiguration, mutate func(code *stubCode)) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	oidcLoginHandler(recorder, httptest.NewRequest("GET", "/login/oidc", nil))
+	location, err := url.Parse(recorder.Header().Get("Location"))
+	if err != nil || recorder.Code != 303 {
+		t.Fatalf("Login should redirect to the identity provider, got %v", recorder.Code)
+	}
+	query := location.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("client_id") != "golb" || query.Get("redirect_uri") != config.OIDCRedirectURL {
+		t.Fatal("Authorization request should use PKCE and the configured client")
+	}
+
+	code := stubCode{challenge: query.Get("code_challenge"), alg: "RS256", signer: stub.rsaKey, claims: map[string]any{
+		"iss": config.OIDCIssuer, "aud": "golb", "sub": "1234", "email": "alice@example.com", "email_verified": true, "name": "Alice",
+		"nonce": query.Get("nonce"), "iat": time.Now().Unix(), "exp": time.Now().Add(5 * time.Minute).Unix(),
+	}}
+	if mutate != nil {
+		mutate(&code)
+	}
+	stub.codes["code"] = code
+
+	callback := httptest.NewRequest("GET", "/login/oidc/callback?code=code&state="+url.QueryEscape(query.Get("state")), nil)
+	for _, cookie := range recorder.Result().Cookies() {
+		callback.AddCookie(cookie)
+	}
+	recorder = httptest.NewRecorder()
+	oidcCallbackHandler(recorder, callback)
+	return recorder
+}
+
+func TestOIDCLogin(t *testing.T) {
+	stub := newStubProvider(t)
+	config := setupOIDCTest(t, stub)
+
+	recorder := loginWithStub(t, stub, config, nil)
+	sessions, _ := sessionStore.List()
+	if recorder.Code != 303 || len(sessions) != 1 || sessions[0].Username != "alice@example.com" || sessions[0].SSO == nil {
+		t.Fatalf("Valid id token should create a session, got %v", recorder.Code)
+	}
+
+	r := httptest.NewRequest("GET", "/create", nil)
+	r.AddCookie(recorder.Result().Cookies()[len(recorder.Result().Cookies())-1])
+	user, _, err := currentUser(r, config)
+	if err != nil || !user.IsAdmin() || user.Name() != "Alice" {
+		t.Fatal("Single sign-on users should be admins")
+	}
+
+	config.OIDCAllowed = []string{"group:blog-admins"}
+	_, _, err = currentUser(r, config)
+	if err == nil {
+		t.Fatal("Removing the allowed rule should revoke access")
+	}
+}
+
+func TestOIDCLoginGroupAndES256(t *testing.T) {
+	stub := newStubProvider(t)
+	config := setupOIDCTest(t, stub)
+
+	loginWithStub(t, stub, config, func(code *stubCode) {
+		code.alg = "ES256"
+		code.signer = stub.ecKey
+		code.claims["email"] = "bob@example.com"
+		code.claims["groups"] = []string{"staff", "blog-admins"}
+	})
+	sessions, _ := sessionStore.List()
+	if len(sessions) != 1 || sessions[0].Username != "bob@example.com" {
+		t.Fatal("Group members should be allowed and ES256 tokens accepted")
+	}
+}
+
+func TestOIDCRejectsInvalidTokens(t *testing.T) {
+	stub := newStubProvider(t)
+	config := setupOIDCTest(t, stub)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	cases := map[string]func(code *stubCode){
+		"wrong signing key":  func(code *stubCode) { code.signer = otherKey },
+		"wrong audience":     func(code *stubCode) { code.claims["aud"] = "other" },
+		"wrong issuer":       func(code *stubCode) { code.claims["iss"] = "https://evil.example.com" },
+		"expired":            func(code *stubCode) { code.claims["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"wrong nonce":        func(code *stubCode) { code.claims["nonce"] = "replayed" },
+		"not allowed":        func(code *stubCode) { code.claims["email"] = "mallory@example.com" },
+		"unverified email":   func(code *stubCode) { code.claims["email_verified"] = false },
+		"unknown email":      func(code *stubCode) { delete(code.claims, "email_verified") },
+		"wrong pkce":         func(code *stubCode) { code.challenge = pkceChallenge("other") },
+		"unsigned algorithm": func(code *stubCode) { code.alg = "none" },
+	}
+	for name, mutate := range cases {
+		loginWithStub(t, stub, config, mutate)
+		sessions, _ := sessionStore.List()
+		if len(sessions) != 0 {
+			t.Fatalf("Login with %v should fail", name)
+		}
+	}
+}
+
+func TestOIDCStateMismatch(t *testing.T) {
+	stub := newStubProvider(t)
+	setupOIDCTest(t, stub)
+
+	recorder := httptest.NewRecorder()
+	oidcLoginHandler(recorder, httptest.NewRequest("GET", "/login/oidc", nil))
+	location, _ := url.Parse(recorder.Header().Get("Location"))
+
+	// the callback arrives in a browser that didn't start the login
+	callback := httptest.NewRequest("GET", "/login/oidc/callback?code=code&state="+url.QueryEscape(location.Query().Get("state")), nil)
+	recorder = httptest.NewRecorder()
+	oidcCallbackHandler(recorder, callback)
+	sessions, _ := sessionStore.List()
+	if len(sessions) != 0 || stub.tokenCalls != 0 {
+		t.Fatal("Callback without the state cookie should be rejected before exchanging the code")
+	}
+}
+
+func TestParseOIDCAllowed(t *testing.T) {
+	rules, err := parseOIDCAllowed("email:alice@example.com, group:admins,sub:1234")
+	if err != nil || len(rules) != 3 || rules[1] != "group:admins" {
+		t.Fatal("Valid rules should be parsed")
+	}
+	_, err = parseOIDCAllowed("alice@example.com")
+	if err == nil {
+		t.Fatal("Rules without a kind should be rejected")
+	}
+}
+
+func TestOIDCSlowProvider(t *testing.T) {
+	oidcProviders = &oidcProviderCache{}
+	stub := newStubProvider(t)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	go oidcProviders.Get(slow.URL, false)
+	<-started
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := oidcProviders.Get(stub.server.URL, false)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("A slow identity provider shouldn't block other providers")
+	}
+}
+
+func TestOIDCConcurrentDiscovery(t *testing.T) {
+	oidcProviders = &oidcProviderCache{}
+	var discoveries atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/jwks" {
+			w.Write([]byte(`{"keys": []}`))
+			return
+		}
+		if discoveries.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 server.URL,
+			"authorization_endpoint": server.URL + "/authorize",
+			"token_endpoint":         server.URL + "/token",
+			"jwks_uri":               server.URL + "/jwks",
+		})
+	}))
+	defer server.Close()
+
+	var callers sync.WaitGroup
+	get := func() {
+		defer callers.Done()
+		_, err := oidcProviders.Get(server.URL, false)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	callers.Add(1)
+	go get()
+	<-started
+	for range 5 {
+		callers.Add(1)
+		go get()
+	}
+	close(release)
+	callers.Wait()
+	if discoveries.Load() != 1 {
+		t.Fatalf("Concurrent logins should share one discovery, got %v", discoveries.Load())
+	}
+}
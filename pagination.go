@@ -0,0 +1,54 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"time"
+)
+
+// PAGE_LINK_RADIUS is how many pages before and after the current one are linked besides the first and last page
+const PAGE_LINK_RADIUS int = 2
+
+// pageCount is the number of index pages, an empty blog still has its first page
+func pageCount(posts int, perPage int) int {
+	return max(1, (posts+perPage-1)/perPage)
+}
+
+// pageLinks lists the first and last page and the pages around the current one, Gap marks links that skip pages
+func pageLinks(current int, total int) []PageLink {
+	indices := []int{0, total - 1}
+	for index := max(0, current-PAGE_LINK_RADIUS); index <= min(total-1, current+PAGE_LINK_RADIUS); index++ {
+		indices = append(indices, index)
+	}
+	slices.Sort(indices)
+	indices = slices.Compact(indices)
+
+	links := make([]PageLink, 0, len(indices))
+	for i, index := range indices {
+		link := PageLink{Number: index + 1, Current: index == current, Gap: i > 0 && index > indices[i-1]+1}
+		if index > 0 {
+			link.Path = "page/" + strconv.Itoa(index)
+		}
+		links = append(links, link)
+	}
+	return links
+}
+
+// postsBefore returns the page of posts written before the cursor and the cursor of the next page, empty on the last page.
+// Pages don't end between posts with the same timestamp, so following the cursors never skips a post.
+func postsBefore(postHeaders []PostHeader, before time.Time, perPage int, location *time.Location) ([]PostHeader, string) {
+	var page []PostHeader
+	var last time.Time
+	for _, header := range postHeaders {
+		timestamp, ok := postTime(header.Timestamp, location)
+		if !ok || !timestamp.Before(before) {
+			continue
+		}
+		if len(page) >= perPage && !timestamp.Equal(last) {
+			return page, strconv.FormatInt(last.Unix(), 10)
+		}
+		page = append(page, header)
+		last = timestamp
+	}
+	return page, ""
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPageLinks(t *testing.T) {
+	numbers := func(links []PageLink) []int {
+		var result []int
+		for _, link := range links {
+			result = append(result, link.Number)
+		}
+		return result
+	}
+	if links := pageLinks(0, 1); len(links) != 1 || !links[0].Current || links[0].Path != "" {
+		t.Fatalf("A single page should link to the index, got %v", links)
+	}
+	links := pageLinks(10, 50)
+	if !slices.Equal(numbers(links), []int{1, 9, 10, 11, 12, 13, 50}) {
+		t.Fatalf("Expected the first, last and neighbouring pages, got %v", numbers(links))
+	}
+	if !links[1].Gap || links[2].Gap || !links[6].Gap || !links[3].Current || links[3].Path != "page/10" {
+		t.Fatalf("Gaps and the current page should be marked, got %v", links)
+	}
+	if !slices.Equal(numbers(pageLinks(1, 4)), []int{1, 2, 3, 4}) {
+		t.Fatalf("Pages shouldn't be listed twice, got %v", numbers(pageLinks(1, 4)))
+	}
+	if pageCount(0, 10) != 1 || pageCount(10, 10) != 1 || pageCount(11, 10) != 2 {
+		t.Fatal("Unexpected page count")
+	}
+}
+
+func TestPagination(t *testing.T) {
+	defaultSite.SetConfig(BlogConfiguration{Title: "Pages", PostDir: t.TempDir(), TemplateDir: "templates", PostsPerPage: 2, ViewOnly: true, Location: time.UTC})
+	err := reloadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second and third post share a timestamp, the cursor pages must keep them together
+	start := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	var headers []PostHeader
+	for i, offset := range []int{0, 1, 1, 2, 3} {
+		timestamp := start.Add(-time.Duration(offset) * time.Hour).Format(time.RFC1123)
+		headers = append(headers, PostHeader{Title: fmt.Sprintf("Post %v", i), Timestamp: timestamp, URL: fmt.Sprintf("post-%v", i)})
+	}
+	defaultSite.sortedPostIndex.Set(headers)
+	mux := http.NewServeMux()
+	registerPublicRoutes(mux, "")
+
+	serve := func(target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("GET", target, nil))
+		return recorder
+	}
+
+	body := serve("/page/1").Body.String()
+	for _, expected := range []string{"Post 2", "Post 3", `<a href="/">1</a>`, "<strong>2</strong>", `<a href="/page/2">3</a>`, `href="/page/2">older`} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("Expected %v on the second page, got %v", expected, body)
+		}
+	}
+	for _, target := range []string{"/page/3", "/page/-1", "/page/abc", "/page/123456789012345678901234567890"} {
+		if recorder := serve(target); recorder.Code != http.StatusNotFound {
+			t.Fatalf("%v should be a 404, got %v", target, recorder.Code)
+		}
+	}
+	if recorder := serve("/?before=yesterday"); recorder.Code != http.StatusBadRequest {
+		t.Fatalf("Invalid cursors should be rejected, got %v", recorder.Code)
+	}
+
+	page, nextCursor := postsBefore(headers, start.Add(time.Minute), 2, time.UTC)
+	if len(page) != 3 || nextCursor != fmt.Sprint(start.Add(-time.Hour).Unix()) {
+		t.Fatalf("A page shouldn't end between posts with the same timestamp, got %v posts and cursor %v", len(page), nextCursor)
+	}
+
+	var seen []string
+	cursor := fmt.Sprint(start.Add(time.Minute).Unix())
+	for cursor != "" {
+		next := ""
+		body := serve("/?before=" + cursor).Body.String()
+		for _, header := range headers {
+			if strings.Contains(body, ">"+header.Title+"<") {
+				seen = append(seen, header.Title)
+			}
+		}
+		if index := strings.Index(body, "?before="); index != -1 {
+			next = body[index+len("?before=") : index+strings.Index(body[index:], `"`)]
+		}
+		cursor = next
+	}
+	if !slices.Equal(seen, []string{"Post 0", "Post 1", "Post 2", "Post 3", "Post 4"}) {
+		t.Fatalf("Following the cursors should list every post once, got %v", seen)
+	}
+}
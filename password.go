@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+type Argon2Params struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+var defaultArgon2Params Argon2Params = Argon2Params{Memory: 64 * 1024, Time: 3, Threads: 4}
+
+const argon2SaltLength int = 16
+const argon2KeyLength uint32 = 32
+
+// hashPassword hashes the password with argon2id and encodes the result in the PHC string format, e.g. $argon2id$v=19$m=65536,t=3,p=4$salt$hash
+func hashPassword(password string, params Argon2Params) (string, error) {
+	if len(password) > 4096 {
+		return "", errors.New("password too long")
+	}
+	if params.Memory < 8*uint32(params.Threads) || params.Time < 1 || params.Threads < 1 {
+		return "", errors.New("invalid argon2 parameters")
+	}
+
+	salt := make([]byte, argon2SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", errors.New("couldn't read cryptographically secure rand")
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, params.Memory, params.Time, params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func decodePasswordHash(encoded string) (Argon2Params, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return Argon2Params{}, nil, nil, errors.New("password hash is not an argon2id hash")
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return Argon2Params{}, nil, nil, errors.New("unsupported argon2 version")
+	}
+
+	var params Argon2Params
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads)
+	if err != nil || params.Time < 1 || params.Threads < 1 {
+		return Argon2Params{}, nil, nil, errors.New("invalid argon2 parameters in password hash")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(salt) == 0 {
+		return Argon2Params{}, nil, nil, errors.New("invalid salt in password hash")
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return Argon2Params{}, nil, nil, errors.New("invalid key in password hash")
+	}
+
+	return params, salt, key, nil
+}
+
+// verifyPassword checks the password against an encoded argon2id hash in constant time
+func verifyPassword(password string, encoded string) (bool, error) {
+	if len(password) > 4096 {
+		return false, errors.New("password too long")
+	}
+
+	params, salt, key, err := decodePasswordHash(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// readCredentialsFile returns the password hash stored on the first non empty line of the file
+func readCredentialsFile(filename string) (string, error) {
+	filebytes, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(strings.ReplaceAll(string(filebytes), "\r", ""), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return line, nil
+		}
+	}
+	return "", errors.New("no password hash found in " + filename)
+}
+
+// runHashPassword implements the hash-password subcommand, the password is read from stdin so it doesn't end up in the shell history
+func runHashPassword(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("golb hash-password", flag.ContinueOnError)
+	memory := flags.Uint("memory", uint(defaultArgon2Params.Memory), "specifies the argon2 memory cost in KiB")
+	iterations := flags.Uint("time", uint(defaultArgon2Params.Time), "specifies the argon2 time cost (iterations)")
+	threads := flags.Uint("threads", uint(defaultArgon2Params.Threads), "specifies the argon2 parallelism")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *threads > 255 {
+		return errors.New("threads can't be higher than 255")
+	}
+
+	fmt.Fprintln(os.Stderr, "enter password:")
+	reader := bufio.NewReader(stdin)
+	password, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return errors.New("password can't be empty")
+	}
+
+	hashed, err := hashPassword(password, Argon2Params{Memory: uint32(*memory), Time: uint32(*iterations), Threads: uint8(*threads)})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(stdout, hashed)
+	return nil
+}
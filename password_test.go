@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testArgon2Params Argon2Params = Argon2Params{Memory: 64, Time: 1, Threads: 1}
+
+func TestHashPassword(t *testing.T) {
+	hashed, err := hashPassword("test", testArgon2Params)
+	if err != nil || !strings.HasPrefix(hashed, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("Hashing password should produce an argon2id hash, got %v", hashed)
+	}
+
+	other, _ := hashPassword("test", testArgon2Params)
+	if hashed == other {
+		t.Fatal("Hashing the same password twice should use different salts")
+	}
+
+	ok, err := verifyPassword("test", hashed)
+	if err != nil || !ok {
+		t.Fatal("Verifying the correct password should succeed")
+	}
+
+	ok, err = verifyPassword("wrong", hashed)
+	if err != nil || ok {
+		t.Fatal("Verifying a wrong password should fail")
+	}
+
+	_, err = verifyPassword("test", "b0e292b2e7822a4cde578f5b10456dab1420820eb74f62e230e30b03f9fd6db1")
+	if err == nil {
+		t.Fatal("Verifying against a malformed hash should return an error")
+	}
+}
+
+func TestResolvePasswordHash(t *testing.T) {
+	hashed, err := resolvePasswordHash("", "", "")
+	if err != nil || hashed != "" {
+		t.Fatal("No credentials should resolve to an empty hash")
+	}
+
+	_, err = resolvePasswordHash("", "not a hash", "")
+	if err == nil {
+		t.Fatal("Invalid password hash should be rejected")
+	}
+
+	valid, _ := hashPassword("test", testArgon2Params)
+	credentials := filepath.Join(t.TempDir(), "credentials")
+	err = os.WriteFile(credentials, []byte("# admin password\n"+valid+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashed, err = resolvePasswordHash("", "", credentials)
+	if err != nil || hashed != valid {
+		t.Fatal("Password hash should be read from the credentials file")
+	}
+
+	_, err = resolvePasswordHash("", valid, credentials)
+	if err == nil {
+		t.Fatal("Supplying both a hash and a credentials file should fail")
+	}
+}
+
+func TestRunHashPassword(t *testing.T) {
+	var output strings.Builder
+	err := runHashPassword([]string{"-memory", "64", "-time", "1", "-threads", "1"}, strings.NewReader("test\n"), &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := verifyPassword("test", strings.TrimSpace(output.String()))
+	if err != nil || !ok {
+		t.Fatal("hash-password should print a hash of the given password")
+	}
+}
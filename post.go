@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"html/template"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -10,8 +11,13 @@ import (
 	"time"
 
 	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
 )
 
+// the author is stored as a markdown link reference definition, which renders to nothing
+const AUTHOR_PREFIX string = `[author]: # "`
+
 func parsePostHeader(filebytes []byte, postId string) (PostHeader, error) {
 	rstring := strings.ReplaceAll(string(filebytes), "\r", "")
 	splitstrings := strings.Split(rstring, "\n")
@@ -23,7 +29,13 @@ func parsePostHeader(filebytes []byte, postId string) (PostHeader, error) {
 	if index >= 2 {
 		timestamp = strings.TrimPrefix(splitstrings[1], "###### ")
 	}
-	return PostHeader{Title: strings.TrimPrefix(splitstrings[0], "### "), Timestamp: timestamp, URL: strings.TrimSuffix(postId, ".md"), ContentIndex: index + 1}, nil
+	var author string
+	for _, line := range splitstrings[1:index] {
+		if strings.HasPrefix(line, AUTHOR_PREFIX) {
+			author = strings.TrimSuffix(strings.TrimPrefix(line, AUTHOR_PREFIX), `"`)
+		}
+	}
+	return PostHeader{Title: strings.TrimPrefix(splitstrings[0], "### "), Timestamp: timestamp, Author: author, URL: strings.TrimSuffix(postId, ".md"), ContentIndex: index + 1}, nil
 }
 
 func readPostHeader(filename string, postdir string) (PostHeader, error) {
@@ -40,17 +52,17 @@ func readPostHeader(filename string, postdir string) (PostHeader, error) {
 	return postheader, nil
 }
 
-func parsePost(filebytes []byte, postId string) (PostData, error) {
+func parsePost(filebytes []byte, postId string, md goldmark.Markdown) (PostData, error) {
 	header, err := parsePostHeader(filebytes, postId)
 	if err != nil {
 		return PostData{}, err
 	}
 	var markdown strings.Builder
-	err = goldmark.Convert(filebytes, &markdown)
+	err = md.Convert(filebytes, &markdown)
 	if err != nil {
 		return PostData{}, err
 	}
-	return PostData{PostHeader: header, Text: markdown.String()}, nil
+	return PostData{PostHeader: header, Text: template.HTML(markdown.String())}, nil
 }
 
 func parseCreatePost(filebytes []byte, postId string) (CreatePostData, error) {
@@ -62,16 +74,16 @@ func parseCreatePost(filebytes []byte, postId string) (CreatePostData, error) {
 	splitstrings := strings.Split(rstring, "\n")
 	body := strings.Join(splitstrings[header.ContentIndex:], "\n")
 
-	return CreatePostData{Title: header.Title, Text: body}, nil
+	return CreatePostData{Title: header.Title, Text: body, Author: header.Author}, nil
 }
 
-func readPost(filename string, postdir string) (PostData, error) {
+func readPost(filename string, postdir string, md goldmark.Markdown) (PostData, error) {
 	filebytes, err := os.ReadFile(filepath.Join(postdir, filename))
 	if err != nil {
 		return PostData{}, err
 	}
 
-	post, err := parsePost(filebytes, filename)
+	post, err := parsePost(filebytes, filename, md)
 	if err != nil {
 		return PostData{}, err
 	}
@@ -93,7 +105,7 @@ func readCreatePost(filename string, postdir string) (CreatePostData, error) {
 	return post, nil
 }
 
-func buildPost(data CreatePostData) ([]byte, error) {
+func buildPost(data CreatePostData, location *time.Location) ([]byte, error) {
 	empty := CreatePostData{}
 	if data == empty || data.Title == "" {
 		return nil, errors.New("Post can't be empty")
@@ -101,23 +113,25 @@ func buildPost(data CreatePostData) ([]byte, error) {
 
 	var stringbuilder strings.Builder
 	stringbuilder.WriteString("### " + data.Title + "\n")
-	stringbuilder.WriteString("###### " + time.Now().Format(time.RFC1123) + "\n")
+	stringbuilder.WriteString("###### " + time.Now().In(location).Format(time.RFC1123) + "\n")
+	if data.Author != "" {
+		stringbuilder.WriteString(AUTHOR_PREFIX + data.Author + "\"\n")
+	}
 	stringbuilder.WriteString("---\n")
 	stringbuilder.WriteString(data.Text)
 
 	return []byte(stringbuilder.String()), nil
 }
 
-func writePost(data CreatePostData, postdir string) (string, error) {
-	post, err := buildPost(data)
+func writePost(data CreatePostData, postdir string, location *time.Location) (string, error) {
+	post, err := buildPost(data, location)
 	if err != nil {
 		return "", err
 	}
 
 	filename := filepath.Join(postdir, generatePostFilename(data.Title))
-	deletePost(generatePostFilename(data.Title), postdir)
 
-	err = os.WriteFile(filename, post, 0700)
+	err = writeFileAtomic(filename, post, 0700)
 	if err != nil {
 		return "", err
 	}
@@ -125,16 +139,15 @@ func writePost(data CreatePostData, postdir string) (string, error) {
 	return filename, nil
 }
 
-func writePostWithFilename(data CreatePostData, postname string, postdir string) (string, error) {
-	post, err := buildPost(data)
+func writePostWithFilename(data CreatePostData, postname string, postdir string, location *time.Location) (string, error) {
+	post, err := buildPost(data, location)
 	if err != nil {
 		return "", err
 	}
 
 	filename := filepath.Join(postdir, url.PathEscape(postname))
-	deletePost(url.PathEscape(postname), postdir)
 
-	err = os.WriteFile(filename, post, 0700)
+	err = writeFileAtomic(filename, post, 0700)
 	if err != nil {
 		return "", err
 	}
@@ -142,6 +155,23 @@ func writePostWithFilename(data CreatePostData, postname string, postdir string)
 	return filename, nil
 }
 
+// writeFileAtomic writes to a temporary file first and renames it, so an interrupted write never leaves a half written file behind
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmpname := filename + ".tmp"
+	err := os.WriteFile(tmpname, data, perm)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpname, filename)
+	if err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+
+	return nil
+}
+
 func deletePost(postname string, postdir string) error {
 	filename := filepath.Join(postdir, postname)
 
@@ -152,6 +182,43 @@ func deletePost(postname string, postdir string) error {
 	return nil
 }
 
+// comparePostHeaders sorts the newest post first, posts without a valid timestamp go to the front
+func comparePostHeaders(a PostHeader, b PostHeader) int {
+	atime, err := time.Parse(time.RFC1123, a.Timestamp)
+	if err != nil {
+		return -1
+	}
+	btime, err := time.Parse(time.RFC1123, b.Timestamp)
+	if err != nil {
+		return 1
+	}
+
+	return btime.Compare(atime)
+}
+
+// postLinks returns the destinations of all links and images in a post
+func postLinks(filebytes []byte, md goldmark.Markdown) []string {
+	var links []string
+	document := md.Parser().Parse(text.NewReader(filebytes))
+	ast.Walk(document, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch node := node.(type) {
+		case *ast.Link:
+			links = append(links, string(node.Destination))
+		case *ast.Image:
+			links = append(links, string(node.Destination))
+		case *ast.AutoLink:
+			if node.AutoLinkType == ast.AutoLinkURL {
+				links = append(links, string(node.URL(filebytes)))
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+	return links
+}
+
 func generatePostFilename(title string) string {
 	return url.PathEscape(strings.ToLower(title)) + ".md"
 }
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/yuin/goldmark"
 )
 
 func TestParsePostHeader(t *testing.T) {
@@ -29,11 +34,39 @@ Hello, world!`)
 	if err != nil || postheader.Title != "hello" || postheader.Timestamp != "" || postheader.URL != "test" || postheader.ContentIndex != 2 {
 		t.Fatal("Parsing valid post should succeed")
 	}
+
+	filebytes = []byte(`### hello
+###### Wed, 05 Feb 2025 17:54:14 CET
+[author]: # "alice"
+---
+Hello, world!`)
+	postheader, err = parsePostHeader(filebytes, "test")
+
+	if err != nil || postheader.Author != "alice" || postheader.ContentIndex != 4 {
+		t.Fatal("Parsing post with author should succeed")
+	}
+}
+
+func TestBuildPostAuthor(t *testing.T) {
+	post, err := buildPost(CreatePostData{Title: "hello", Text: "Hello, world!", Author: "alice"}, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := parseCreatePost(post, "hello.md")
+	if err != nil || data.Author != "alice" || data.Text != "Hello, world!" {
+		t.Fatal("Author should survive building and parsing a post")
+	}
+
+	postdata, err := parsePost(post, "hello.md", goldmark.New())
+	if err != nil || strings.Contains(string(postdata.Text), "alice") {
+		t.Fatal("Author line should not be rendered")
+	}
 }
 
 func TestParsePost(t *testing.T) {
 	filebytes := []byte{}
-	_, err := parsePost(filebytes, "test")
+	_, err := parsePost(filebytes, "test", goldmark.New())
 	if err == nil {
 		t.Fatal("Parsing empty post should fail")
 	}
@@ -42,7 +75,7 @@ func TestParsePost(t *testing.T) {
 
 Hello, world!`)
 
-	post, err := parsePost(filebytes, "test")
+	post, err := parsePost(filebytes, "test", goldmark.New())
 
 	if err == nil {
 		t.Fatal("Parsing invalid post should fail")
@@ -59,23 +92,63 @@ Hello, world!`)
 <p>Hello, world!</p>
 ` // newline is required here
 
-	post, err = parsePost(filebytes, "test")
+	post, err = parsePost(filebytes, "test", goldmark.New())
 
-	if err != nil || post.Title != "hello" || post.Timestamp != "Wed, 05 Feb 2025 17:54:14 CET" || post.URL != "test" || post.Text != filehtml {
+	if err != nil || post.Title != "hello" || post.Timestamp != "Wed, 05 Feb 2025 17:54:14 CET" || post.URL != "test" || string(post.Text) != filehtml {
 		t.Fatal("Parsing valid post should succeed")
 	}
 }
 
 func TestBuildPost(t *testing.T) {
 	cpostdata := CreatePostData{}
-	_, err := buildPost(cpostdata)
+	_, err := buildPost(cpostdata, time.Local)
 	if err == nil {
 		t.Fatal("Building post from empty post data should fail")
 	}
 
 	cpostdata = CreatePostData{Title: "Test", Text: "Also a test", Publish: false}
-	_, err = buildPost(cpostdata)
+	_, err = buildPost(cpostdata, time.Local)
 	if err != nil {
 		t.Fatal("Building post from valid post data should succeed")
 	}
 }
+
+func TestMarkdownOptions(t *testing.T) {
+	filebytes := []byte("### hello\n---\n| a |\n| - |\n| b |\n\n<b>raw</b>")
+
+	post, err := parsePost(filebytes, "test", newMarkdown(BlogConfiguration{}))
+	if err != nil || strings.Contains(string(post.Text), "<table>") || strings.Contains(string(post.Text), "<b>raw</b>") {
+		t.Fatal("Tables and raw html should be off by default")
+	}
+
+	extensions, err := parseMarkdownExtensions("table, strikethrough")
+	if err != nil {
+		t.Fatal(err)
+	}
+	post, err = parsePost(filebytes, "test", newMarkdown(BlogConfiguration{MarkdownExtensions: extensions, MarkdownUnsafe: true}))
+	if err != nil || !strings.Contains(string(post.Text), "<table>") || !strings.Contains(string(post.Text), "<b>raw</b>") {
+		t.Fatal("Configured markdown options should be applied")
+	}
+}
+
+func TestFailedWriteKeepsPost(t *testing.T) {
+	postDir := t.TempDir()
+	filename, err := writePostWithFilename(CreatePostData{Title: "Kept", Text: "first"}, "kept.md", postDir, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a directory in place of the temporary file makes the next write fail
+	err = os.Mkdir(filename+".tmp", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = writePostWithFilename(CreatePostData{Title: "Kept", Text: "second"}, "kept.md", postDir, time.UTC)
+	if err == nil {
+		t.Fatal("The write should fail")
+	}
+	filebytes, err := os.ReadFile(filename)
+	if err != nil || !strings.Contains(string(filebytes), "first") {
+		t.Fatalf("A failed write should leave the previous post in place, got %q %v", filebytes, err)
+	}
+}
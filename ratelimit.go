@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var rateLimited *counterVec = newCounterVec("golb_rate_limited_total", "Number of requests rejected by a rate limit.", "limiter")
+var loginLockouts *counterVec = newCounterVec("golb_login_lockouts_total", "Number of login attempts rejected because of a lockout.", "scope")
+
+var loginLimiter *rateLimiter = newRateLimiter("login", 10, time.Minute)
+var loginGuard *loginThrottle = newLoginThrottle(5, 60*time.Minute, 0)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket per key, every key may do burst requests per period and regains tokens evenly over the period
+type rateLimiter struct {
+	name    string
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	calls   int
+	mutex   sync.Mutex
+}
+
+func newRateLimiter(name string, burst int, period time.Duration) *rateLimiter {
+	limiter := &rateLimiter{name: name, buckets: map[string]*tokenBucket{}}
+	limiter.SetLimit(burst, period)
+	return limiter
+}
+
+func (limiter *rateLimiter) SetLimit(burst int, period time.Duration) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.burst = float64(burst)
+	limiter.rate = float64(burst) / period.Seconds()
+}
+
+// Allow takes a token for key, when no token is available it returns how long to wait for the next one
+func (limiter *rateLimiter) Allow(key string) (bool, time.Duration) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	if limiter.burst <= 0 {
+		return true, 0
+	}
+
+	now := time.Now()
+	limiter.calls++
+	if limiter.calls%1000 == 0 {
+		limiter.cleanup(now)
+	}
+
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: limiter.burst, last: now}
+		limiter.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(limiter.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*limiter.rate)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - bucket.tokens) / limiter.rate * float64(time.Second))
+	return false, wait
+}
+
+// cleanup forgets buckets that would be full again, they behave the same as new ones
+func (limiter *rateLimiter) cleanup(now time.Time) {
+	for key, bucket := range limiter.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*limiter.rate >= limiter.burst {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+func writeRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+// rateLimitHandler rejects requests with 429 Too Many Requests once the client ip ran out of tokens
+func rateLimitHandler(limiter *rateLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r, blogConfig.Get().TrustedProxies)
+		ok, wait := limiter.Allow(ip)
+		if !ok {
+			rateLimited.Inc(limiter.name)
+			requestLogger(r).Warn("rate limited", "limiter", limiter.name, "remote_addr", ip, "retry_after", wait.String())
+			writeRetryAfter(w, wait)
+			http.Error(w, "Too many requests, try again later.", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type loginFailure struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// loginThrottle tracks failed logins, every failure doubles the time an ip has to wait before it may try again.
+// When too many logins fail across all ips, all logins are locked for a while.
+type loginThrottle struct {
+	freeFailures int
+	maxLockout   time.Duration
+	failures     map[string]*loginFailure
+	global       *rateLimiter
+	globalUntil  time.Time
+	mutex        sync.Mutex
+}
+
+func newLoginThrottle(freeFailures int, maxLockout time.Duration, globalPerMinute int) *loginThrottle {
+	return &loginThrottle{freeFailures: freeFailures, maxLockout: maxLockout, failures: map[string]*loginFailure{}, global: newRateLimiter("login_global", globalPerMinute, time.Minute)}
+}
+
+func (throttle *loginThrottle) SetLimits(freeFailures int, maxLockout time.Duration, globalPerMinute int) {
+	throttle.mutex.Lock()
+	throttle.freeFailures = freeFailures
+	throttle.maxLockout = maxLockout
+	throttle.mutex.Unlock()
+	throttle.global.SetLimit(globalPerMinute, time.Minute)
+}
+
+// Locked returns whether logins from ip are currently rejected and for how long
+func (throttle *loginThrottle) Locked(ip string) (bool, time.Duration, string) {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+
+	now := time.Now()
+	if now.Before(throttle.globalUntil) {
+		return true, throttle.globalUntil.Sub(now), "global"
+	}
+
+	failure, ok := throttle.failures[ip]
+	if ok && now.Before(failure.lockedUntil) {
+		return true, failure.lockedUntil.Sub(now), "ip"
+	}
+	return false, 0, ""
+}
+
+// Failure registers a failed login and returns how long the ip is locked out
+func (throttle *loginThrottle) Failure(ip string) time.Duration {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+
+	now := time.Now()
+	for key, failure := range throttle.failures {
+		if now.Sub(failure.last) > 2*throttle.maxLockout {
+			delete(throttle.failures, key)
+		}
+	}
+
+	ok, wait := throttle.global.Allow("global")
+	if !ok {
+		throttle.globalUntil = now.Add(wait)
+	}
+
+	failure, ok := throttle.failures[ip]
+	if !ok {
+		failure = &loginFailure{}
+		throttle.failures[ip] = failure
+	}
+	failure.count++
+	failure.last = now
+
+	if failure.count <= throttle.freeFailures {
+		return 0
+	}
+
+	lockout := throttle.maxLockout
+	exponent := failure.count - throttle.freeFailures - 1
+	if exponent < 32 {
+		lockout = time.Duration(math.Min(float64(time.Second)*math.Pow(2, float64(exponent)), float64(throttle.maxLockout)))
+	}
+	failure.lockedUntil = now.Add(lockout)
+	return lockout
+}
+
+func (throttle *loginThrottle) Success(ip string) {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+	delete(throttle.failures, ip)
+}
+
+func formatWait(wait time.Duration) string {
+	if wait < time.Minute {
+		return fmt.Sprintf("%v seconds", int(math.Ceil(wait.Seconds())))
+	}
+	return fmt.Sprintf("%v minutes", int(math.Ceil(wait.Minutes())))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter("test", 2, time.Minute)
+	for i := 0; i < 2; i++ {
+		ok, _ := limiter.Allow("a")
+		if !ok {
+			t.Fatal("Requests within the burst should be allowed")
+		}
+	}
+
+	ok, wait := limiter.Allow("a")
+	if ok || wait <= 0 || wait > 30*time.Second {
+		t.Fatalf("Requests over the burst should be rejected with a wait of at most 30s, got %v", wait)
+	}
+
+	ok, _ = limiter.Allow("b")
+	if !ok {
+		t.Fatal("Keys should be limited independently")
+	}
+
+	limiter.SetLimit(0, time.Minute)
+	ok, _ = limiter.Allow("a")
+	if !ok {
+		t.Fatal("A limit of 0 should disable the limiter")
+	}
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	blogConfig.Set(BlogConfiguration{})
+	handler := rateLimitHandler(newRateLimiter("test", 1, time.Minute), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatal("First request should pass")
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") == "" {
+		t.Fatal("Limited request should get 429 with Retry-After")
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	throttle := newLoginThrottle(2, time.Hour, 0)
+
+	if throttle.Failure("a") != 0 || throttle.Failure("a") != 0 {
+		t.Fatal("Free failures should not lock out")
+	}
+	if lockout := throttle.Failure("a"); lockout != time.Second {
+		t.Fatalf("First failure after the free failures should lock out for 1s, got %v", lockout)
+	}
+	if lockout := throttle.Failure("a"); lockout != 2*time.Second {
+		t.Fatalf("Lockout should double with every failure, got %v", lockout)
+	}
+	for i := 0; i < 40; i++ {
+		throttle.Failure("a")
+	}
+	locked, wait, scope := throttle.Locked("a")
+	if !locked || scope != "ip" || wait > time.Hour {
+		t.Fatal("Lockout should be capped at the max lockout")
+	}
+
+	locked, _, _ = throttle.Locked("b")
+	if locked {
+		t.Fatal("Other ips should not be locked out")
+	}
+
+	throttle.Success("a")
+	locked, _, _ = throttle.Locked("a")
+	if locked {
+		t.Fatal("Successful login should reset the lockout")
+	}
+
+	global := newLoginThrottle(100, time.Hour, 1)
+	global.Failure("a")
+	global.Failure("b")
+	locked, _, scope = global.Locked("c")
+	if !locked || scope != "global" {
+		t.Fatal("Too many failures across all ips should lock all logins")
+	}
+}
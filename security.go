@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const DEFAULT_CSP string = "default-src 'self'; script-src 'self' 'nonce-{nonce}'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; object-src 'none'; base-uri 'self'; form-action 'self'"
+const DEFAULT_PERMISSIONS_POLICY string = "camera=(), microphone=(), geolocation=(), payment=(), usb=()"
+const DEFAULT_REFERRER_POLICY string = "strict-origin-when-cross-origin"
+
+type cspNonceKey struct{}
+
+func generateNonce() (string, error) {
+	randbytes := make([]byte, 16)
+	_, err := rand.Read(randbytes)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(randbytes), nil
+}
+
+// cspNonce returns the nonce of the current request, templates can use it through the nonce function
+func cspNonce(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	nonce, _ := r.Context().Value(cspNonceKey{}).(string)
+	return nonce
+}
+
+func parseFrameOptions(option string) (string, error) {
+	switch strings.ToLower(option) {
+	case "deny":
+		return "DENY", nil
+	case "sameorigin":
+		return "SAMEORIGIN", nil
+	case "allow", "off":
+		return "", nil
+	}
+	return "", errors.New("invalid frame option " + option + ", use deny, sameorigin or allow")
+}
+
+func buildContentSecurityPolicy(policy string, frameOptions string, nonce string) string {
+	if policy == "" {
+		return ""
+	}
+
+	policy = strings.ReplaceAll(policy, "{nonce}", nonce)
+	if !strings.Contains(policy, "frame-ancestors") {
+		switch frameOptions {
+		case "DENY":
+			policy += "; frame-ancestors 'none'"
+		case "SAMEORIGIN":
+			policy += "; frame-ancestors 'self'"
+		}
+	}
+	return policy
+}
+
+func isHTTPS(r *http.Request, config BlogConfiguration) bool {
+	if r.TLS != nil {
+		return true
+	}
+	addr, ok := remoteAddr(r)
+	return ok && isTrustedProxy(addr, config.TrustedProxies) && forwardedValue(r, "X-Forwarded-Proto") == "https"
+}
+
+// securityHeadersHandler sets the configured security headers on every response and generates the nonce for the Content-Security-Policy
+func securityHeadersHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := requestSite(r).Config()
+		header := w.Header()
+
+		nonce, err := generateNonce()
+		if err != nil {
+			requestLogger(r).Error("couldn't generate csp nonce", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), cspNonceKey{}, nonce))
+
+		policy := buildContentSecurityPolicy(config.ContentSecurityPolicy, config.FrameOptions, nonce)
+		if policy != "" {
+			header.Set("Content-Security-Policy", policy)
+		}
+		if config.FrameOptions != "" {
+			header.Set("X-Frame-Options", config.FrameOptions)
+		}
+		if config.ReferrerPolicy != "" {
+			header.Set("Referrer-Policy", config.ReferrerPolicy)
+		}
+		if config.PermissionsPolicy != "" {
+			header.Set("Permissions-Policy", config.PermissionsPolicy)
+		}
+		if config.HSTSMaxAge > 0 && isHTTPS(r, config) {
+			header.Set("Strict-Transport-Security", "max-age="+strconv.Itoa(config.HSTSMaxAge)+"; includeSubDomains")
+		}
+		header.Set("X-Content-Type-Options", "nosniff")
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	blogConfig.Set(BlogConfiguration{ContentSecurityPolicy: DEFAULT_CSP, ReferrerPolicy: DEFAULT_REFERRER_POLICY, PermissionsPolicy: DEFAULT_PERMISSIONS_POLICY, FrameOptions: "DENY", HSTSMaxAge: 60})
+	handler := securityHeadersHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	header := recorder.Header()
+
+	if header.Get("X-Content-Type-Options") != "nosniff" || header.Get("X-Frame-Options") != "DENY" || header.Get("Referrer-Policy") != DEFAULT_REFERRER_POLICY || header.Get("Permissions-Policy") != DEFAULT_PERMISSIONS_POLICY {
+		t.Fatal("Default security headers are missing")
+	}
+	if !strings.Contains(header.Get("Content-Security-Policy"), "frame-ancestors 'none'") || strings.Contains(header.Get("Content-Security-Policy"), "{nonce}") {
+		t.Fatalf("Content-Security-Policy is not built correctly: %v", header.Get("Content-Security-Policy"))
+	}
+	if header.Get("Strict-Transport-Security") != "" {
+		t.Fatal("HSTS should only be sent over TLS")
+	}
+
+	blogConfig.Set(BlogConfiguration{FrameOptions: ""})
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "https://localhost/", nil))
+	if recorder.Header().Get("Content-Security-Policy") != "" || recorder.Header().Get("X-Frame-Options") != "" {
+		t.Fatal("Disabled headers should not be sent")
+	}
+}
+
+func TestTemplateNonce(t *testing.T) {
+	dir := t.TempDir()
+	blogConfig.Set(BlogConfiguration{TemplateDir: dir, ContentSecurityPolicy: DEFAULT_CSP})
+	err := os.WriteFile(filepath.Join(dir, "_base.html"), []byte(`{{.Page}}`), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "page.html"), []byte(`<script nonce="{{nonce}}"></script>`), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reloadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := securityHeadersHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		renderPage(w, r, "page.html", nil)
+	}))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+
+	body := recorder.Body.String()
+	// html/template escapes the + of base64 in attributes, browsers unescape it again
+	nonce := html.UnescapeString(strings.TrimSuffix(strings.TrimPrefix(body, `<script nonce="`), `"></script>`))
+	if nonce == "" || nonce == body || !strings.Contains(recorder.Header().Get("Content-Security-Policy"), "'nonce-"+nonce+"'") {
+		t.Fatalf("Template nonce %v doesn't match the Content-Security-Policy %v", body, recorder.Header().Get("Content-Security-Policy"))
+	}
+}
+
+func TestTemplateNonceConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	blogConfig.Set(BlogConfiguration{TemplateDir: dir, ContentSecurityPolicy: DEFAULT_CSP})
+	os.WriteFile(filepath.Join(dir, "_base.html"), []byte(`{{.Page}}`), 0700)
+	os.WriteFile(filepath.Join(dir, "page.html"), []byte(`{{nonce}}`), 0700)
+	err := reloadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := securityHeadersHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		renderPage(w, r, "page.html", nil)
+	}))
+	var wg sync.WaitGroup
+	failures := make(chan string, 100)
+	for range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+			nonce := html.UnescapeString(recorder.Body.String())
+			if !strings.Contains(recorder.Header().Get("Content-Security-Policy"), "'nonce-"+nonce+"'") {
+				failures <- nonce
+			}
+		}()
+	}
+	wg.Wait()
+	close(failures)
+	for nonce := range failures {
+		t.Fatalf("Concurrent requests should each render their own nonce, got %v", nonce)
+	}
+	if _, ok := templatePools.Load(defaultSite.Templates()); !ok {
+		t.Fatal("Rendered pages should reuse pooled template sets")
+	}
+}
+
+func TestReplacedTemplatesArentPooled(t *testing.T) {
+	dir := t.TempDir()
+	config := BlogConfiguration{TemplateDir: dir}
+	blogConfig.Set(config)
+	os.WriteFile(filepath.Join(dir, "_base.html"), []byte(`{{.Page}}`), 0700)
+	err := reloadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaced := defaultSite.Templates()
+	preview, err := previewTemplates(replaced, config, Theme{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reloadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// requests that started before the reload still render with the replaced set
+	tmpls, err := acquireTemplates(replaced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseTemplates(replaced, tmpls)
+	_, err = previewTemplates(replaced, config, Theme{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := templatePools.Load(replaced); ok {
+		t.Fatal("Replaced template sets shouldn't get a pool again")
+	}
+	if _, ok := templatePools.Load(preview); ok {
+		t.Fatal("Previews of replaced template sets should be forgotten")
+	}
+	previewTemplateSets.Range(func(key any, _ any) bool {
+		if key.(previewKey).base == replaced {
+			t.Fatal("Previews of replaced template sets shouldn't be cached again")
+		}
+		return true
+	})
+	if _, ok := templatePools.Load(defaultSite.Templates()); !ok {
+		t.Fatal("The current template set should be pooled")
+	}
+}
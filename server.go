@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// serve runs the http server until SIGINT or SIGTERM is received, then gives in-flight requests the configured time to finish.
+// SIGHUP reloads templates and configuration.
+func serve(hostname string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	config := blogConfig.Get()
+	server := newServer(hostname, serverHandler(http.DefaultServeMux))
+	if config.TLSCert != "" || config.TLSSelfSigned {
+		err := setupTLS(ctx, server, config)
+		if err != nil {
+			return err
+		}
+	}
+	servers := []*http.Server{server}
+	if config.MetricsPort != 0 {
+		metricsMux := http.NewServeMux()
+		metricsMux.HandleFunc("/metrics", metricsHandler)
+		servers = append(servers, newServer(fmt.Sprintf(":%v", config.MetricsPort), metricsMux))
+	}
+	if config.RedirectPort != 0 {
+		servers = append(servers, newServer(fmt.Sprintf(":%v", config.RedirectPort), httpsRedirectHandler(config.Port)))
+	}
+
+	go refreshPostsPeriodically(ctx, 30)
+	go expireSessions(ctx, 60)
+	go handleReloads(ctx)
+
+	serverErr := make(chan error, len(servers))
+	for _, server := range servers {
+		go func() {
+			if server.TLSConfig != nil {
+				slog.Info("server running", "addr", server.Addr, "tls", true)
+				serverErr <- server.ListenAndServeTLS("", "")
+				return
+			}
+			slog.Info("server running", "addr", server.Addr)
+			serverErr <- server.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err := <-serverErr:
+		shutdownServers(servers, 0)
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+
+	drain := time.Duration(blogConfig.Get().ShutdownTimeout) * time.Second
+	slog.Info("shutting down, waiting for in-flight requests", "timeout", drain.String())
+	err := shutdownServers(servers, drain)
+	if err != nil {
+		return err
+	}
+
+	for range servers {
+		err = <-serverErr
+		if !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
+	slog.Info("server stopped")
+	return nil
+}
+
+// serverHandler wraps the routes with logging, security headers and metrics, the metrics sit right around the mux
+// because it records the matched route pattern on the request it is given, not on the copies outer handlers create
+func serverHandler(mux http.Handler) http.Handler {
+	return accessLogHandler(securityHeadersHandler(instrumentHandler(mux)))
+}
+
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      60 * time.Second,
+		IdleTimeout:       120 * time.Second,
+	}
+}
+
+func shutdownServers(servers []*http.Server, drain time.Duration) error {
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+
+	var errs []error
+	for _, server := range servers {
+		errs = append(errs, server.Shutdown(shutdownCtx))
+	}
+	return errors.Join(errs...)
+}
+
+func handleReloads(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	cancelWatch := startWatching(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			cancelWatch()
+			return
+		case <-hup:
+		}
+
+		slog.Info("received SIGHUP, reloading templates and configuration")
+		err := reloadConfiguration()
+		if err != nil {
+			slog.Error("reload failed", "error", err)
+			recordAudit(nil, AuditEvent{Action: AUDIT_CONFIG_RELOAD, Actor: "SIGHUP", Detail: "failed: " + err.Error()})
+		} else {
+			recordAudit(nil, AuditEvent{Action: AUDIT_CONFIG_RELOAD, Actor: "SIGHUP", Detail: "succeeded"})
+		}
+
+		// directories might have changed, so the watcher is restarted with the new configuration
+		cancelWatch()
+		cancelWatch = startWatching(ctx)
+	}
+}
+
+func startWatching(ctx context.Context) context.CancelFunc {
+	watchCtx, cancel := context.WithCancel(ctx)
+	if blogConfig.Get().Watch {
+		var dirs []string
+		for _, site := range allSites() {
+			config := site.Config()
+			for _, dir := range []string{config.PostDir, config.TemplateDir, config.FileDir} {
+				if !slices.Contains(dirs, dir) {
+					dirs = append(dirs, dir)
+				}
+			}
+		}
+		go watchDirectories(watchCtx, dirs, 250*time.Millisecond, 2*time.Second, applyDirectoryChange)
+	}
+	return cancel
+}
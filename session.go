@@ -1,63 +1,300 @@
 package main
 
 import (
-	"crypto"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"time"
 )
 
-func calcHash(text string, seed []byte) (string, error) {
-	if len(text) > 4096 {
-		return "", errors.New("input text too long")
+const SESSION_COOKIE string = "microblog_h"
+
+var sessionStore SessionStore = newMemorySessionStore()
+
+// generateToken returns 256 bits of randomness, hex encoded
+func generateToken() (string, error) {
+	randbytes := make([]byte, 32)
+	_, err := rand.Read(randbytes)
+	if err != nil {
+		return "", errors.New("couldn't read cryptographically secure rand")
+	}
+	return hex.EncodeToString(randbytes), nil
+}
+
+func generateSessionID() (string, error) {
+	return generateToken()
+}
+
+func sessionKey(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+func sessionExpired(session Session, bc BlogConfiguration, now time.Time) bool {
+	timeout := time.Duration(bc.SessionTimeout) * time.Minute
+	if session.RememberMe {
+		timeout = time.Duration(bc.RememberMeDays) * 24 * time.Hour
 	}
+	return session.LastSeen.Add(timeout).Before(now)
+}
 
-	h := crypto.SHA256.New()
-	h.Write(seed)
-	h.Write([]byte(text + TITLE))
-	return hex.EncodeToString(h.Sum(nil)), nil
+func createSession(w http.ResponseWriter, r *http.Request, bc BlogConfiguration, username string, rememberMe bool) (Session, error) {
+	id, err := generateSessionID()
+	if err != nil {
+		return Session{}, err
+	}
+
+	csrf, err := generateToken()
+	if err != nil {
+		return Session{}, err
+	}
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > 256 {
+		userAgent = userAgent[:256]
+	}
+
+	now := time.Now()
+	session := Session{Key: sessionKey(id), Username: username, Created: now, LastSeen: now, RememberMe: rememberMe, IP: clientIP(r, bc.TrustedProxies), UserAgent: userAgent, CSRFToken: csrf}
+	err = siteOf(bc).Sessions().Save(session)
+	if err != nil {
+		return Session{}, err
+	}
+
+	cookie := &http.Cookie{Name: SESSION_COOKIE, Value: id, Path: bc.BasePath + "/", Secure: true, HttpOnly: true, SameSite: http.SameSiteLaxMode}
+	if rememberMe {
+		cookie.MaxAge = bc.RememberMeDays * 24 * 3600
+	}
+	http.SetCookie(w, cookie)
+	return session, nil
 }
 
 func checkSession(r *http.Request, bc BlogConfiguration) (bool, error) {
+	_, _, err := currentUser(r, bc)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// currentSession returns the valid session belonging to the request and extends it
+func currentSession(r *http.Request, bc BlogConfiguration) (Session, error) {
 	if bc.isPasswordless() {
-		return false, errors.New("session can't be valid in view only mode")
+		return Session{}, errors.New("session can't be valid in view only mode")
 	}
 
-	hcookie, err := r.Cookie("microblog_h")
+	hcookie, err := r.Cookie(SESSION_COOKIE)
 	if err != nil {
-		return false, errors.New("couldn't find session cookie")
+		return Session{}, errors.New("couldn't find session cookie")
 	}
 
-	cookieid := hcookie.Value
+	store := siteOf(bc).Sessions()
+	key := sessionKey(hcookie.Value)
+	session, ok, err := store.Get(key)
+	if err != nil {
+		return Session{}, err
+	}
+	if !ok {
+		return Session{}, errors.New("invalid session")
+	}
 
-	sessionsMutex.Lock()
-	_, ok := sessions[cookieid]
-	sessionsMutex.Unlock()
+	now := time.Now()
+	if sessionExpired(session, bc, now) {
+		store.Delete(key)
+		return Session{}, errors.New("session expired")
+	}
 
-	if !ok {
-		return false, errors.New("invalid session")
+	// sliding expiry, last activity is only written once a minute to keep the store quiet
+	if now.Sub(session.LastSeen) > time.Minute || session.CSRFToken == "" {
+		session.LastSeen = now
+		if session.CSRFToken == "" {
+			session.CSRFToken, err = generateToken()
+			if err != nil {
+				return Session{}, err
+			}
+		}
+		err = store.Save(session)
+		if err != nil {
+			slog.Warn("couldn't update session activity", "error", err)
+		}
 	}
 
-	return true, nil
+	return session, nil
 }
 
-func expireSessions(sleepseconds int) {
-	for {
-		time.Sleep(time.Duration(sleepseconds) * time.Second)
+func clearSessionCookie(w http.ResponseWriter, config BlogConfiguration) {
+	http.SetCookie(w, &http.Cookie{Name: SESSION_COOKIE, Value: "", Path: config.BasePath + "/", Secure: true, HttpOnly: true, SameSite: http.SameSiteLaxMode, MaxAge: -1})
+}
 
-		var sessionsToDelete []string
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	config := requestSite(r).Config()
+	if r.Method != "POST" {
+		renderError(w, r, methodNotAllowed("POST"))
+		return
+	}
 
-		for sess, t := range sessions {
-			if t.Add(time.Duration(3600)*time.Second).Compare(time.Now()) < 0 {
-				sessionsToDelete = append(sessionsToDelete, sess)
+	err := r.ParseForm()
+	if err == nil {
+		err = checkCSRF(r, config)
+	}
+	if err != nil {
+		renderCSRFError(w, r, err)
+		return
+	}
+
+	session, err := currentSession(r, config)
+	if err == nil {
+		err = siteOf(config).Sessions().Delete(session.Key)
+		if err != nil {
+			requestLogger(r).Error("couldn't delete session on logout", "error", err)
+		}
+		requestLogger(r).Info("logout succeeded", "remote_addr", clientIP(r, config.TrustedProxies))
+		recordAudit(r, AuditEvent{Action: AUDIT_LOGOUT, Actor: sessionUsername(session)})
+	}
+
+	clearSessionCookie(w, config)
+	redirect(w, r, "/", 303)
+}
+
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	config := requestSite(r).Config()
+	logger := requestLogger(r)
+	user, current, err := currentUser(r, config)
+	if err != nil {
+		redirect(w, r, "/login", 307)
+		return
+	}
+
+	data := SessionListData{CurrentKey: current.Key}
+	if r.Method == "POST" {
+		err := r.ParseForm()
+		if err == nil {
+			err = checkCSRF(r, config)
+		}
+		if err != nil {
+			renderCSRFError(w, r, err)
+			return
+		}
+
+		if r.PostFormValue("others") != "" {
+			revoked, err := revokeOtherSessions(current, config)
+			if err != nil {
+				logger.Error("couldn't revoke sessions", "error", err)
+				data.Message = "Revoking sessions failed!"
+			} else {
+				logger.Info("revoked other sessions", "count", revoked)
+				recordAudit(r, AuditEvent{Action: AUDIT_SESSION_REVOKE, Actor: user.Username, Detail: fmt.Sprintf("revoked %v other session(s)", revoked)})
+				data.Message = fmt.Sprintf("Revoked %v other session(s)", revoked)
+			}
+		} else if key := r.PostFormValue("session"); key != "" {
+			session, ok, err := siteOf(config).Sessions().Get(key)
+			if err == nil && ok && !user.IsAdmin() && sessionUsername(session) != user.Username {
+				ok = false
+			}
+			if err == nil && ok {
+				err = siteOf(config).Sessions().Delete(key)
+			}
+			if err != nil {
+				logger.Error("couldn't revoke session", "error", err)
+				data.Message = "Revoking session failed!"
+			} else if !ok {
+				data.Message = "Session not found!"
+			} else {
+				logger.Info("revoked session", "username", sessionUsername(session))
+				recordAudit(r, AuditEvent{Action: AUDIT_SESSION_REVOKE, Actor: user.Username, Detail: "revoked a session of " + sessionUsername(session)})
+				data.Message = "Session revoked"
+			}
+			if key == current.Key {
+				clearSessionCookie(w, config)
+				redirect(w, r, "/", 303)
+				return
 			}
 		}
+	} else if r.Method != "GET" {
+		renderError(w, r, methodNotAllowed("GET", "POST"))
+		return
+	}
 
-		sessionsMutex.Lock()
-		for _, sess := range sessionsToDelete {
-			delete(sessions, sess)
+	sessions, err := siteOf(config).Sessions().List()
+	if err != nil {
+		renderError(w, r, internalError(fmt.Errorf("couldn't list sessions: %w", err)))
+		return
+	}
+	for _, session := range sessions {
+		if user.IsAdmin() || sessionUsername(session) == user.Username {
+			data.Sessions = append(data.Sessions, session)
+		}
+	}
+
+	renderPage(w, r, "sessions.html", data)
+}
+
+// sessionUsername returns the user a session belongs to, sessions from before user accounts belong to the legacy admin
+func sessionUsername(session Session) string {
+	if session.Username == "" {
+		return LEGACY_ADMIN
+	}
+	return session.Username
+}
+
+// revokeOtherSessions logs the user of the current session out everywhere else
+func revokeOtherSessions(current Session, bc BlogConfiguration) (int, error) {
+	store := siteOf(bc).Sessions()
+	sessions, err := store.List()
+	if err != nil {
+		return 0, err
+	}
+
+	revoked := 0
+	for _, session := range sessions {
+		if session.Key == current.Key || sessionUsername(session) != sessionUsername(current) {
+			continue
+		}
+		err = store.Delete(session.Key)
+		if err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+func expireSessions(ctx context.Context, sleepseconds int) {
+	ticker := time.NewTicker(time.Duration(sleepseconds) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, site := range allSites() {
+			expireSiteSessions(site, time.Now())
+		}
+	}
+}
+
+func expireSiteSessions(site *Site, now time.Time) {
+	sessions, err := site.Sessions().List()
+	if err != nil {
+		slog.Error("couldn't list sessions", "site", site.Name, "error", err)
+		return
+	}
+
+	config := site.Config()
+	for _, session := range sessions {
+		if sessionExpired(session, config, now) {
+			err = site.Sessions().Delete(session.Key)
+			if err != nil {
+				slog.Error("couldn't delete expired session", "site", site.Name, "error", err)
+			}
 		}
-		sessionsMutex.Unlock()
 	}
 }
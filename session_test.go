@@ -1,54 +1,84 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
 
-func TestCalcHash(t *testing.T) {
-	input := "test"
-	salt := []byte{144, 134, 195, 91}
-	hash, _ := calcHash(input, salt)
-	if hash != "b0e292b2e7822a4cde578f5b10456dab1420820eb74f62e230e30b03f9fd6db1" {
-		t.Fatalf("Hash calculation does not match expected hash %v != %v", hash, "b0e292b2e7822a4cde578f5b10456dab1420820eb74f62e230e30b03f9fd6db1")
+func TestGenerateSessionID(t *testing.T) {
+	id, err := generateSessionID()
+	if err != nil || len(id) != 64 {
+		t.Fatalf("Session id should contain 256 bits of randomness, got %v", id)
+	}
+
+	other, _ := generateSessionID()
+	if id == other {
+		t.Fatal("Session ids should be unique")
 	}
-}
 
-func TestCalcHashEmpty(t *testing.T) {
-	input := ""
-	salt := []byte{144, 134, 195, 91}
-	hash, _ := calcHash(input, salt)
-	if hash == "" {
-		t.Fatal("Hash calculation does not work correctly when supplying empty input")
+	if sessionKey(id) == id {
+		t.Fatal("Session key should not be the session id itself")
 	}
 }
 
 func TestSessionExpiry(t *testing.T) {
+	store := newMemorySessionStore()
+	sessionStore = store
+	blogConfig.Set(BlogConfiguration{SessionTimeout: 60, RememberMeDays: 30})
 	expiredTime := time.Now().Add(-time.Duration(61) * time.Minute)
-	sessions = map[string]time.Time{"b0e292b2e7822a4cde578f5b10456dab1420820eb74f62e230e30b03f9fd6db1": expiredTime}
-	go expireSessions(1)
+	store.Save(Session{Key: "expired", Created: expiredTime, LastSeen: expiredTime})
+	store.Save(Session{Key: "remembered", Created: expiredTime, LastSeen: expiredTime, RememberMe: true})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go expireSessions(ctx, 1)
 	time.Sleep(time.Duration(2) * time.Second)
-	if len(sessions) > 0 {
+	sessions, _ := store.List()
+	if len(sessions) != 1 || sessions[0].Key != "remembered" {
 		t.Fatal("Sessions are not being cleared correctly on expiry")
 	}
 }
 
 func TestSessionCheck(t *testing.T) {
-	sessions = map[string]time.Time{"b0e292b2e7822a4cde578f5b10456dab1420820eb74f62e230e30b03f9fd6db1": time.Now()}
+	store := newMemorySessionStore()
+	sessionStore = store
+	store.Save(Session{Key: sessionKey("b0e292b2e7822a4cde578f5b10456dab1420820eb74f62e230e30b03f9fd6db1"), Created: time.Now(), LastSeen: time.Now()})
 	r := &http.Request{
 		Header: map[string][]string{
 			"Cookie": {"microblog_h=b0e292b2e7822a4cde578f5b10456dab1420820eb74f62e230e30b03f9fd6db1"},
 		},
 	}
 
-	blogConfig := BlogConfiguration{Hash: "filler", ViewOnly: false}
+	blogConfig := BlogConfiguration{Hash: "filler", ViewOnly: false, SessionTimeout: 60, RememberMeDays: 30}
 
 	ok, err := checkSession(r, blogConfig)
 	if err != nil || ok == false {
 		t.Fatal("Valid session throws an error")
 	}
 
+	idleTime := time.Now().Add(-time.Duration(59) * time.Minute)
+	store.Save(Session{Key: sessionKey("b0e292b2e7822a4cde578f5b10456dab1420820eb74f62e230e30b03f9fd6db1"), Created: idleTime, LastSeen: idleTime})
+	ok, err = checkSession(r, blogConfig)
+	session, _, _ := store.Get(sessionKey("b0e292b2e7822a4cde578f5b10456dab1420820eb74f62e230e30b03f9fd6db1"))
+	if err != nil || ok == false || !session.LastSeen.After(idleTime) {
+		t.Fatal("Session activity doesn't extend the session")
+	}
+
+	r = &http.Request{
+		Header: map[string][]string{
+			"Cookie": {"microblog_h=" + sessionKey("b0e292b2e7822a4cde578f5b10456dab1420820eb74f62e230e30b03f9fd6db1")},
+		},
+	}
+
+	ok, err = checkSession(r, blogConfig)
+	if err == nil || ok == true {
+		t.Fatal("Session key should not be accepted as session id")
+	}
+
 	r = &http.Request{
 		Header: map[string][]string{
 			"Cookie": {"microblog_h="},
@@ -82,7 +112,7 @@ func TestSessionCheck(t *testing.T) {
 		t.Fatal("Invalid hash doesn't throw an error")
 	}
 
-	blogConfig = BlogConfiguration{Hash: "filler", ViewOnly: true}
+	blogConfig = BlogConfiguration{Hash: "filler", ViewOnly: true, SessionTimeout: 60, RememberMeDays: 30}
 
 	r = &http.Request{
 		Header: map[string][]string{
@@ -137,3 +167,63 @@ func TestSessionCheck(t *testing.T) {
 		t.Fatal("Session check doesn't fail when hash is empty but view only mode is set to false")
 	}
 }
+
+func TestFileSessionStore(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "sessions.json")
+	store, err := newFileSessionStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Save(Session{Key: "first", Created: time.Now(), LastSeen: time.Now(), RememberMe: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Save(Session{Key: "second", Created: time.Now(), LastSeen: time.Now()})
+	store.Delete("second")
+
+	reopened, err := newFileSessionStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, _ := reopened.List()
+	if len(sessions) != 1 || sessions[0].Key != "first" || !sessions[0].RememberMe {
+		t.Fatal("Sessions are not persisted across restarts")
+	}
+}
+
+func TestLogoutAndRevoke(t *testing.T) {
+	store := newMemorySessionStore()
+	sessionStore = store
+	config := BlogConfiguration{Hash: "filler", SessionTimeout: 60, RememberMeDays: 30}
+	blogConfig.Set(config)
+
+	recorder := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/login", nil)
+	current, err := createSession(recorder, r, config, LEGACY_ADMIN, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := recorder.Result().Cookies()[0]
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Fatal("Session cookie should be HttpOnly and SameSite")
+	}
+	createSession(httptest.NewRecorder(), r, config, LEGACY_ADMIN, false)
+	createSession(httptest.NewRecorder(), r, config, LEGACY_ADMIN, true)
+
+	revoked, err := revokeOtherSessions(current, config)
+	sessions, _ := store.List()
+	if err != nil || revoked != 2 || len(sessions) != 1 || sessions[0].Key != current.Key {
+		t.Fatal("Revoking other sessions should keep only the current session")
+	}
+
+	recorder = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/logout", strings.NewReader("csrf_token="+current.CSRFToken))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(cookie)
+	logoutHandler(recorder, r)
+	sessions, _ = store.List()
+	if len(sessions) != 0 || recorder.Result().Cookies()[0].MaxAge >= 0 {
+		t.Fatal("Logout should delete the session and clear the cookie")
+	}
+}
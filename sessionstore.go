@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+type Session struct {
+	Key        string
+	Username   string
+	Created    time.Time
+	LastSeen   time.Time
+	RememberMe bool
+	IP         string
+	UserAgent  string
+	CSRFToken  string
+	SSO        *SSOIdentity `json:",omitempty"`
+}
+
+// SessionStore stores sessions by key, the key is a hash of the session id so a leaked store can't be used to hijack sessions
+type SessionStore interface {
+	Get(key string) (Session, bool, error)
+	Save(session Session) error
+	Delete(key string) error
+	List() ([]Session, error)
+}
+
+type memorySessionStore struct {
+	sessions map[string]Session
+	mutex    sync.Mutex
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: map[string]Session{}}
+}
+
+func (store *memorySessionStore) Get(key string) (Session, bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	session, ok := store.sessions[key]
+	return session, ok, nil
+}
+
+func (store *memorySessionStore) Save(session Session) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.sessions[session.Key] = session
+	return nil
+}
+
+func (store *memorySessionStore) Delete(key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.sessions, key)
+	return nil
+}
+
+func (store *memorySessionStore) List() ([]Session, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	var sessions []Session = []Session{}
+	for _, session := range store.sessions {
+		sessions = append(sessions, session)
+	}
+	slices.SortFunc(sessions, func(a Session, b Session) int {
+		return a.Created.Compare(b.Created)
+	})
+	return sessions, nil
+}
+
+// fileSessionStore keeps sessions in memory and writes them to a json file on every change, so sessions survive restarts
+type fileSessionStore struct {
+	memorySessionStore
+	filename  string
+	fileMutex sync.Mutex
+}
+
+func newFileSessionStore(filename string) (*fileSessionStore, error) {
+	store := &fileSessionStore{memorySessionStore: memorySessionStore{sessions: map[string]Session{}}, filename: filename}
+
+	filebytes, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var sessions []Session
+	err = json.Unmarshal(filebytes, &sessions)
+	if err != nil {
+		return nil, errors.New("couldn't parse session file " + filename + ": " + err.Error())
+	}
+	for _, session := range sessions {
+		store.sessions[session.Key] = session
+	}
+
+	return store, nil
+}
+
+func (store *fileSessionStore) persist() error {
+	store.fileMutex.Lock()
+	defer store.fileMutex.Unlock()
+
+	sessions, _ := store.memorySessionStore.List()
+	filebytes, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(store.filename, filebytes, 0600)
+}
+
+func (store *fileSessionStore) Save(session Session) error {
+	store.memorySessionStore.Save(session)
+	return store.persist()
+}
+
+func (store *fileSessionStore) Delete(key string) error {
+	store.memorySessionStore.Delete(key)
+	return store.persist()
+}
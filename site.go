@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/yuin/goldmark"
+)
+
+const DEFAULT_SITE string = "default"
+
+// Site is one blog served by the process with its own configuration, templates, caches and stores.
+// The default site uses the package level caches and stores and serves every host no other site claims.
+type Site struct {
+	Name            string
+	Hosts           []string
+	config          *SyncCache[BlogConfiguration]
+	templates       *SyncCache[*template.Template]
+	postHeaders     *SyncCache[map[string]PostHeader]
+	sortedPostIndex *SyncCache[[]PostHeader]
+	markdown        *SyncCache[goldmark.Markdown]
+	sessions        *SessionStore
+	users           *UserStore
+	audit           *AuditLog
+}
+
+var defaultSite *Site = &Site{Name: DEFAULT_SITE, config: &blogConfig, templates: &templates, postHeaders: &postHeadersCache, sortedPostIndex: &sortedPostIndexCache,
+	markdown: &markdownRenderer, sessions: &sessionStore, users: &userStore, audit: &auditLog}
+
+// sites are the additional sites from the config file, selected by their hosts
+var sites SyncCache[[]*Site] = SyncCache[[]*Site]{}
+
+func newSite(name string, hosts []string) *Site {
+	var sessions SessionStore = newMemorySessionStore()
+	var users UserStore = newMemoryUserStore()
+	var audit AuditLog = newMemoryAuditLog(1000)
+	return &Site{Name: name, Hosts: hosts, config: &SyncCache[BlogConfiguration]{}, templates: &SyncCache[*template.Template]{},
+		postHeaders: &SyncCache[map[string]PostHeader]{}, sortedPostIndex: &SyncCache[[]PostHeader]{},
+		markdown: &SyncCache[goldmark.Markdown]{value: goldmark.New()}, sessions: &sessions, users: &users, audit: &audit}
+}
+
+func (site *Site) Config() BlogConfiguration {
+	return site.config.Get()
+}
+
+func (site *Site) SetConfig(config BlogConfiguration) {
+	if site != defaultSite {
+		config.site = site
+	}
+	site.config.Set(config)
+	site.markdown.Set(newMarkdown(config))
+}
+
+func (site *Site) Templates() *template.Template {
+	return site.templates.Get()
+}
+
+func (site *Site) Sessions() SessionStore {
+	return *site.sessions
+}
+
+func (site *Site) Users() UserStore {
+	return *site.users
+}
+
+func (site *Site) Audit() AuditLog {
+	return *site.audit
+}
+
+func (site *Site) Markdown() goldmark.Markdown {
+	return site.markdown.Get()
+}
+
+// openStores replaces the in memory stores with the files of the configuration
+func (site *Site) openStores(config BlogConfiguration) error {
+	if config.SessionFile != "" {
+		store, err := newFileSessionStore(config.SessionFile)
+		if err != nil {
+			return errors.New("couldn't load sessions: " + err.Error())
+		}
+		*site.sessions = store
+	}
+
+	if config.AuditFile != "" {
+		log, err := newFileAuditLog(config.AuditFile)
+		if err != nil {
+			return errors.New("couldn't open audit log: " + err.Error())
+		}
+		*site.audit = log
+	}
+
+	if config.UsersFile != "" {
+		store, err := newFileUserStore(config.UsersFile)
+		if err != nil {
+			return errors.New("couldn't load users: " + err.Error())
+		}
+		*site.users = store
+	}
+	return nil
+}
+
+// setupSites creates the sites of the configuration and loads their stores, templates and posts
+func setupSites(config BlogConfiguration) error {
+	var created []*Site
+	for _, siteConfig := range config.Sites {
+		site := newSite(siteConfig.Name, siteConfig.Hosts)
+		err := site.openStores(siteConfig.Config)
+		if err != nil {
+			return errors.New("site " + site.Name + ": " + err.Error())
+		}
+		site.SetConfig(siteConfig.Config)
+		err = site.reloadTemplates()
+		if err != nil {
+			return errors.New("site " + site.Name + ": couldn't load templates: " + err.Error())
+		}
+		created = append(created, site)
+		slog.Info("serving site", "site", site.Name, "hosts", site.Hosts, "postdir", siteConfig.Config.PostDir)
+	}
+	sites.Set(created)
+	return nil
+}
+
+func allSites() []*Site {
+	return append([]*Site{defaultSite}, sites.Get()...)
+}
+
+// requestSite selects the site by the Host header, unknown hosts get the default site
+func requestSite(r *http.Request) *Site {
+	host := r.Host
+	hostname, _, err := net.SplitHostPort(host)
+	if err == nil {
+		host = hostname
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	for _, site := range sites.Get() {
+		if slices.Contains(site.Hosts, host) {
+			return site
+		}
+	}
+	return defaultSite
+}
+
+// siteOf returns the site a configuration belongs to
+func siteOf(bc BlogConfiguration) *Site {
+	if bc.site == nil {
+		return defaultSite
+	}
+	return bc.site
+}
+
+// managementHandler hides the management pages of sites without credentials
+func managementHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestSite(r).Config().isPasswordless() {
+			renderError(w, r, notFound("Page not found!"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// configuredSites returns the default site and the sites of a configuration
+func configuredSites(config BlogConfiguration) []SiteConfiguration {
+	return append([]SiteConfiguration{{Name: DEFAULT_SITE, Config: config}}, config.Sites...)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSiteConfiguration(t *testing.T) {
+	hashed, err := hashPassword("secret", testArgon2Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := writeConfigFile(t, `{
+	"title": "Main",
+	"passwordhash": "`+hashed+`",
+	"postsperpage": 5,
+	"sites": [
+		{"name": "cooking", "hosts": ["Cooking.example.com", "www.cooking.example.com"], "title": "Cooking", "postdir": "cooking"},
+		{"name": "travel", "hosts": ["travel.example.com"], "postdir": "travel", "passwordhash": "`+hashed+`"}
+	]
+}`)
+	config, err := parseFlags([]string{"-config", filename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Sites) != 2 || config.Sites[0].Hosts[0] != "cooking.example.com" {
+		t.Fatal("Sites should be read from the config file")
+	}
+	cooking := config.Sites[0].Config
+	if cooking.Title != "Cooking" || cooking.PostsPerPage != 5 || cooking.PostDir != "cooking" {
+		t.Fatal("Sites should inherit settings they don't set")
+	}
+	if !cooking.isPasswordless() || config.Sites[1].Config.isPasswordless() {
+		t.Fatal("Sites shouldn't inherit credentials")
+	}
+
+	filename = writeConfigFile(t, `{"baseurl": "https://example.com/blog", "sites": [{"name": "a", "hosts": ["a.example.com"], "postdir": "a"}, {"name": "b", "hosts": ["b.example.com"], "postdir": "b", "baseurl": "https://b.example.com/blog"}]}`)
+	config, err = parseFlags([]string{"-config", filename})
+	if err != nil || config.Sites[0].Config.BasePath != "/blog" || config.Sites[1].Config.BasePath != "/blog" {
+		t.Fatalf("Sites should be served under the base path of the default site, got %v", err)
+	}
+
+	cases := map[string]string{
+		`{"sites": [{"name": "a", "hosts": ["a.example.com"], "port": 9000, "postdir": "a"}]}`:                                                               "port can't be set per site",
+		`{"sites": [{"name": "a", "hosts": ["a.example.com"], "titel": "A", "postdir": "a"}]}`:                                                               `did you mean "title"?`,
+		`{"sites": [{"name": "a", "hosts": [], "postdir": "a"}]}`:                                                                                            "at least one host",
+		`{"sites": [{"name": "default", "hosts": ["a.example.com"], "postdir": "a"}]}`:                                                                       "can't be default",
+		`{"sites": [{"name": "a", "hosts": ["a.example.com"]}]}`:                                                                                             "own post directory",
+		`{"sites": [{"name": "a", "hosts": ["x.example.com"], "postdir": "a"}, {"name": "b", "hosts": ["x.example.com"], "postdir": "b"}]}`:                  "host x.example.com is used by site a and b",
+		`{"sites": [{"name": "a", "hosts": ["a.example.com"], "postdir": "a", "postsperpage": 0}]}`:                                                          "site a: invalid postsperpage",
+		`{"baseurl": "https://example.com/blog", "sites": [{"name": "a", "hosts": ["a.example.com"], "postdir": "a", "baseurl": "https://a.example.com/"}]}`: "baseurl https://a.example.com of site a",
+	}
+	for content, expected := range cases {
+		_, err := parseFlags([]string{"-config", writeConfigFile(t, content)})
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("Config %v should fail with %v, got %v", content, expected, err)
+		}
+	}
+}
+
+func writeTestPost(t *testing.T, dir string, title string) {
+	post, err := buildPost(CreatePostData{Title: title, Text: "Hello"}, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, generatePostFilename(title)), post, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSiteIsolation(t *testing.T) {
+	sessionStore = newMemorySessionStore()
+	mainDir, cookingDir := t.TempDir(), t.TempDir()
+	writeTestPost(t, mainDir, "Main post")
+	writeTestPost(t, cookingDir, "Cooking post")
+
+	hashed, _ := hashPassword("secret", testArgon2Params)
+	main := BlogConfiguration{Title: "Main", Hash: hashed, PostDir: mainDir, TemplateDir: "templates", PostsPerPage: 10, SessionTimeout: 60, RememberMeDays: 30}
+	defaultSite.SetConfig(main)
+	cooking := newSite("cooking", []string{"cooking.example.com"})
+	cooking.SetConfig(BlogConfiguration{Title: "Cooking", PostDir: cookingDir, TemplateDir: "templates", PostsPerPage: 10, ViewOnly: true})
+	sites.Set([]*Site{cooking})
+	defer sites.Set(nil)
+	err := reloadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshPosts()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "Cooking.example.com:8080"
+	if requestSite(r) != cooking || requestSite(httptest.NewRequest("GET", "/", nil)) != defaultSite {
+		t.Fatal("Sites should be selected by host, unknown hosts get the default site")
+	}
+
+	recorder := httptest.NewRecorder()
+	homeHandler(recorder, r)
+	if !strings.Contains(recorder.Body.String(), "Cooking post") || strings.Contains(recorder.Body.String(), "Main post") {
+		t.Fatal("Every site should list its own posts")
+	}
+
+	recorder = httptest.NewRecorder()
+	session, err := createSession(recorder, httptest.NewRequest("POST", "/login", nil), main, LEGACY_ADMIN, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.AddCookie(recorder.Result().Cookies()[0])
+	_, _, err = currentUser(r, requestSite(r).Config())
+	if err == nil {
+		t.Fatal("Sessions of one site shouldn't be valid on another site")
+	}
+	sessions, _ := cooking.Sessions().List()
+	if len(sessions) != 0 || session.Key == "" {
+		t.Fatal("Sessions should be stored by the site they were created on")
+	}
+
+	recorder = httptest.NewRecorder()
+	managementHandler(http.NotFoundHandler()).ServeHTTP(recorder, httptest.NewRequest("GET", "http://cooking.example.com/create", nil))
+	if recorder.Code != http.StatusNotFound || !strings.Contains(recorder.Body.String(), "Page not found") {
+		t.Fatal("Sites without credentials shouldn't serve the management pages")
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const DEFAULT_LOCALE string = "en"
+const WORDS_PER_MINUTE int = 200
+
+var localePattern *regexp.Regexp = regexp.MustCompile(`^[a-z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+var slugSeparatorPattern *regexp.Regexp = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+var htmlTagPattern *regexp.Regexp = regexp.MustCompile(`<[^>]*>`)
+
+// assetVersions caches the fingerprints of files by location, size and modification time
+var assetVersions sync.Map
+
+// templateFuncs are the functions available in every template, site and request specific functions are replaced when loading and rendering
+var templateFuncs template.FuncMap = template.FuncMap{
+	"nonce":       func() string { return "" },
+	"option":      func(name string) any { return nil },
+	"theme":       func() Theme { return Theme{} },
+	"csrf":        func() string { return "" },
+	"sso":         func() bool { return false },
+	"absurl":      func(parts ...any) string { return "" },
+	"truncate":    truncate,
+	"slugify":     slugify,
+	"readingtime": readingTime,
+}
+
+// siteFuncs are the template functions that depend on the configuration and theme of a site
+func siteFuncs(config BlogConfiguration, theme Theme, catalog map[string]string) template.FuncMap {
+	translate := func(key string, args ...any) string {
+		text, ok := catalog[key]
+		if !ok {
+			text = key
+		}
+		if len(args) > 0 {
+			return fmt.Sprintf(text, args...)
+		}
+		return text
+	}
+	return template.FuncMap{
+		"date": func(value any, layout ...string) string {
+			return formatDate(value, config, layout...)
+		},
+		"ago": func(value any) string {
+			return relativeDate(value, time.Now(), config.location(), translate)
+		},
+		"url": func(parts ...any) string {
+			return buildURL(config.BasePath, parts...)
+		},
+		"asset": func(name string) string {
+			return assetURL(config, theme, name)
+		},
+		"t": translate,
+	}
+}
+
+// postTime parses a post timestamp, timestamps are written in the configured time zone
+func postTime(value any, location *time.Location) (time.Time, bool) {
+	switch value := value.(type) {
+	case time.Time:
+		return value, true
+	case string:
+		parsed, err := time.ParseInLocation(time.RFC1123, value, location)
+		return parsed, err == nil
+	}
+	return time.Time{}, false
+}
+
+// formatDate formats a post timestamp or time in the configured time zone, with the configured layout unless one is passed
+func formatDate(value any, config BlogConfiguration, layout ...string) string {
+	parsed, ok := postTime(value, config.location())
+	if !ok {
+		return fmt.Sprint(value)
+	}
+	format := config.DateFormat
+	if len(layout) > 0 {
+		format = layout[0]
+	} else if format == "" {
+		format = time.RFC1123
+	}
+	return parsed.In(config.location()).Format(format)
+}
+
+// relativeDate describes how long ago a timestamp was in the largest whole unit, like "3 days ago"
+func relativeDate(value any, now time.Time, location *time.Location, translate func(key string, args ...any) string) string {
+	parsed, ok := postTime(value, location)
+	if !ok {
+		return fmt.Sprint(value)
+	}
+	elapsed := now.Sub(parsed)
+	units := []struct {
+		size time.Duration
+		name string
+	}{{365 * 24 * time.Hour, "year"}, {30 * 24 * time.Hour, "month"}, {24 * time.Hour, "day"}, {time.Hour, "hour"}, {time.Minute, "minute"}}
+	for _, unit := range units {
+		count := int(elapsed / unit.size)
+		if count == 1 {
+			return translate("relative." + unit.name)
+		} else if count > 1 {
+			return translate("relative."+unit.name+"s", count)
+		}
+	}
+	return translate("relative.now")
+}
+
+// truncate shortens text to at most length characters, cutting at a word boundary when there is one
+func truncate(length int, text string) string {
+	if utf8.RuneCountInString(text) <= length {
+		return text
+	}
+	if length < 1 {
+		return ""
+	}
+	cut := string([]rune(text)[:length-1])
+	if index := strings.LastIndexAny(cut, " \t\n"); index > 0 {
+		cut = cut[:index]
+	}
+	return strings.TrimRight(cut, " \t\n.,;:-") + "…"
+}
+
+func slugify(text string) string {
+	return strings.Trim(slugSeparatorPattern.ReplaceAllString(strings.ToLower(text), "-"), "-")
+}
+
+// readingTime estimates the minutes it takes to read a text or rendered post, at least one
+func readingTime(value any) int {
+	text := fmt.Sprint(value)
+	if html, ok := value.(template.HTML); ok {
+		text = htmlTagPattern.ReplaceAllString(string(html), " ")
+	}
+	words := len(strings.Fields(text))
+	return max(1, (words+WORDS_PER_MINUTE-1)/WORDS_PER_MINUTE)
+}
+
+// buildURL joins the parts to a path, posts urls are already escaped so parts are used as they are
+func buildURL(base string, parts ...any) string {
+	var segments []string
+	for _, part := range parts {
+		segment := strings.Trim(fmt.Sprint(part), "/")
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.Join(segments, "/")
+}
+
+// assetURL links a file with a fingerprint of its content, so browsers can cache it until it changes
+func assetURL(config BlogConfiguration, theme Theme, name string) string {
+	link := config.BasePath + "/files/" + strings.TrimPrefix(name, "/")
+	files := siteFiles(config, theme)
+	info, err := fs.Stat(files, strings.TrimPrefix(name, "/"))
+	if err != nil || info.IsDir() {
+		return link
+	}
+	key := strings.Join([]string{config.FileDir, theme.Dir, name, fmt.Sprint(info.Size()), fmt.Sprint(info.ModTime().UnixNano())}, "\x00")
+	if version, ok := assetVersions.Load(key); ok {
+		return link + "?v=" + version.(string)
+	}
+	data, err := fs.ReadFile(files, strings.TrimPrefix(name, "/"))
+	if err != nil {
+		return link
+	}
+	sum := sha256.Sum256(data)
+	version := hex.EncodeToString(sum[:])[:12]
+	assetVersions.Store(key, version)
+	return link + "?v=" + version
+}
+
+// loadCatalog merges the translations of the locale over the english ones, the embedded catalogs are
+// extended by i18n/<locale>.json files of the theme and the template directory
+func loadCatalog(config BlogConfiguration, theme Theme) (map[string]string, error) {
+	locales := []string{DEFAULT_LOCALE}
+	if config.Locale != "" && config.Locale != DEFAULT_LOCALE {
+		language, _, _ := strings.Cut(config.Locale, "-")
+		if language != DEFAULT_LOCALE && language != config.Locale {
+			locales = append(locales, language)
+		}
+		locales = append(locales, config.Locale)
+	}
+
+	catalog := map[string]string{}
+	for _, locale := range locales {
+		filename := locale + ".json"
+		sources := []func() ([]byte, error){func() ([]byte, error) { return embeddedTranslations.ReadFile("i18n/" + filename) }}
+		if theme.Dir != "" {
+			sources = append(sources, func() ([]byte, error) { return os.ReadFile(filepath.Join(theme.Dir, "i18n", filename)) })
+		}
+		if config.TemplateDir != "" {
+			sources = append(sources, func() ([]byte, error) { return os.ReadFile(filepath.Join(config.TemplateDir, "i18n", filename)) })
+		}
+		for _, source := range sources {
+			data, err := source()
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			var translations map[string]string
+			err = json.Unmarshal(data, &translations)
+			if err != nil {
+				return nil, fmt.Errorf("invalid translations %v: %w", filename, err)
+			}
+			for key, text := range translations {
+				catalog[key] = text
+			}
+		}
+	}
+	return catalog, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"html/template"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTitlesAreEscaped(t *testing.T) {
+	postDir := t.TempDir()
+	title := "<script>alert(1)</script> & more"
+	post, err := buildPost(CreatePostData{Title: title, Text: "Hello", Author: "mallory"}, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(postDir, generatePostFilename(title)), post, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userStore = newMemoryUserStore()
+	userStore.Save(User{Username: "mallory", DisplayName: "<i>Mallory</i>", Role: ROLE_AUTHOR})
+	defaultSite.SetConfig(BlogConfiguration{Title: "<b>Blog</b>", PostDir: postDir, TemplateDir: "templates", PostsPerPage: 10, ViewOnly: true})
+	err = reloadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshPosts()
+
+	pages := []string{"/", "/posts/" + defaultSite.sortedPostIndex.Get()[0].URL}
+	for _, page := range pages {
+		r := httptest.NewRequest("GET", page, nil)
+		if page != "/" {
+			postId, _ := url.PathUnescape(strings.TrimPrefix(page, "/posts/"))
+			r.SetPathValue("postId", postId)
+		}
+		recorder := httptest.NewRecorder()
+		if page == "/" {
+			homeHandler(recorder, r)
+		} else {
+			postsHandler(recorder, r)
+		}
+		body := recorder.Body.String()
+		if recorder.Code != 200 {
+			t.Fatalf("%v should be shown, got %v", page, recorder.Code)
+		}
+		if strings.Contains(body, "<script>alert") || strings.Contains(body, "<b>Blog</b>") || strings.Contains(body, "<i>Mallory</i>") {
+			t.Fatalf("%v should escape titles, got %v", page, body)
+		}
+		if page == "/" && !strings.Contains(body, "&lt;script&gt;alert(1)&lt;/script&gt; &amp; more") {
+			t.Fatalf("%v should show the escaped title, got %v", page, body)
+		}
+		if page != "/" && !strings.Contains(body, "&lt;i&gt;Mallory&lt;/i&gt;") {
+			t.Fatalf("%v should show the escaped author name, got %v", page, body)
+		}
+		if !strings.Contains(body, "&lt;b&gt;Blog&lt;/b&gt;") {
+			t.Fatalf("%v should show the escaped blog title, got %v", page, body)
+		}
+	}
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	config := BlogConfiguration{Location: berlin, DateFormat: "2006-01-02 15:04"}
+	if formatDate("Wed, 05 Feb 2025 17:54:14 CET", config) != "2025-02-05 17:54" || formatDate("Wed, 05 Feb 2025 16:54:14 UTC", config, "15:04 MST") != "17:54 CET" {
+		t.Fatal("Dates should be formatted in the configured time zone and layout")
+	}
+	if formatDate("yesterday", config) != "yesterday" {
+		t.Fatal("Invalid timestamps should be shown as they are")
+	}
+
+	catalog, err := loadCatalog(BlogConfiguration{Locale: "de-AT"}, Theme{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	funcs := siteFuncs(BlogConfiguration{Location: time.UTC}, Theme{}, catalog)
+	translate := funcs["t"].(func(string, ...any) string)
+	if translate("pagination.older") != "ältere Beiträge" || translate("post.readingtime", 3) != "3 Min. Lesezeit" || translate("unknown") != "unknown" {
+		t.Fatal("Translations should fall back from the region to the language and to the key")
+	}
+	now := time.Date(2025, 2, 10, 12, 0, 0, 0, time.UTC)
+	cases := map[time.Time]string{now.Add(-30 * time.Second): "gerade eben", now.Add(-90 * time.Minute): "vor einer Stunde", now.Add(-72 * time.Hour): "vor 3 Tagen", now.Add(time.Hour): "gerade eben"}
+	for timestamp, expected := range cases {
+		if relative := relativeDate(timestamp, now, time.UTC, translate); relative != expected {
+			t.Fatalf("Expected %q, got %q", expected, relative)
+		}
+	}
+
+	if truncate(12, "Hello wonderful world") != "Hello…" || truncate(40, "short") != "short" || truncate(3, "äöüß") != "äö…" {
+		t.Fatal("Truncate should cut at word boundaries and count characters")
+	}
+	if slugify("Hello, Wörld! 2025") != "hello-wörld-2025" {
+		t.Fatal("Slugify should keep letters and digits only")
+	}
+	if readingTime(template.HTML("<p>"+strings.Repeat("word ", 450)+"</p>")) != 3 || readingTime("") != 1 {
+		t.Fatal("Reading time should round up words per minute and ignore markup")
+	}
+	if buildURL("", "posts", "first%20post") != "/posts/first%20post" || buildURL("https://example.com/", "/page/", 2) != "https://example.com/page/2" || buildURL("") != "/" {
+		t.Fatal("Urls should join their parts")
+	}
+}
+
+func TestAssetFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	config := BlogConfiguration{FileDir: dir}
+	os.WriteFile(filepath.Join(dir, "style.css"), []byte("body {}"), 0700)
+	first := assetURL(config, Theme{}, "style.css")
+	if !strings.HasPrefix(first, "/files/style.css?v=") || assetURL(config, Theme{}, "style.css") != first {
+		t.Fatalf("Assets should be linked with a stable fingerprint, got %v", first)
+	}
+	os.WriteFile(filepath.Join(dir, "style.css"), []byte("body { color: red; }"), 0700)
+	if assetURL(config, Theme{}, "style.css") == first {
+		t.Fatal("The fingerprint should change with the content")
+	}
+	if assetURL(config, Theme{}, "missing.css") != "/files/missing.css" {
+		t.Fatal("Missing assets should be linked without a fingerprint")
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const THEME_MANIFEST string = "theme.json"
+const THEME_PREVIEW_COOKIE string = "golb_theme_preview"
+
+var themeNamePattern *regexp.Regexp = regexp.MustCompile(`^[a-z0-9_-]{1,64}$`)
+var themeOptionNamePattern *regexp.Regexp = regexp.MustCompile(`^[a-z][a-z0-9-]{0,63}$`)
+
+// option values end up in style sheets and pages unescaped, so every type only allows harmless characters
+var themeOptionTypes map[string]*regexp.Regexp = map[string]*regexp.Regexp{
+	"bool":  regexp.MustCompile(`^(true|false)$`),
+	"color": regexp.MustCompile(`^(#[0-9a-fA-F]{3}|#[0-9a-fA-F]{4}|#[0-9a-fA-F]{6}|#[0-9a-fA-F]{8}|[a-zA-Z]{1,32})$`),
+	"font":  regexp.MustCompile(`^[a-zA-Z0-9 ,'-]{1,128}$`),
+	"text":  regexp.MustCompile(`^[^<>"'&;{}\\]{0,256}$`),
+}
+
+type ThemeOption struct {
+	Type        string `json:"type"`
+	Default     any    `json:"default"`
+	Description string `json:"description"`
+}
+
+// Theme is an installed theme, Values are the option values after applying the configured options to the defaults
+type Theme struct {
+	Name        string                 `json:"name"`
+	Version     string                 `json:"version"`
+	Description string                 `json:"description"`
+	Options     map[string]ThemeOption `json:"options"`
+	Dir         string                 `json:"-"`
+	Values      map[string]any         `json:"-"`
+}
+
+func (option ThemeOption) parse(value string) (any, error) {
+	if !themeOptionTypes[option.Type].MatchString(value) {
+		return nil, fmt.Errorf("%q is not a valid %v", value, option.Type)
+	}
+	if option.Type == "bool" {
+		return value == "true", nil
+	}
+	return value, nil
+}
+
+// parseThemeOptions parses a semicolon separated list of option=value settings
+func parseThemeOptions(value string) (map[string]string, error) {
+	options := map[string]string{}
+	for _, setting := range strings.Split(value, ";") {
+		if strings.TrimSpace(setting) == "" {
+			continue
+		}
+		name, optionValue, ok := strings.Cut(setting, "=")
+		if !ok {
+			return nil, errors.New(setting + " is not an option=value setting")
+		}
+		options[strings.TrimSpace(name)] = strings.TrimSpace(optionValue)
+	}
+	return options, nil
+}
+
+// loadTheme reads the manifest of an installed theme and applies the options to its defaults
+func loadTheme(themeDir string, name string, options map[string]string) (Theme, error) {
+	if !themeNamePattern.MatchString(name) {
+		return Theme{}, errors.New("invalid theme name " + name + ", use lowercase letters, digits, - and _")
+	}
+	dir := filepath.Join(themeDir, name)
+	filebytes, err := os.ReadFile(filepath.Join(dir, THEME_MANIFEST))
+	if err != nil {
+		return Theme{}, fmt.Errorf("theme %v isn't installed in %v: %w", name, themeDir, err)
+	}
+
+	var theme Theme
+	decoder := json.NewDecoder(bytes.NewReader(filebytes))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&theme)
+	if err != nil {
+		return Theme{}, fmt.Errorf("invalid %v of theme %v: %w", THEME_MANIFEST, name, err)
+	}
+	if theme.Name != name {
+		return Theme{}, fmt.Errorf("%v of theme %v names the theme %q, the name has to match the directory", THEME_MANIFEST, name, theme.Name)
+	}
+	if theme.Version == "" {
+		return Theme{}, fmt.Errorf("%v of theme %v has no version", THEME_MANIFEST, name)
+	}
+
+	theme.Dir = dir
+	theme.Values = map[string]any{}
+	for optionName, option := range theme.Options {
+		if !themeOptionNamePattern.MatchString(optionName) {
+			return Theme{}, fmt.Errorf("invalid option name %v in theme %v, use lowercase letters, digits and -", optionName, name)
+		}
+		if themeOptionTypes[option.Type] == nil {
+			return Theme{}, fmt.Errorf("option %v of theme %v has the unknown type %q, use bool, color, font or text", optionName, name, option.Type)
+		}
+		defaultValue := ""
+		if option.Default != nil {
+			defaultValue = fmt.Sprint(option.Default)
+		} else if option.Type == "bool" {
+			defaultValue = "false"
+		}
+		theme.Values[optionName], err = option.parse(defaultValue)
+		if err != nil {
+			return Theme{}, fmt.Errorf("invalid default of option %v in theme %v: %w", optionName, name, err)
+		}
+	}
+
+	for optionName, value := range options {
+		option, ok := theme.Options[optionName]
+		if !ok {
+			known := slices.Sorted(maps.Keys(theme.Options))
+			return Theme{}, fmt.Errorf("theme %v has no option %v, use one of %v", name, optionName, strings.Join(known, ", "))
+		}
+		theme.Values[optionName], err = option.parse(value)
+		if err != nil {
+			return Theme{}, fmt.Errorf("invalid value for option %v of theme %v: %w", optionName, name, err)
+		}
+	}
+	return theme, nil
+}
+
+// listThemes returns the valid themes installed in themeDir, invalid themes are logged and skipped
+func listThemes(themeDir string) ([]Theme, error) {
+	entries, err := os.ReadDir(themeDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var themes []Theme
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		theme, err := loadTheme(themeDir, entry.Name(), nil)
+		if err != nil {
+			slog.Warn("skipping invalid theme", "theme", entry.Name(), "error", err)
+			continue
+		}
+		themes = append(themes, theme)
+	}
+	return themes, nil
+}
+
+// previewTheme returns the theme an admin is previewing, other users always see the active theme
+func previewTheme(r *http.Request, config BlogConfiguration) (Theme, bool) {
+	cookie, err := r.Cookie(THEME_PREVIEW_COOKIE)
+	if err != nil || cookie.Value == "" {
+		return Theme{}, false
+	}
+	user, _, err := currentUser(r, config)
+	if err != nil || !user.IsAdmin() {
+		return Theme{}, false
+	}
+	theme, err := loadTheme(config.ThemeDir, cookie.Value, nil)
+	if err != nil {
+		return Theme{}, false
+	}
+	return theme, true
+}
+
+// activateTheme switches the theme of the site until the configuration is reloaded, the configured options apply if the theme has them
+func activateTheme(site *Site, name string) error {
+	config := site.Config()
+	previous := config
+	theme := Theme{}
+	if name != "" {
+		var err error
+		theme, err = loadTheme(config.ThemeDir, name, config.ThemeOptions)
+		if err != nil {
+			theme, err = loadTheme(config.ThemeDir, name, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	config.Theme = name
+	config.theme = theme
+	site.SetConfig(config)
+	err := site.reloadTemplates()
+	if err != nil {
+		site.SetConfig(previous)
+		return err
+	}
+	return nil
+}
+
+func themesHandler(w http.ResponseWriter, r *http.Request) {
+	site := requestSite(r)
+	config := site.Config()
+	logger := requestLogger(r)
+	user, _, err := currentUser(r, config)
+	if err != nil {
+		redirect(w, r, "/login", 307)
+		return
+	}
+	if !user.IsAdmin() {
+		renderError(w, r, forbidden("Only admins can manage themes!"))
+		return
+	}
+
+	data := ThemeListData{Active: config.Theme}
+	if r.Method == "POST" {
+		err := r.ParseForm()
+		if err == nil {
+			err = checkCSRF(r, config)
+		}
+		if err != nil {
+			renderCSRFError(w, r, err)
+			return
+		}
+
+		name := r.PostFormValue("theme")
+		switch r.PostFormValue("action") {
+		case "preview":
+			_, err := loadTheme(config.ThemeDir, name, nil)
+			if err != nil {
+				data.Message = "Can't preview theme: " + err.Error()
+				break
+			}
+			http.SetCookie(w, &http.Cookie{Name: THEME_PREVIEW_COOKIE, Value: name, Path: config.BasePath + "/", Secure: true, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+			redirect(w, r, "/", 303)
+			return
+		case "activate":
+			err := activateTheme(site, name)
+			if err != nil {
+				logger.Error("couldn't activate theme", "theme", name, "error", err)
+				data.Message = "Can't activate theme: " + err.Error()
+				break
+			}
+			http.SetCookie(w, &http.Cookie{Name: THEME_PREVIEW_COOKIE, Path: config.BasePath + "/", MaxAge: -1, Secure: true, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+			recordAudit(r, AuditEvent{Action: AUDIT_THEME, Actor: user.Username, Detail: "activated theme " + themeLabel(name)})
+			logger.Info("activated theme", "theme", themeLabel(name), "username", user.Username)
+			data.Active = name
+			data.Message = "Activated theme " + themeLabel(name) + ", set -theme to keep it after a restart"
+		case "stop":
+			http.SetCookie(w, &http.Cookie{Name: THEME_PREVIEW_COOKIE, Path: config.BasePath + "/", MaxAge: -1, Secure: true, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+			redirect(w, r, "/themes", 303)
+			return
+		default:
+			data.Message = "Unknown action!"
+		}
+	} else if r.Method != "GET" {
+		renderError(w, r, methodNotAllowed("GET", "POST"))
+		return
+	}
+
+	themes, err := listThemes(config.ThemeDir)
+	if err != nil {
+		renderError(w, r, internalError(fmt.Errorf("couldn't list themes: %w", err)))
+		return
+	}
+	data.Themes = themes
+	if preview, ok := previewTheme(r, config); ok {
+		data.Preview = preview.Name
+	}
+	renderPage(w, r, "themes.html", data)
+}
+
+func themeLabel(name string) string {
+	if name == "" {
+		return "built-in"
+	}
+	return name
+}
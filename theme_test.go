@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestTheme(t *testing.T, themeDir string, name string, manifest string) {
+	dir := filepath.Join(themeDir, name)
+	os.MkdirAll(filepath.Join(dir, "templates"), 0700)
+	os.MkdirAll(filepath.Join(dir, "files"), 0700)
+	err := os.WriteFile(filepath.Join(dir, THEME_MANIFEST), []byte(manifest), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadTheme(t *testing.T) {
+	theme, err := loadTheme("themes", "dusk", map[string]string{"accent": "#123456", "wide": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if theme.Values["accent"] != "#123456" || theme.Values["wide"] != true || theme.Values["font"] != "Georgia, serif" {
+		t.Fatalf("Options should override the defaults of the theme, got %v", theme.Values)
+	}
+
+	themeDir := t.TempDir()
+	writeTestTheme(t, themeDir, "other", `{"name": "renamed", "version": "1"}`)
+	writeTestTheme(t, themeDir, "badtype", `{"name": "badtype", "version": "1", "options": {"size": {"type": "number"}}}`)
+	cases := map[string]map[string]string{
+		"has no option size":           {"size": "12"},
+		`"red;}" is not a valid color`: {"accent": "red;}"},
+		"is not a valid bool":          {"wide": "yes"},
+	}
+	for expected, options := range cases {
+		_, err := loadTheme("themes", "dusk", options)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("Options %v should fail with %v, got %v", options, expected, err)
+		}
+	}
+	for name, expected := range map[string]string{"other": "has to match the directory", "badtype": "unknown type", "../dusk": "invalid theme name", "missing": "isn't installed"} {
+		_, err := loadTheme(themeDir, name, nil)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("Theme %v should fail with %v, got %v", name, expected, err)
+		}
+	}
+
+	themes, err := listThemes(themeDir)
+	if err != nil || len(themes) != 0 {
+		t.Fatal("Invalid themes should not be listed")
+	}
+}
+
+func TestThemeConfiguration(t *testing.T) {
+	config, err := parseFlags([]string{"-theme", "dusk", "-themeoptions", "accent=#000; font=Arial, sans-serif"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.theme.Name != "dusk" || config.theme.Values["font"] != "Arial, sans-serif" {
+		t.Fatalf("The configured theme should be loaded with its options, got %v", config.theme)
+	}
+
+	filename := writeConfigFile(t, `{"theme": "dusk", "themeoptions": {"accent": "#000", "wide": true}}`)
+	config, err = parseFlags([]string{"-config", filename})
+	if err != nil || config.theme.Values["wide"] != true {
+		t.Fatalf("Theme options should be accepted as an object in the config file, got %v", err)
+	}
+
+	_, err = parseFlags([]string{"-themeoptions", "accent=#000"})
+	if err == nil {
+		t.Fatal("Theme options without a theme should be rejected")
+	}
+}
+
+func TestThemeLayers(t *testing.T) {
+	themeDir, templateDir := t.TempDir(), t.TempDir()
+	writeTestTheme(t, themeDir, "plain", `{"name": "plain", "version": "1", "options": {"accent": {"type": "color", "default": "red"}}}`)
+	os.WriteFile(filepath.Join(themeDir, "plain", "templates", "error.html"), []byte("theme error"), 0700)
+	os.WriteFile(filepath.Join(themeDir, "plain", "templates", "post.html"), []byte("theme post"), 0700)
+	os.WriteFile(filepath.Join(templateDir, "post.html"), []byte("custom post"), 0700)
+	os.WriteFile(filepath.Join(themeDir, "plain", "files", "theme.css"), []byte("theme"), 0700)
+	theme, err := loadTheme(themeDir, "plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl, err := loadTemplates(BlogConfiguration{TemplateDir: templateDir}, theme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output strings.Builder
+	tmpl.ExecuteTemplate(&output, "post.html", nil)
+	tmpl.ExecuteTemplate(&output, "error.html", nil)
+	if output.String() != "custom posttheme error" || tmpl.Lookup("index.html") == nil {
+		t.Fatalf("Theme templates should shadow the embedded templates and be shadowed by the template directory, got %v", output.String())
+	}
+
+	files := siteFiles(BlogConfiguration{FileDir: t.TempDir()}, theme)
+	css, err := fs.ReadFile(files, "theme.css")
+	if err != nil || string(css) != "theme" {
+		t.Fatal("Theme files should be served")
+	}
+}
+
+func TestThemePreviewAndActivate(t *testing.T) {
+	themeDir := t.TempDir()
+	writeTestTheme(t, themeDir, "plain", `{"name": "plain", "version": "1", "options": {"accent": {"type": "color", "default": "red"}}}`)
+	os.WriteFile(filepath.Join(themeDir, "plain", "templates", "error.html"), []byte(`plain {{option "accent"}}`), 0700)
+	sessionStore = newMemorySessionStore()
+	userStore = newMemoryUserStore()
+	auditLog = newMemoryAuditLog(100)
+	config := BlogConfiguration{Hash: "filler", ThemeDir: themeDir, SessionTimeout: 60, RememberMeDays: 30}
+	defaultSite.SetConfig(config)
+	defer defaultSite.SetConfig(BlogConfiguration{})
+	reloadTemplates()
+
+	recorder := httptest.NewRecorder()
+	session, _ := createSession(recorder, httptest.NewRequest("POST", "/login", nil), config, LEGACY_ADMIN, false)
+	cookie := recorder.Result().Cookies()[0]
+	post := func(form string) *httptest.ResponseRecorder {
+		r := newFormRequest("/themes", form+"&csrf_token="+session.CSRFToken)
+		r.AddCookie(cookie)
+		recorder := httptest.NewRecorder()
+		themesHandler(recorder, r)
+		return recorder
+	}
+	render := func(cookies ...*http.Cookie) string {
+		r := httptest.NewRequest("GET", "/missing", nil)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		recorder := httptest.NewRecorder()
+		renderPage(recorder, r, "error.html", "Page not found!")
+		return recorder.Body.String()
+	}
+
+	response := post("action=preview&theme=plain")
+	previewCookie := response.Result().Cookies()[0]
+	if previewCookie.Name != THEME_PREVIEW_COOKIE || previewCookie.Value != "plain" {
+		t.Fatal("Previewing should set the preview cookie")
+	}
+	if !strings.Contains(render(cookie, previewCookie), "plain red") || !strings.Contains(render(cookie, previewCookie), "Previewing theme plain") {
+		t.Fatal("Admins should see the previewed theme")
+	}
+	if strings.Contains(render(previewCookie), "plain red") {
+		t.Fatal("Only admins should be able to preview themes")
+	}
+
+	post("action=activate&theme=plain")
+	if defaultSite.Config().Theme != "plain" || !strings.Contains(render(), "plain red") {
+		t.Fatal("Activating should switch the theme for everyone")
+	}
+	events, _ := auditLog.List()
+	if len(events) != 1 || events[0].Action != AUDIT_THEME {
+		t.Fatal("Activating a theme should be audited")
+	}
+
+	post("action=activate&theme=")
+	if defaultSite.Config().Theme != "" || strings.Contains(render(), "plain red") {
+		t.Fatal("Activating the built-in theme should remove the theme")
+	}
+}
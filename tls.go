@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// certificateStore serves the certificate of -tlscert and -tlskey and swaps in a new one when the files change
+type certificateStore struct {
+	certFile    string
+	keyFile     string
+	certificate SyncCache[*tls.Certificate]
+}
+
+func newCertificateStore(certFile string, keyFile string) (*certificateStore, error) {
+	store := &certificateStore{certFile: certFile, keyFile: keyFile}
+	err := store.reload()
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// reload reads the certificate files, the current certificate stays active if they can't be loaded
+func (store *certificateStore) reload() error {
+	certificate, err := tls.LoadX509KeyPair(store.certFile, store.keyFile)
+	if err != nil {
+		return err
+	}
+	store.certificate.Set(&certificate)
+	return nil
+}
+
+func (store *certificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return store.certificate.Get(), nil
+}
+
+// watch reloads the certificate when its directories change, renewals usually replace both files at once
+func (store *certificateStore) watch(ctx context.Context) {
+	dirs := []string{filepath.Dir(store.certFile)}
+	if !slices.Contains(dirs, filepath.Dir(store.keyFile)) {
+		dirs = append(dirs, filepath.Dir(store.keyFile))
+	}
+	watchDirectories(ctx, dirs, 500*time.Millisecond, 10*time.Second, func(dir string) {
+		err := store.reload()
+		if err != nil {
+			slog.Warn("couldn't reload certificate, keeping the current one", "certfile", store.certFile, "error", err)
+			return
+		}
+		slog.Info("reloaded certificate", "certfile", store.certFile)
+	})
+}
+
+// selfSignedCertificate generates a certificate for development, valid for localhost and the given hosts
+func selfSignedCertificate(hosts []string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"golb development"}, CommonName: "localhost"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(30 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			if !slices.ContainsFunc(template.IPAddresses, ip.Equal) {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			}
+		} else if !slices.Contains(template.DNSNames, host) {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// tlsConfig offers HTTP/2 and HTTP/1.1, getCertificate returns the current certificate for every handshake
+func tlsConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	return &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: getCertificate, NextProtos: []string{"h2", "http/1.1"}}
+}
+
+// setupTLS prepares the main server for https, certificates of files are reloaded until ctx is cancelled
+func setupTLS(ctx context.Context, server *http.Server, config BlogConfiguration) error {
+	if config.TLSSelfSigned {
+		var hosts []string
+		for _, site := range allSites() {
+			hosts = append(hosts, site.Hosts...)
+			if parsed, err := url.Parse(site.Config().BaseURL); err == nil && parsed.Hostname() != "" {
+				hosts = append(hosts, parsed.Hostname())
+			}
+		}
+		certificate, err := selfSignedCertificate(hosts)
+		if err != nil {
+			return err
+		}
+		slog.Warn("serving https with a self-signed certificate, only use this for development", "hosts", certificate.Leaf.DNSNames, "ips", certificate.Leaf.IPAddresses)
+		server.TLSConfig = tlsConfig(func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return certificate, nil })
+		return nil
+	}
+
+	store, err := newCertificateStore(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return err
+	}
+	server.TLSConfig = tlsConfig(store.GetCertificate)
+	go store.watch(ctx)
+	return nil
+}
+
+// httpsRedirectHandler sends plain http requests to the same url on the https port
+func httpsRedirectHandler(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
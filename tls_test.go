@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func writeTestCertificate(t *testing.T, dir string, hosts ...string) *tls.Certificate {
+	certificate, err := selfSignedCertificate(hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(certificate.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+func TestSelfSignedCertificate(t *testing.T) {
+	certificate, err := selfSignedCertificate([]string{"blog.example.com", "192.0.2.1", "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"localhost", "blog.example.com", "127.0.0.1", "::1", "192.0.2.1"} {
+		err = certificate.Leaf.VerifyHostname(host)
+		if err != nil {
+			t.Fatalf("The certificate should be valid for %v: %v", host, err)
+		}
+	}
+	if len(certificate.Leaf.DNSNames) != 2 {
+		t.Fatalf("Hosts shouldn't be listed twice, got %v", certificate.Leaf.DNSNames)
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	first := writeTestCertificate(t, dir, "first.example.com")
+	store, err := newCertificateStore(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, _ := store.GetCertificate(nil)
+	if !slices.Equal(current.Certificate[0], first.Certificate[0]) {
+		t.Fatal("The store should serve the certificate of the files")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go store.watch(ctx)
+	time.Sleep(100 * time.Millisecond)
+
+	second := writeTestCertificate(t, dir, "second.example.com")
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		current, _ = store.GetCertificate(nil)
+		if slices.Equal(current.Certificate[0], second.Certificate[0]) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !slices.Equal(current.Certificate[0], second.Certificate[0]) {
+		t.Fatal("The certificate should be reloaded when the files change")
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "cert.pem"), []byte("broken"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.reload() == nil {
+		t.Fatal("Invalid certificates should be rejected")
+	}
+	current, _ = store.GetCertificate(nil)
+	if !slices.Equal(current.Certificate[0], second.Certificate[0]) {
+		t.Fatal("The current certificate should be kept when the files are invalid")
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	certificate, err := selfSignedCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(listener.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	server.TLSConfig = tlsConfig(func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return certificate, nil })
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(certificate.Leaf)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}, ForceAttemptHTTP2: true}}
+	resp, err := client.Get("https://" + listener.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("Expected HTTP/2, got %v", resp.Proto)
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	tests := []struct {
+		port     int
+		host     string
+		target   string
+		expected string
+	}{
+		{443, "example.com", "/posts/hello?x=1", "https://example.com/posts/hello?x=1"},
+		{443, "example.com:80", "/", "https://example.com/"},
+		{8443, "localhost:8080", "/login", "https://localhost:8443/login"},
+		{443, "[::1]:80", "/", "https://[::1]/"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.target, nil)
+		r.Host = test.host
+		recorder := httptest.NewRecorder()
+		httpsRedirectHandler(test.port).ServeHTTP(recorder, r)
+		if recorder.Code != http.StatusPermanentRedirect || recorder.Header().Get("Location") != test.expected {
+			t.Fatalf("Expected a redirect to %v, got %v %v", test.expected, recorder.Code, recorder.Header().Get("Location"))
+		}
+	}
+
+	_, err := parseFlags([]string{"-redirectport", "8081"})
+	if err == nil {
+		t.Fatal("The redirect port should require tls")
+	}
+	_, err = parseFlags([]string{"-tlscert", "cert.pem"})
+	if err == nil {
+		t.Fatal("A certificate without key should be rejected")
+	}
+	config, err := parseFlags([]string{"-tlsselfsigned", "-redirectport", "8081"})
+	if err != nil || config.RedirectPort != 8081 {
+		t.Fatalf("Expected a redirect port with a self-signed certificate, got %v %v", config.RedirectPort, err)
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"rsc.io/qr"
+)
+
+const TOTP_PERIOD int64 = 30
+const TOTP_DIGITS int = 6
+const TOTP_COOKIE string = "golb_2fa"
+const TOTP_FIELD string = "code"
+
+var totpEncoding *base32.Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var pendingLogins *pendingLoginStore = &pendingLoginStore{logins: map[string]pendingLogin{}}
+var pendingEnrollments *pendingEnrollmentStore = &pendingEnrollmentStore{enrollments: map[string]pendingEnrollment{}}
+
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", errors.New("couldn't read cryptographically secure rand")
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// totpCode computes the RFC 6238 code (HMAC-SHA1, 6 digits) for the given time step
+func totpCode(secret string, counter int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", errors.New("invalid totp secret")
+	}
+
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%1000000), nil
+}
+
+// verifyTOTP accepts codes of the previous, current and next time step to allow for clock drift.
+// Steps up to lastCounter were used before and are rejected, so a code can't be replayed.
+func verifyTOTP(secret string, code string, now time.Time, lastCounter int64) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != TOTP_DIGITS {
+		return 0, false
+	}
+
+	current := now.Unix() / TOTP_PERIOD
+	for counter := current - 1; counter <= current+1; counter++ {
+		if counter <= lastCounter {
+			continue
+		}
+		expected, err := totpCode(secret, counter)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(code), []byte(expected)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+func totpURI(issuer string, username string, secret string) string {
+	label := url.PathEscape(issuer + ":" + username)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(TOTP_DIGITS))
+	query.Set("period", fmt.Sprint(TOTP_PERIOD))
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// qrCodeSVG renders text as a QR code in an inline svg, so no image has to be served or loaded from elsewhere
+func qrCodeSVG(text string) (template.HTML, error) {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return "", err
+	}
+
+	const border int = 4
+	size := code.Size + 2*border
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %v %v" width="256" height="256" shape-rendering="crispEdges" class="qrcode">`, size, size)
+	fmt.Fprintf(&buf, `<rect width="%v" height="%v" fill="#fff"/><path fill="#000" d="`, size, size)
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if code.Black(x, y) {
+				fmt.Fprintf(&buf, "M%v %vh1v1h-1z", x+border, y+border)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return template.HTML(buf.String()), nil
+}
+
+// generateRecoveryCodes returns the codes to show to the user once and the hashes to store
+func generateRecoveryCodes(count int) ([]string, []string, error) {
+	var codes []string = []string{}
+	var hashed []string = []string{}
+	for i := 0; i < count; i++ {
+		randbytes := make([]byte, 5)
+		_, err := rand.Read(randbytes)
+		if err != nil {
+			return nil, nil, errors.New("couldn't read cryptographically secure rand")
+		}
+		encoded := hex.EncodeToString(randbytes)
+		code := encoded[:5] + "-" + encoded[5:]
+		codes = append(codes, code)
+		hashed = append(hashed, hashRecoveryCode(code))
+	}
+	return codes, hashed, nil
+}
+
+// hashRecoveryCode uses a plain sha256, recovery codes are random enough that they don't need a slow hash
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// useRecoveryCode removes the matching recovery code from the user, every code works only once
+func useRecoveryCode(user *User, code string) bool {
+	hashed := hashRecoveryCode(code)
+	for i, stored := range user.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(hashed), []byte(stored)) == 1 {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// verifySecondFactor checks a totp or recovery code and stores the used time step or remaining recovery codes
+func verifySecondFactor(user User, code string, bc BlogConfiguration) (bool, error) {
+	counter, ok := verifyTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastCounter)
+	if ok {
+		user.TOTPLastCounter = counter
+		return true, saveUserKeepingLegacyPassword(user, bc)
+	}
+	if useRecoveryCode(&user, code) {
+		return true, saveUserKeepingLegacyPassword(user, bc)
+	}
+	return false, nil
+}
+
+func requiresTOTPEnrollment(user User, bc BlogConfiguration) bool {
+	return bc.Require2FA && user.IsAdmin() && user.TOTPSecret == "" && !user.SSO
+}
+
+type pendingEnrollment struct {
+	Secret  string
+	Expires time.Time
+}
+
+// pendingEnrollmentStore keeps the secret shown during enrollment on the server until the user confirms it with a code,
+// so the secret that gets enabled is always one golb generated for that session
+type pendingEnrollmentStore struct {
+	enrollments map[string]pendingEnrollment
+	mutex       sync.Mutex
+}
+
+// Start returns the pending secret of the session, a new one is generated when there is none or it expired
+func (store *pendingEnrollmentStore) Start(sessionKey string) (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	now := time.Now()
+	for key, enrollment := range store.enrollments {
+		if now.After(enrollment.Expires) {
+			delete(store.enrollments, key)
+		}
+	}
+	if enrollment, ok := store.enrollments[sessionKey]; ok {
+		return enrollment.Secret, nil
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	store.enrollments[sessionKey] = pendingEnrollment{Secret: secret, Expires: now.Add(10 * time.Minute)}
+	return secret, nil
+}
+
+func (store *pendingEnrollmentStore) Get(sessionKey string) (string, bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	enrollment, ok := store.enrollments[sessionKey]
+	if !ok || time.Now().After(enrollment.Expires) {
+		return "", false
+	}
+	return enrollment.Secret, true
+}
+
+func (store *pendingEnrollmentStore) Finish(sessionKey string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.enrollments, sessionKey)
+}
+
+type pendingLogin struct {
+	Site       string
+	Username   string
+	RememberMe bool
+	Expires    time.Time
+	Attempts   int
+}
+
+// pendingLoginStore remembers logins that passed the password check and still need their second factor
+type pendingLoginStore struct {
+	logins map[string]pendingLogin
+	mutex  sync.Mutex
+}
+
+func (store *pendingLoginStore) Start(w http.ResponseWriter, config BlogConfiguration, username string, rememberMe bool) error {
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	now := time.Now()
+	for key, login := range store.logins {
+		if now.After(login.Expires) {
+			delete(store.logins, key)
+		}
+	}
+	store.logins[sessionKey(token)] = pendingLogin{Site: siteOf(config).Name, Username: username, RememberMe: rememberMe, Expires: now.Add(5 * time.Minute)}
+
+	http.SetCookie(w, &http.Cookie{Name: TOTP_COOKIE, Value: token, Path: config.BasePath + "/login", Secure: true, HttpOnly: true, SameSite: http.SameSiteStrictMode, MaxAge: 300})
+	return nil
+}
+
+// Get returns the pending login of the request, it is dropped after too many wrong codes
+func (store *pendingLoginStore) Get(r *http.Request) (pendingLogin, string, bool) {
+	cookie, err := r.Cookie(TOTP_COOKIE)
+	if err != nil {
+		return pendingLogin{}, "", false
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	key := sessionKey(cookie.Value)
+	login, ok := store.logins[key]
+	if !ok || time.Now().After(login.Expires) || login.Attempts >= 5 {
+		delete(store.logins, key)
+		return pendingLogin{}, "", false
+	}
+	return login, key, true
+}
+
+func (store *pendingLoginStore) Failure(key string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	login, ok := store.logins[key]
+	if ok {
+		login.Attempts++
+		store.logins[key] = login
+	}
+}
+
+func (store *pendingLoginStore) Finish(w http.ResponseWriter, config BlogConfiguration, key string) {
+	store.mutex.Lock()
+	delete(store.logins, key)
+	store.mutex.Unlock()
+	http.SetCookie(w, &http.Cookie{Name: TOTP_COOKIE, Value: "", Path: config.BasePath + "/login", Secure: true, HttpOnly: true, SameSite: http.SameSiteStrictMode, MaxAge: -1})
+}
+
+func twoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	config := requestSite(r).Config()
+	logger := requestLogger(r)
+	session, err := currentSession(r, config)
+	if err != nil {
+		redirect(w, r, "/login", 307)
+		return
+	}
+	user, ok := userForSession(session, config)
+	if !ok {
+		redirect(w, r, "/login", 307)
+		return
+	}
+	if user.SSO {
+		renderError(w, r, notFound("Two-factor authentication for single sign-on accounts is managed by your identity provider."))
+		return
+	}
+
+	data := TwoFactorData{Enabled: user.TOTPSecret != "", Required: config.Require2FA && user.IsAdmin()}
+	if r.Method == "POST" {
+		err := r.ParseForm()
+		if err == nil {
+			err = checkCSRF(r, config)
+		}
+		if err != nil {
+			renderCSRFError(w, r, err)
+			return
+		}
+
+		if config.UsersFile == "" {
+			data.Message = "Two-factor authentication needs a users file (-usersfile) to store the secret."
+		} else if r.PostFormValue("disable") != "" {
+			data.Message = disableTOTP(user, r.PostFormValue(TOTP_FIELD), data.Required, config)
+			if data.Message == "" {
+				logger.Info("disabled two-factor authentication", "username", user.Username)
+				recordAudit(r, AuditEvent{Action: AUDIT_2FA, Actor: user.Username, Detail: "disabled"})
+				data.Enabled = false
+				data.Message = "Two-factor authentication disabled"
+			}
+		} else if !data.Enabled {
+			secret, pending := pendingEnrollments.Get(session.Key)
+			if !pending {
+				data.Message = "The setup expired, please scan the new code."
+			} else if counter, ok := verifyTOTP(secret, r.PostFormValue(TOTP_FIELD), time.Now(), 0); ok {
+				codes, hashed, err := generateRecoveryCodes(10)
+				if err == nil {
+					user.TOTPSecret = secret
+					user.TOTPLastCounter = counter
+					user.RecoveryCodes = hashed
+					err = saveUserKeepingLegacyPassword(user, config)
+				}
+				if err != nil {
+					logger.Error("couldn't enable two-factor authentication", "username", user.Username, "error", err)
+					data.Message = "Enabling two-factor authentication failed!"
+				} else {
+					pendingEnrollments.Finish(session.Key)
+					logger.Info("enabled two-factor authentication", "username", user.Username)
+					recordAudit(r, AuditEvent{Action: AUDIT_2FA, Actor: user.Username, Detail: "enabled"})
+					data.Enabled = true
+					data.RecoveryCodes = codes
+					data.Message = "Two-factor authentication enabled, store these recovery codes in a safe place. Every code works once and they won't be shown again."
+					renderPage(w, r, "2fa.html", data)
+					return
+				}
+			} else {
+				data.Message = "Invalid code, please try again."
+			}
+		}
+	} else if r.Method != "GET" {
+		renderError(w, r, methodNotAllowed("GET", "POST"))
+		return
+	}
+
+	if !data.Enabled {
+		secret, err := pendingEnrollments.Start(session.Key)
+		if err != nil {
+			renderError(w, r, internalError(fmt.Errorf("couldn't generate totp secret: %w", err)))
+			return
+		}
+		data.Secret = secret
+		uri := totpURI(config.Title, user.Username, secret)
+		data.URI = template.URL(uri)
+		data.QRCode, err = qrCodeSVG(uri)
+		if err != nil {
+			logger.Error("couldn't render qr code", "error", err)
+		}
+	}
+
+	renderPage(w, r, "2fa.html", data)
+}
+
+// disableTOTP removes the second factor after checking a current code, it returns a message when that isn't possible
+func disableTOTP(user User, code string, required bool, bc BlogConfiguration) string {
+	if required {
+		return "Two-factor authentication is required for admins."
+	}
+	ok, err := verifySecondFactor(user, code, bc)
+	if err != nil || !ok {
+		return "Invalid code, please try again."
+	}
+
+	user, _ = lookupUser(user.Username, bc)
+	user.TOTPSecret = ""
+	user.TOTPLastCounter = 0
+	user.RecoveryCodes = nil
+	err = saveUserKeepingLegacyPassword(user, bc)
+	if err != nil {
+		return "Disabling two-factor authentication failed!"
+	}
+	return ""
+}
+
+// saveUserKeepingLegacyPassword stores the user, the legacy admin keeps using the configured password instead of a copy
+func saveUserKeepingLegacyPassword(user User, bc BlogConfiguration) error {
+	if user.Username == LEGACY_ADMIN && user.PasswordHash == bc.Hash {
+		user.PasswordHash = ""
+	}
+	return siteOf(bc).Users().Save(user)
+}
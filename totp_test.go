@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// secret of the RFC 6238 test vectors, "12345678901234567890" in base32
+const testTOTPSecret string = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	vectors := map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"}
+	for unix, expected := range vectors {
+		code, err := totpCode(testTOTPSecret, unix/TOTP_PERIOD)
+		if err != nil || code != expected {
+			t.Fatalf("Code at %v should be %v, got %v", unix, expected, code)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	counter, ok := verifyTOTP(testTOTPSecret, "081804", now, 0)
+	if !ok || counter != 1111111109/TOTP_PERIOD {
+		t.Fatal("Current code should be accepted")
+	}
+
+	_, ok = verifyTOTP(testTOTPSecret, "081804", now.Add(30*time.Second), 0)
+	if !ok {
+		t.Fatal("Code of the previous time step should be accepted")
+	}
+
+	_, ok = verifyTOTP(testTOTPSecret, "081804", now.Add(90*time.Second), 0)
+	if ok {
+		t.Fatal("Old codes should be rejected")
+	}
+
+	_, ok = verifyTOTP(testTOTPSecret, "081804", now, counter)
+	if ok {
+		t.Fatal("Used codes should be rejected")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashed, err := generateRecoveryCodes(10)
+	if err != nil || len(codes) != 10 || len(hashed) != 10 {
+		t.Fatal("Generating recovery codes should succeed")
+	}
+
+	user := User{RecoveryCodes: hashed}
+	if !useRecoveryCode(&user, strings.ToUpper(codes[3])) || len(user.RecoveryCodes) != 9 {
+		t.Fatal("Recovery code should be accepted once")
+	}
+	if useRecoveryCode(&user, codes[3]) {
+		t.Fatal("Recovery code should not be accepted twice")
+	}
+}
+
+func TestLoginWithTOTP(t *testing.T) {
+	userStore = newMemoryUserStore()
+	sessionStore = newMemorySessionStore()
+	pendingLogins = &pendingLoginStore{logins: map[string]pendingLogin{}}
+	loginGuard = newLoginThrottle(5, time.Hour, 100)
+	config := BlogConfiguration{TemplateDir: "templates", UsersFile: filepath.Join(t.TempDir(), "users.json"), SessionTimeout: 60, RememberMeDays: 30}
+	blogConfig.Set(config)
+	err := reloadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashed, _ := hashPassword("secret", testArgon2Params)
+	userStore.Save(User{Username: "alice", PasswordHash: hashed, Role: ROLE_AUTHOR, TOTPSecret: testTOTPSecret})
+
+	recorder := httptest.NewRecorder()
+	r := newFormRequest("/login", "username=alice&password=secret&csrf_token=token")
+	r.AddCookie(&http.Cookie{Name: CSRF_COOKIE, Value: "token"})
+	loginHandler(recorder, r)
+	if len(sessionStore.(*memorySessionStore).sessions) != 0 || !strings.Contains(recorder.Body.String(), `name="code"`) {
+		t.Fatal("Password alone should not create a session when two-factor authentication is enabled")
+	}
+	pending := recorder.Result().Cookies()[0]
+
+	code, _ := totpCode(testTOTPSecret, time.Now().Unix()/TOTP_PERIOD)
+	for _, submitted := range []string{"000000", code} {
+		recorder = httptest.NewRecorder()
+		r = newFormRequest("/login", "code="+submitted+"&csrf_token=token")
+		r.AddCookie(&http.Cookie{Name: CSRF_COOKIE, Value: "token"})
+		r.AddCookie(pending)
+		loginHandler(recorder, r)
+	}
+
+	sessions, _ := sessionStore.List()
+	if len(sessions) != 1 || sessions[0].Username != "alice" {
+		t.Fatal("Valid code should complete the login")
+	}
+}
+
+func TestRequire2FA(t *testing.T) {
+	userStore = newMemoryUserStore()
+	sessionStore = newMemorySessionStore()
+	config := BlogConfiguration{Hash: "filler", Require2FA: true, SessionTimeout: 60, RememberMeDays: 30}
+	blogConfig.Set(config)
+	userStore.Save(User{Username: "root", Role: ROLE_ADMIN})
+	userStore.Save(User{Username: "alice", Role: ROLE_AUTHOR})
+
+	_, err := parseFlags([]string{"-require2fa"})
+	if err == nil || !strings.Contains(err.Error(), "usersfile") {
+		t.Fatalf("Requiring two-factor authentication without a users file should be rejected, got %v", err)
+	}
+	_, err = parseFlags([]string{"-require2fa", "-usersfile", filepath.Join(t.TempDir(), "users.json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for username, allowed := range map[string]bool{"root": false, "alice": true} {
+		recorder := httptest.NewRecorder()
+		createSession(recorder, httptest.NewRequest("POST", "/login", nil), config, username, false)
+		r := httptest.NewRequest("GET", "/create", nil)
+		r.AddCookie(recorder.Result().Cookies()[0])
+		_, _, err := currentUser(r, config)
+		if (err == nil) != allowed {
+			t.Fatalf("Admins without two-factor authentication should have to enroll first (user %v)", username)
+		}
+	}
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	userStore = newMemoryUserStore()
+	sessionStore = newMemorySessionStore()
+	pendingEnrollments = &pendingEnrollmentStore{enrollments: map[string]pendingEnrollment{}}
+	config := BlogConfiguration{Hash: "filler", TemplateDir: "templates", UsersFile: filepath.Join(t.TempDir(), "users.json"), SessionTimeout: 60, RememberMeDays: 30}
+	blogConfig.Set(config)
+	err := reloadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	userStore.Save(User{Username: "alice", Role: ROLE_AUTHOR})
+	recorder := httptest.NewRecorder()
+	session, err := createSession(recorder, httptest.NewRequest("POST", "/login", nil), config, "alice", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := recorder.Result().Cookies()[0]
+
+	recorder = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/2fa", nil)
+	r.AddCookie(cookie)
+	twoFactorHandler(recorder, r)
+	secret, ok := pendingEnrollments.Get(session.Key)
+	if !ok || !strings.Contains(recorder.Body.String(), secret) || strings.Contains(recorder.Body.String(), `name="secret"`) {
+		t.Fatal("The secret should be shown and kept on the server, not sent back with the form")
+	}
+
+	enroll := func(form string) {
+		r := newFormRequest("/2fa", form+"&csrf_token="+session.CSRFToken)
+		r.AddCookie(cookie)
+		twoFactorHandler(httptest.NewRecorder(), r)
+	}
+	code, _ := totpCode(testTOTPSecret, time.Now().Unix()/TOTP_PERIOD)
+	enroll("secret=" + testTOTPSecret + "&code=" + code)
+	if user, _, _ := userStore.Get("alice"); user.TOTPSecret != "" {
+		t.Fatal("A secret chosen by the client should never be enabled")
+	}
+
+	code, _ = totpCode(secret, time.Now().Unix()/TOTP_PERIOD)
+	enroll("code=" + code)
+	if user, _, _ := userStore.Get("alice"); user.TOTPSecret != secret {
+		t.Fatal("A valid code should enable the pending secret")
+	}
+	if _, ok := pendingEnrollments.Get(session.Key); ok {
+		t.Fatal("The pending secret should be dropped after enrolling")
+	}
+}
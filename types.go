@@ -1,51 +1,177 @@
 package main
 
+import (
+	"html/template"
+	"log/slog"
+	"net/netip"
+	"time"
+)
+
 type BlogConfiguration struct {
-	Title       string
-	Hash        string
-	Salt        [4]byte
-	Port        int
-	PostDir     string
-	TemplateDir string
-	FileDir     string
-	ViewOnly    bool
+	ConfigFile            string
+	Title                 string
+	BaseURL               string
+	BasePath              string
+	Hash                  string
+	Port                  int
+	PostDir               string
+	TemplateDir           string
+	FileDir               string
+	PostsPerPage          int
+	Location              *time.Location
+	MarkdownExtensions    []string
+	MarkdownUnsafe        bool
+	MarkdownHardWraps     bool
+	DateFormat            string
+	Locale                string
+	Theme                 string
+	ThemeDir              string
+	ThemeOptions          map[string]string
+	theme                 Theme
+	Watch                 bool
+	ShutdownTimeout       int
+	MetricsPort           int
+	TLSCert               string
+	TLSKey                string
+	TLSSelfSigned         bool
+	RedirectPort          int
+	LogLevel              slog.Level
+	LogFormat             string
+	TrustedProxies        []netip.Prefix
+	ContentSecurityPolicy string
+	ReferrerPolicy        string
+	PermissionsPolicy     string
+	FrameOptions          string
+	HSTSMaxAge            int
+	UsersFile             string
+	AuditFile             string
+	Require2FA            bool
+	OIDCIssuer            string
+	OIDCClientID          string
+	OIDCClientSecret      string
+	OIDCRedirectURL       string
+	OIDCScopes            string
+	OIDCGroupsClaim       string
+	OIDCAllowed           []string
+	SessionFile           string
+	SessionTimeout        int
+	RememberMeDays        int
+	LoginRateLimit        int
+	LoginFreeFailures     int
+	LoginMaxLockout       int
+	LoginGlobalFailures   int
+	ViewOnly              bool
+	Sites                 []SiteConfiguration
+	site                  *Site
+}
+
+// SiteConfiguration is an additional site from the config file, served for requests to one of its hosts
+type SiteConfiguration struct {
+	Name     string
+	Hosts    []string
+	Config   BlogConfiguration
+	Settings []ConfigSetting
 }
 
 func (bc BlogConfiguration) isPasswordless() bool {
-	if bc.ViewOnly || bc.Hash == "" {
+	if bc.ViewOnly || (bc.Hash == "" && bc.UsersFile == "" && bc.OIDCIssuer == "") {
 		return true
 	}
 	return false
 }
 
+// location is the time zone post timestamps are written in
+func (bc BlogConfiguration) location() *time.Location {
+	if bc.Location == nil {
+		return time.Local
+	}
+	return bc.Location
+}
+
 type TemplateData struct {
-	Title string
-	Page  string
+	Title        string
+	Page         template.HTML
+	HasSession   bool
+	Username     string
+	IsAdmin      bool
+	PreviewTheme string
 }
 
 type CreatePostData struct {
 	Title       string
 	Text        string
 	Publish     bool
-	HTMLMessage string
+	HTMLMessage template.HTML
+	Author      string
 }
 
 type PostHeader struct {
 	Title        string
 	Timestamp    string
+	Author       string
+	AuthorName   string
 	URL          string
 	ContentIndex int
 }
 
 type PostData struct {
 	PostHeader
-	Text string
+	Text template.HTML
 }
 
 type PageParameters[T any] struct {
 	PageData     T
 	HasSession   bool
+	CanEdit      bool
 	CurrentPage  int
 	NextPage     int
 	PreviousPage int
+	TotalPages   int
+	Pages        []PageLink
+	Cursor       string
+	NextCursor   string
+}
+
+type PageLink struct {
+	Number  int
+	Path    string
+	Current bool
+	Gap     bool
+}
+
+type TwoFactorData struct {
+	Enabled       bool
+	Required      bool
+	Secret        string
+	URI           template.URL
+	QRCode        template.HTML
+	RecoveryCodes []string
+	Message       string
+}
+
+type AuditListData struct {
+	Events      []AuditEvent
+	Filter      AuditFilter
+	Actions     []string
+	Truncated   bool
+	ExportQuery template.URL
+}
+
+type ThemeListData struct {
+	Themes  []Theme
+	Active  string
+	Preview string
+	Message string
+}
+
+type UserListData struct {
+	Users   []User
+	Roles   []string
+	Message string
+}
+
+type SessionListData struct {
+	Sessions   []Session
+	CurrentKey string
+	Message    string
 }
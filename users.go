@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const ROLE_ADMIN string = "admin"
+const ROLE_EDITOR string = "editor"
+const ROLE_AUTHOR string = "author"
+
+// LEGACY_ADMIN is the user the -password, -passwordhash and -credentialsfile credentials belong to
+const LEGACY_ADMIN string = "admin"
+
+var roles []string = []string{ROLE_ADMIN, ROLE_EDITOR, ROLE_AUTHOR}
+var usernamePattern *regexp.Regexp = regexp.MustCompile(`^[a-z0-9_.-]{1,32}$`)
+
+var userStore UserStore = newMemoryUserStore()
+
+var dummyPasswordHash func() string = sync.OnceValue(func() string {
+	hashed, _ := hashPassword("golb", defaultArgon2Params)
+	return hashed
+})
+
+type User struct {
+	Username        string
+	DisplayName     string
+	PasswordHash    string
+	Role            string
+	TOTPSecret      string   `json:",omitempty"`
+	TOTPLastCounter int64    `json:",omitempty"`
+	RecoveryCodes   []string `json:",omitempty"`
+	SSO             bool     `json:"-"`
+}
+
+func (user User) IsAdmin() bool {
+	return user.Role == ROLE_ADMIN
+}
+
+// CanEditAll is true for roles that may edit and delete posts of other users
+func (user User) CanEditAll() bool {
+	return user.Role == ROLE_ADMIN || user.Role == ROLE_EDITOR
+}
+
+func (user User) CanEditPost(author string) bool {
+	return user.CanEditAll() || (author != "" && author == user.Username)
+}
+
+func (user User) Name() string {
+	if user.DisplayName != "" {
+		return user.DisplayName
+	}
+	return user.Username
+}
+
+type UserStore interface {
+	Get(username string) (User, bool, error)
+	Save(user User) error
+	Delete(username string) error
+	List() ([]User, error)
+}
+
+type memoryUserStore struct {
+	users map[string]User
+	mutex sync.Mutex
+}
+
+func newMemoryUserStore() *memoryUserStore {
+	return &memoryUserStore{users: map[string]User{}}
+}
+
+func (store *memoryUserStore) Get(username string) (User, bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	user, ok := store.users[username]
+	return user, ok, nil
+}
+
+func (store *memoryUserStore) Save(user User) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.users[user.Username] = user
+	return nil
+}
+
+func (store *memoryUserStore) Delete(username string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.users, username)
+	return nil
+}
+
+func (store *memoryUserStore) List() ([]User, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	var users []User = []User{}
+	for _, user := range store.users {
+		users = append(users, user)
+	}
+	slices.SortFunc(users, func(a User, b User) int {
+		return strings.Compare(a.Username, b.Username)
+	})
+	return users, nil
+}
+
+// fileUserStore keeps the users in a json file, which can also be edited by hand while golb isn't running
+type fileUserStore struct {
+	memoryUserStore
+	filename  string
+	fileMutex sync.Mutex
+}
+
+func newFileUserStore(filename string) (*fileUserStore, error) {
+	store := &fileUserStore{memoryUserStore: memoryUserStore{users: map[string]User{}}, filename: filename}
+
+	filebytes, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var users []User
+	err = json.Unmarshal(filebytes, &users)
+	if err != nil {
+		return nil, errors.New("couldn't parse users file " + filename + ": " + err.Error())
+	}
+	for _, user := range users {
+		err = validateUser(user)
+		if err != nil {
+			return nil, errors.New("invalid user in " + filename + ": " + err.Error())
+		}
+		store.users[user.Username] = user
+	}
+
+	return store, nil
+}
+
+func (store *fileUserStore) persist() error {
+	store.fileMutex.Lock()
+	defer store.fileMutex.Unlock()
+
+	users, _ := store.memoryUserStore.List()
+	filebytes, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(store.filename, filebytes, 0600)
+}
+
+func (store *fileUserStore) Save(user User) error {
+	store.memoryUserStore.Save(user)
+	return store.persist()
+}
+
+func (store *fileUserStore) Delete(username string) error {
+	store.memoryUserStore.Delete(username)
+	return store.persist()
+}
+
+func validateUser(user User) error {
+	if !usernamePattern.MatchString(user.Username) {
+		return errors.New("username " + user.Username + " may only contain a-z, 0-9, _, . and - and be at most 32 characters")
+	}
+	if !slices.Contains(roles, user.Role) {
+		return errors.New("role of " + user.Username + " must be one of " + strings.Join(roles, ", "))
+	}
+	if user.PasswordHash != "" {
+		_, _, _, err := decodePasswordHash(user.PasswordHash)
+		if err != nil {
+			return errors.New("password hash of " + user.Username + " is invalid: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// lookupUser returns the user from the store. The legacy admin named admin logs in with the configured password
+// when the store has no user of that name or the stored one has no password, even if other admins exist.
+func lookupUser(username string, bc BlogConfiguration) (User, bool) {
+	user, ok, err := siteOf(bc).Users().Get(username)
+	if err == nil && ok {
+		if user.Username == LEGACY_ADMIN && user.PasswordHash == "" {
+			user.PasswordHash = bc.Hash
+		}
+		return user, true
+	}
+	if username == LEGACY_ADMIN && bc.Hash != "" {
+		return User{Username: LEGACY_ADMIN, DisplayName: "Admin", PasswordHash: bc.Hash, Role: ROLE_ADMIN}, true
+	}
+	return User{}, false
+}
+
+// draftFilename is where the unpublished preview of a user is kept, the extension keeps it out of the post list
+func draftFilename(username string) string {
+	if username == LEGACY_ADMIN {
+		return "_createpost.temp"
+	}
+	return "_createpost." + username + ".temp"
+}
+
+func displayName(username string, bc BlogConfiguration) string {
+	user, ok := lookupUser(username, bc)
+	if !ok {
+		return username
+	}
+	return user.Name()
+}
+
+// userForSession returns the user of a session, single sign-on users are admins for as long as their claims are allowed
+func userForSession(session Session, bc BlogConfiguration) (User, bool) {
+	if session.SSO != nil {
+		if bc.OIDCIssuer == "" || !ssoAllowed(*session.SSO, bc.OIDCAllowed) {
+			return User{}, false
+		}
+		return User{Username: session.Username, DisplayName: session.SSO.Name, Role: ROLE_ADMIN, SSO: true}, true
+	}
+	return lookupUser(sessionUsername(session), bc)
+}
+
+// currentUser returns the logged in user of the request, sessions of deleted users are invalid
+func currentUser(r *http.Request, bc BlogConfiguration) (User, Session, error) {
+	session, err := currentSession(r, bc)
+	if err != nil {
+		return User{}, Session{}, err
+	}
+
+	user, ok := userForSession(session, bc)
+	if !ok {
+		return User{}, Session{}, errors.New("user " + sessionUsername(session) + " doesn't exist anymore or lost access")
+	}
+	if requiresTOTPEnrollment(user, bc) {
+		return User{}, Session{}, errors.New("user " + user.Username + " has to enable two-factor authentication first")
+	}
+	return user, session, nil
+}
+
+func usersHandler(w http.ResponseWriter, r *http.Request) {
+	config := requestSite(r).Config()
+	logger := requestLogger(r)
+	user, _, err := currentUser(r, config)
+	if err != nil {
+		redirect(w, r, "/login", 307)
+		return
+	}
+	if !user.IsAdmin() {
+		renderError(w, r, forbidden("Only admins can manage users!"))
+		return
+	}
+
+	data := UserListData{Roles: roles}
+	if r.Method == "POST" {
+		err := r.ParseForm()
+		if err == nil {
+			err = checkCSRF(r, config)
+		}
+		if err != nil {
+			renderCSRFError(w, r, err)
+			return
+		}
+
+		data.Message = applyUserForm(r, user, logger)
+	} else if r.Method != "GET" {
+		renderError(w, r, methodNotAllowed("GET", "POST"))
+		return
+	}
+
+	users, err := siteOf(config).Users().List()
+	if err != nil {
+		renderError(w, r, internalError(fmt.Errorf("couldn't list users: %w", err)))
+		return
+	}
+	data.Users = users
+
+	renderPage(w, r, "users.html", data)
+}
+
+// applyUserForm creates, updates or deletes the user in the submitted form and returns the message to show
+func applyUserForm(r *http.Request, admin User, logger *slog.Logger) string {
+	config := requestSite(r).Config()
+	store := siteOf(config).Users()
+	username := strings.TrimSpace(strings.ToLower(r.PostFormValue("username")))
+	existing, exists, err := store.Get(username)
+	if err != nil {
+		logger.Error("couldn't read user", "username", username, "error", err)
+		return "Something went wrong, please try again!"
+	}
+
+	if r.PostFormValue("delete") != "" {
+		if !exists {
+			return "User " + username + " doesn't exist!"
+		}
+		if username == admin.Username {
+			return "You can't delete yourself!"
+		}
+		err = store.Delete(username)
+		if err != nil {
+			logger.Error("couldn't delete user", "username", username, "error", err)
+			return "Deleting user failed!"
+		}
+		revokeUserSessions(username, config)
+		logger.Info("deleted user", "username", username, "actor", admin.Username)
+		recordAudit(r, AuditEvent{Action: AUDIT_USER_DELETE, Actor: admin.Username, Detail: username})
+		return "Deleted user " + username
+	}
+
+	user := existing
+	user.Username = username
+	user.DisplayName = strings.TrimSpace(r.PostFormValue("displayname"))
+	user.Role = r.PostFormValue("role")
+	if username == admin.Username && user.Role != ROLE_ADMIN {
+		return "You can't remove your own admin role!"
+	}
+
+	password := r.PostFormValue("password")
+	if password != "" {
+		hashed, err := hashPassword(password, defaultArgon2Params)
+		if err != nil {
+			return "Couldn't set password: " + err.Error()
+		}
+		user.PasswordHash = hashed
+	} else if !exists {
+		return "New users need a password!"
+	}
+
+	err = validateUser(user)
+	if err != nil {
+		return err.Error()
+	}
+
+	err = store.Save(user)
+	if err != nil {
+		logger.Error("couldn't save user", "username", username, "error", err)
+		return "Saving user failed!"
+	}
+	if password != "" && exists {
+		revokeUserSessions(username, config)
+	}
+
+	logger.Info("saved user", "username", username, "role", user.Role, "actor", admin.Username)
+	detail := username + " with role " + user.Role
+	if password != "" {
+		detail += " and a new password"
+	}
+	recordAudit(r, AuditEvent{Action: AUDIT_USER_SAVE, Actor: admin.Username, Detail: detail})
+	if exists {
+		return "Updated user " + username
+	}
+	return "Created user " + username
+}
+
+func revokeUserSessions(username string, bc BlogConfiguration) {
+	store := siteOf(bc).Sessions()
+	sessions, err := store.List()
+	if err != nil {
+		return
+	}
+	for _, session := range sessions {
+		if sessionUsername(session) == username {
+			store.Delete(session.Key)
+		}
+	}
+}
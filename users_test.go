@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUserPermissions(t *testing.T) {
+	admin := User{Username: "root", Role: ROLE_ADMIN}
+	editor := User{Username: "ed", Role: ROLE_EDITOR}
+	author := User{Username: "alice", Role: ROLE_AUTHOR}
+
+	if !admin.CanEditPost("alice") || !editor.CanEditPost("alice") || !editor.CanEditPost("") {
+		t.Fatal("Admins and editors should be able to edit all posts")
+	}
+	if !author.CanEditPost("alice") || author.CanEditPost("bob") || author.CanEditPost("") {
+		t.Fatal("Authors should only be able to edit their own posts")
+	}
+	if !admin.IsAdmin() || editor.IsAdmin() || author.IsAdmin() {
+		t.Fatal("Only admins should be admins")
+	}
+}
+
+func TestValidateUser(t *testing.T) {
+	if validateUser(User{Username: "alice", Role: ROLE_AUTHOR}) != nil {
+		t.Fatal("Valid user should pass validation")
+	}
+	if validateUser(User{Username: "Alice Smith", Role: ROLE_AUTHOR}) == nil {
+		t.Fatal("Username with spaces and capitals should fail validation")
+	}
+	if validateUser(User{Username: "alice", Role: "owner"}) == nil {
+		t.Fatal("Unknown role should fail validation")
+	}
+	if validateUser(User{Username: "alice", Role: ROLE_AUTHOR, PasswordHash: "plaintext"}) == nil {
+		t.Fatal("Invalid password hash should fail validation")
+	}
+}
+
+func TestLookupUser(t *testing.T) {
+	userStore = newMemoryUserStore()
+	config := BlogConfiguration{Hash: "legacyhash"}
+
+	user, ok := lookupUser(LEGACY_ADMIN, config)
+	if !ok || user.PasswordHash != "legacyhash" || !user.IsAdmin() {
+		t.Fatal("Configured password should belong to the legacy admin")
+	}
+
+	userStore.Save(User{Username: LEGACY_ADMIN, PasswordHash: "storedhash", Role: ROLE_EDITOR})
+	user, ok = lookupUser(LEGACY_ADMIN, config)
+	if !ok || user.PasswordHash != "storedhash" {
+		t.Fatal("Stored user should take precedence over the legacy admin")
+	}
+
+	_, ok = lookupUser("nobody", config)
+	if ok {
+		t.Fatal("Unknown user should not be found")
+	}
+}
+
+func TestFileUserStore(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "users.json")
+	store, err := newFileUserStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Save(User{Username: "alice", DisplayName: "Alice", Role: ROLE_AUTHOR})
+	store.Save(User{Username: "bob", Role: ROLE_EDITOR})
+	store.Delete("bob")
+
+	store, err = newFileUserStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, _ := store.List()
+	if len(users) != 1 || users[0].Username != "alice" || users[0].DisplayName != "Alice" {
+		t.Fatal("Users are not persisted across restarts")
+	}
+}
+
+func TestUsersHandler(t *testing.T) {
+	userStore = newMemoryUserStore()
+	sessionStore = newMemorySessionStore()
+	config := BlogConfiguration{Hash: "filler", SessionTimeout: 60, RememberMeDays: 30}
+	blogConfig.Set(config)
+	userStore.Save(User{Username: "root", Role: ROLE_ADMIN})
+	userStore.Save(User{Username: "alice", Role: ROLE_AUTHOR})
+
+	post := func(username string, form string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		session, _ := createSession(recorder, httptest.NewRequest("POST", "/login", nil), config, username, false)
+		r := newFormRequest("/users", form+"&csrf_token="+session.CSRFToken)
+		r.AddCookie(recorder.Result().Cookies()[0])
+		recorder = httptest.NewRecorder()
+		usersHandler(recorder, r)
+		return recorder
+	}
+
+	recorder := post("alice", "username=mallory&role=admin&password=secret")
+	_, exists, _ := userStore.Get("mallory")
+	if recorder.Code != 403 || exists {
+		t.Fatal("Authors should not be able to manage users")
+	}
+
+	post("root", "username=bob&role=editor&password=secret")
+	bob, exists, _ := userStore.Get("bob")
+	if !exists || bob.Role != ROLE_EDITOR || !strings.HasPrefix(bob.PasswordHash, "$argon2id$") {
+		t.Fatal("Admins should be able to create users")
+	}
+
+	post("alice", "")
+	post("root", "username=alice&delete=1")
+	_, exists, _ = userStore.Get("alice")
+	sessions, _ := sessionStore.List()
+	for _, session := range sessions {
+		if session.Username == "alice" {
+			t.Fatal("Deleting a user should revoke their sessions")
+		}
+	}
+	if exists {
+		t.Fatal("Admins should be able to delete users")
+	}
+}
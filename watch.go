@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// watchDirectories calls onChange for every directory in dirs that had changes, once no new changes came in for the debounce duration.
+// inotify is used when available, otherwise the directories are polled every pollInterval.
+// Watching stops when ctx is cancelled.
+func watchDirectories(ctx context.Context, dirs []string, debounce time.Duration, pollInterval time.Duration, onChange func(dir string)) {
+	events := make(chan string, 64)
+
+	err := watchNotify(ctx, dirs, events)
+	if err != nil {
+		slog.Warn("filesystem notifications unavailable, falling back to polling", "error", err)
+		go watchPoll(ctx, dirs, pollInterval, events)
+	}
+
+	debounceEvents(ctx, events, debounce, onChange)
+}
+
+func debounceEvents(ctx context.Context, events <-chan string, debounce time.Duration, onChange func(dir string)) {
+	pending := map[string]bool{}
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case dir, ok := <-events:
+			if !ok {
+				return
+			}
+			pending[dir] = true
+			timer.Reset(debounce)
+		case <-timer.C:
+			for dir := range pending {
+				onChange(dir)
+			}
+			pending = map[string]bool{}
+		}
+	}
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+func snapshotDirectory(dir string) map[string]fileState {
+	var snapshot map[string]fileState = map[string]fileState{}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return snapshot
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		snapshot[filepath.Join(dir, entry.Name())] = fileState{modTime: info.ModTime(), size: info.Size()}
+	}
+
+	return snapshot
+}
+
+func snapshotsEqual(a map[string]fileState, b map[string]fileState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, state := range a {
+		other, ok := b[name]
+		if !ok || !state.modTime.Equal(other.modTime) || state.size != other.size {
+			return false
+		}
+	}
+	return true
+}
+
+func watchPoll(ctx context.Context, dirs []string, interval time.Duration, events chan<- string) {
+	var snapshots map[string]map[string]fileState = map[string]map[string]fileState{}
+	for _, dir := range dirs {
+		snapshots[dir] = snapshotDirectory(dir)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, dir := range dirs {
+			snapshot := snapshotDirectory(dir)
+			if !snapshotsEqual(snapshots[dir], snapshot) {
+				snapshots[dir] = snapshot
+				select {
+				case events <- dir:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}
+}
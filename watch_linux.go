@@ -0,0 +1,66 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask uint32 = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE
+
+func watchNotify(ctx context.Context, dirs []string, events chan<- string) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+
+	var watches map[int32]string = map[int32]string{}
+	for _, dir := range dirs {
+		wd, err := syscall.InotifyAddWatch(fd, dir, inotifyMask)
+		if err != nil {
+			syscall.Close(fd)
+			return err
+		}
+		watches[int32(wd)] = dir
+	}
+
+	// a non-blocking fd wrapped in an os.File goes through the runtime poller, so closing it unblocks a pending read
+	file := os.NewFile(uintptr(fd), "inotify")
+	go func() {
+		<-ctx.Done()
+		file.Close()
+	}()
+	go readNotify(ctx, file, watches, events)
+	return nil
+}
+
+func readNotify(ctx context.Context, file *os.File, watches map[int32]string, events chan<- string) {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+
+	for {
+		n, err := file.Read(buf)
+		if err != nil || n <= 0 {
+			if ctx.Err() == nil {
+				slog.Error("stopped watching filesystem", "error", err)
+			}
+			return
+		}
+
+		offset := 0
+		for offset+syscall.SizeofInotifyEvent <= n {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			if dir, ok := watches[event.Wd]; ok {
+				select {
+				case events <- dir:
+				case <-ctx.Done():
+					return
+				}
+			}
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+		}
+	}
+}
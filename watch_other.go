@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+func watchNotify(ctx context.Context, dirs []string, events chan<- string) error {
+	return errors.New("inotify is only available on linux")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchDirectories(t *testing.T) {
+	dir := t.TempDir()
+	changed := make(chan string, 8)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchDirectories(ctx, []string{dir}, 50*time.Millisecond, 100*time.Millisecond, func(d string) { changed <- d })
+	time.Sleep(100 * time.Millisecond)
+
+	err := os.WriteFile(filepath.Join(dir, "test.md"), []byte("### test\n---\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case d := <-changed:
+		if d != dir {
+			t.Fatalf("Change reported for wrong directory %v != %v", d, dir)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Change in watched directory was not reported")
+	}
+}
+
+func TestWatchPoll(t *testing.T) {
+	dir := t.TempDir()
+	events := make(chan string, 8)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchPoll(ctx, []string{dir}, 50*time.Millisecond, events)
+	time.Sleep(100 * time.Millisecond)
+
+	err := os.WriteFile(filepath.Join(dir, "test.html"), []byte("test"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-events:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Polling did not detect a new file")
+	}
+}
+
+func TestReloadTemplatesKeepsPrevious(t *testing.T) {
+	dir := t.TempDir()
+	blogConfig.Set(BlogConfiguration{TemplateDir: dir})
+	err := os.WriteFile(filepath.Join(dir, "_base.html"), []byte("{{.Title}}"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = reloadTemplates()
+	if err != nil {
+		t.Fatal("Reloading valid templates should succeed")
+	}
+	previous := templates.Get()
+
+	err = os.WriteFile(filepath.Join(dir, "broken.html"), []byte("{{.Title"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = reloadTemplates()
+	if err == nil || templates.Get() != previous {
+		t.Fatal("Reloading broken templates should fail and keep the previous templates")
+	}
+}